@@ -0,0 +1,188 @@
+package chik
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gochik/chik/config"
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+)
+
+const accessConfigKey = "access"
+
+// Role defines what a remote peer is allowed to send
+type Role struct {
+	// ReadOnly roles can only send commands that do not change anything:
+	// GET actions, status queries and subscriptions, heartbeats and replies
+	ReadOnly bool `json:"read_only" mapstructure:"read_only"`
+
+	// Allow, if not empty, lists the only command types the role can send
+	Allow []string `json:"allow" mapstructure:"allow"`
+
+	// Deny lists the command types the role cannot send
+	Deny []string `json:"deny" mapstructure:"deny"`
+}
+
+// AccessPolicy decides which commands coming from remote peers get published on the controller.
+// Peers map the peer UUID to a role, it applies only once the peer is authenticated (see Controller.Authenticated):
+// unknown and unauthenticated peers get the Default role. Local clients (see ListenUnix) get the Local role.
+// An empty role name allows the peers getting it to send anything. It is read from the "access" config key, eg:
+//
+//	"access": {"default": "guest", "roles": {"guest": {"read_only": true, "deny": ["SystemdRequestCommandType"]}, "owner": {}}, "peers": {"<uuid>": "owner"}}
+type AccessPolicy struct {
+	Default string            `json:"default" mapstructure:"default"`
+	Local   string            `json:"local" mapstructure:"local"`
+	Roles   map[string]Role   `json:"roles" mapstructure:"roles"`
+	Peers   map[string]string `json:"peers" mapstructure:"peers"`
+
+	denyAll bool
+}
+
+// denyAllPolicy is used in place of an invalid policy: remote peers cannot send anything
+func denyAllPolicy() *AccessPolicy {
+	return &AccessPolicy{denyAll: true}
+}
+
+// readCommandTypes can be sent by read only roles regardless of their content
+var readCommandTypes = map[types.CommandType]bool{
+	types.HeartbeatType:                 true,
+	types.StatusCommandType:             true,
+	types.StatusNotificationCommandType: true,
+	types.VersionReplyCommandType:       true,
+	types.ActionReplyCommandType:        true,
+	types.SystemdReplyCommandType:       true,
+	types.HandlerReplyCommandType:       true,
+	types.ErrorReplyCommandType:         true,
+	types.AckCommandType:                true,
+}
+
+// LoadAccessPolicy reads the policy from the "access" config key, nil is returned if there is none
+func LoadAccessPolicy() (*AccessPolicy, error) {
+	if config.Get(accessConfigKey) == nil {
+		return nil, nil
+	}
+	var policy AccessPolicy
+	if err := config.GetStruct(accessConfigKey, &policy); err != nil {
+		return nil, err
+	}
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func (p *AccessPolicy) validate() error {
+	if _, ok := p.Roles[p.Default]; p.Default != "" && !ok {
+		return fmt.Errorf("unknown default role %s", p.Default)
+	}
+	if _, ok := p.Roles[p.Local]; p.Local != "" && !ok {
+		return fmt.Errorf("unknown local role %s", p.Local)
+	}
+	for peer, role := range p.Peers {
+		if uuid.FromStringOrNil(peer) == uuid.Nil {
+			return fmt.Errorf("invalid peer id %s", peer)
+		}
+		if _, ok := p.Roles[role]; !ok {
+			return fmt.Errorf("unknown role %s for peer %s", role, peer)
+		}
+	}
+	for name, role := range p.Roles {
+		for _, typeName := range append(append([]string{}, role.Allow...), role.Deny...) {
+			if _, ok := types.CommandTypeByName(typeName); !ok {
+				return fmt.Errorf("unknown command type %s in role %s", typeName, name)
+			}
+		}
+	}
+	return nil
+}
+
+// peerRole returns the role name of the given authenticated peer
+func (p *AccessPolicy) peerRole(peer uuid.UUID) string {
+	name, ok := p.Peers[peer.String()]
+	if !ok {
+		return p.Default
+	}
+	return name
+}
+
+// Check returns an error if the authenticated peer is not allowed to send the command
+func (p *AccessPolicy) Check(peer uuid.UUID, command *types.Command) error {
+	return p.check(p.peerRole(peer), command)
+}
+
+// check returns an error if the named role is not allowed to send the command
+func (p *AccessPolicy) check(name string, command *types.Command) error {
+	if p.denyAll {
+		return fmt.Errorf("%s denied", command.Type)
+	}
+	if name == "" {
+		return nil
+	}
+	role := p.Roles[name]
+	typeName := command.Type.String()
+	for _, denied := range role.Deny {
+		if denied == typeName {
+			return fmt.Errorf("%s denied", typeName)
+		}
+	}
+	if len(role.Allow) > 0 {
+		allowed := false
+		for _, name := range role.Allow {
+			allowed = allowed || name == typeName
+		}
+		if !allowed {
+			return fmt.Errorf("%s not allowed", typeName)
+		}
+	}
+	if role.ReadOnly && !isRead(command) {
+		return fmt.Errorf("%s not allowed to read only peers", typeName)
+	}
+	return nil
+}
+
+// isRead tells if a command does not change anything
+func isRead(command *types.Command) bool {
+	if readCommandTypes[command.Type] {
+		return true
+	}
+	var content struct {
+		Action *types.Action `json:"action"`
+	}
+	if err := json.Unmarshal(command.Data, &content); err != nil {
+		return false
+	}
+	return content.Action != nil && *content.Action == types.GET
+}
+
+// UseAccessPolicy checks every message coming from remote peers against the policy,
+// the role is chosen by the identity of the session that delivered the message, never by its claimed sender.
+// Rejected messages are not published and their sender gets an ErrorReplyCommandType reply
+func (c *Controller) UseAccessPolicy(policy *AccessPolicy) {
+	incoming := types.AnyIncomingCommandType.String()
+	c.UsePublish(func(message *Message, topics []string) (*Message, error) {
+		remote := false
+		for _, topic := range topics {
+			remote = remote || topic == incoming
+		}
+		if !remote {
+			return message, nil
+		}
+		role := policy.Default
+		switch {
+		case message.local:
+			role = policy.Local
+		case c.Authenticated(message.SenderUUID()):
+			role = policy.peerRole(message.SenderUUID())
+		}
+		err := policy.check(role, message.Command())
+		if err != nil {
+			c.Reply(message, types.ErrorReplyCommandType, types.ErrorReply{
+				Type:  message.Command().Type,
+				Error: err.Error(),
+			})
+			return nil, fmt.Errorf("access denied to %v: %w", message.SenderUUID(), err)
+		}
+		return message, nil
+	})
+}
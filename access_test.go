@@ -0,0 +1,155 @@
+package chik
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gochik/chik/config"
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+)
+
+var guestID = uuid.Must(uuid.NewV4())
+var ownerID = uuid.Must(uuid.NewV4())
+
+func testPolicy() *AccessPolicy {
+	return &AccessPolicy{
+		Default: "nobody",
+		Roles: map[string]Role{
+			"nobody": {Allow: []string{"HeartbeatType"}},
+			"guest":  {ReadOnly: true, Deny: []string{"SystemdRequestCommandType"}},
+			"owner":  {},
+		},
+		Peers: map[string]string{
+			guestID.String(): "guest",
+			ownerID.String(): "owner",
+		},
+	}
+}
+
+func TestAccessPolicy(t *testing.T) {
+	policy := testPolicy()
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	get := types.NewCommand(types.ActionRequestCommandType, map[string]interface{}{"action": types.GET})
+	set := types.NewCommand(types.ActionRequestCommandType, map[string]interface{}{"action": types.SET})
+	systemd := types.NewCommand(types.SystemdRequestCommandType, map[string]interface{}{"action": types.GET})
+	status := types.NewCommand(types.StatusCommandType, map[string]interface{}{"action": types.SET})
+	heartbeat := types.NewCommand(types.HeartbeatType, nil)
+
+	testCases := []struct {
+		peer    uuid.UUID
+		command *types.Command
+		allowed bool
+	}{
+		{ownerID, set, true},
+		{ownerID, systemd, true},
+		{guestID, get, true},
+		{guestID, status, true},
+		{guestID, set, false},
+		{guestID, systemd, false},
+		{uuid.Must(uuid.NewV4()), heartbeat, true},
+		{uuid.Must(uuid.NewV4()), get, false},
+	}
+	for i, testCase := range testCases {
+		err := policy.Check(testCase.peer, testCase.command)
+		if (err == nil) != testCase.allowed {
+			t.Errorf("Test case %d: unexpected result %v", i, err)
+		}
+	}
+
+	policy.Roles["guest"] = Role{Deny: []string{"NotACommandType"}}
+	if policy.validate() == nil {
+		t.Error("Unknown command types must be refused")
+	}
+}
+
+func TestAccessPolicyInterceptor(t *testing.T) {
+	controller := NewControllerWithID(uuid.Must(uuid.NewV4()))
+	controller.authenticate = func(peer uuid.UUID) bool { return peer == ownerID }
+	controller.UseAccessPolicy(testPolicy())
+	incoming := controller.Sub(types.DigitalCommandType.String())
+	outgoing := controller.Sub(types.AnyOutgoingCommandType.String())
+
+	message := NewMessage(controller.ID, digitalCommand("light"))
+	message.sender = guestID
+	controller.PubMessage(message, types.AnyIncomingCommandType.String(), types.DigitalCommandType.String())
+
+	select {
+	case data := <-outgoing:
+		reply := data.(*Message)
+		var content types.ErrorReply
+		json.Unmarshal(reply.Command().Data, &content)
+		if reply.Command().Type != types.ErrorReplyCommandType || reply.receiver != guestID || content.Type != types.DigitalCommandType {
+			t.Fatalf("Unexpected reply: %v", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Error reply not sent")
+	}
+
+	message = NewMessage(controller.ID, digitalCommand("light"))
+	message.sender = ownerID
+	controller.PubMessage(message, types.AnyIncomingCommandType.String(), types.DigitalCommandType.String())
+	select {
+	case received := <-incoming:
+		if received.(*Message).SenderUUID() != ownerID {
+			t.Fatalf("Unexpected message: %v", received)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Allowed message not published")
+	}
+}
+
+func TestAccessPolicyIdentity(t *testing.T) {
+	controller := NewControllerWithID(uuid.Must(uuid.NewV4()))
+	policy := testPolicy()
+	policy.Local = "guest"
+	controller.UseAccessPolicy(policy)
+	incoming := controller.Sub(types.ActionRequestCommandType.String())
+
+	testCases := []struct {
+		local   bool
+		command *types.Command
+		allowed bool
+	}{
+		// the owner is not authenticated: it gets the default role
+		{false, types.NewCommand(types.ActionRequestCommandType, map[string]interface{}{"action": types.GET}), false},
+		{true, types.NewCommand(types.ActionRequestCommandType, map[string]interface{}{"action": types.GET}), true},
+		{true, types.NewCommand(types.ActionRequestCommandType, map[string]interface{}{"action": types.SET}), false},
+	}
+	for i, testCase := range testCases {
+		message := NewMessage(controller.ID, testCase.command)
+		message.sender = ownerID
+		message.local = testCase.local
+		controller.PubMessage(message, types.AnyIncomingCommandType.String(), types.ActionRequestCommandType.String())
+		select {
+		case received := <-incoming:
+			if !testCase.allowed {
+				t.Errorf("Test case %d: message published: %v", i, received)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if testCase.allowed {
+				t.Errorf("Test case %d: message not published", i)
+			}
+		}
+	}
+}
+
+func TestInvalidAccessPolicy(t *testing.T) {
+	config.Set(accessConfigKey, map[string]interface{}{"default": "missing"})
+	defer config.Set(accessConfigKey, nil)
+	controller := NewController()
+	incoming := controller.Sub(types.HeartbeatType.String())
+
+	message := NewMessage(controller.ID, types.NewCommand(types.HeartbeatType, nil))
+	message.sender = ownerID
+	controller.PubMessage(message, types.AnyIncomingCommandType.String(), types.HeartbeatType.String())
+	select {
+	case received := <-incoming:
+		t.Fatalf("Message published despite the invalid policy: %v", received)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,197 @@
+// Package chiktest runs handlers on an in-memory controller driven by a simulated clock,
+// allowing to test them without remotes, config files or waiting for the wall clock.
+package chiktest
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gochik/chik"
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+)
+
+// DefaultTimeout is how long the harness waits for handlers to start and for expected messages
+const DefaultTimeout = 2 * time.Second
+
+// Epoch is the time fake clocks created by New start from
+var Epoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Harness is a running controller recording every published message
+type Harness struct {
+	t          testing.TB
+	Controller *chik.Controller
+	Clock      *FakeClock
+	cancel     context.CancelFunc
+	done       chan struct{}
+
+	mutex     sync.Mutex
+	published []*chik.Message
+	cursor    int
+	changed   chan struct{}
+}
+
+// New starts the given handlers on a new controller, waiting for all of them to be running.
+// The controller is stopped when the test ends
+func New(t testing.TB, handlers ...chik.Handler) *Harness {
+	t.Helper()
+	h := &Harness{
+		t:          t,
+		Controller: chik.NewControllerWithID(uuid.Must(uuid.NewV4())),
+		Clock:      NewFakeClock(Epoch),
+		done:       make(chan struct{}),
+		published:  make([]*chik.Message, 0),
+		changed:    make(chan struct{}),
+	}
+	h.Controller.SetClock(h.Clock)
+	h.Controller.UsePublish(h.record)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	go func() {
+		if err := h.Controller.Start(ctx, handlers); err != nil {
+			t.Error(err)
+		}
+		close(h.done)
+	}()
+	t.Cleanup(h.Stop)
+
+	deadline := time.Now().Add(DefaultTimeout)
+	for !h.running(handlers) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Handlers not running: %v", h.Controller.HandlersHealth())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return h
+}
+
+func (h *Harness) running(handlers []chik.Handler) bool {
+	health := h.Controller.HandlersHealth()
+	for _, handler := range handlers {
+		if health[handler.String()].State != chik.HandlerRunning {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Harness) record(message *chik.Message, topics []string) (*chik.Message, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.published = append(h.published, message)
+	close(h.changed)
+	h.changed = make(chan struct{})
+	return message, nil
+}
+
+// Stop stops the controller and waits for the handlers teardown
+func (h *Harness) Stop() {
+	h.cancel()
+	<-h.done
+}
+
+// Publish sends an internal command to the handlers
+func (h *Harness) Publish(command *types.Command) {
+	h.Controller.Pub(command, chik.LoopbackID)
+}
+
+// Advance moves the simulated time forward, see FakeClock.Advance
+func (h *Harness) Advance(d time.Duration) {
+	h.Clock.Advance(d)
+}
+
+// Published returns every message published so far
+func (h *Harness) Published() []*chik.Message {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]*chik.Message{}, h.published...)
+}
+
+// next returns the first message published after the last expected one that satisfies match
+func (h *Harness) next(match func(*chik.Message) bool, timeout time.Duration) *chik.Message {
+	deadline := time.After(timeout)
+	for {
+		h.mutex.Lock()
+		for i := h.cursor; i < len(h.published); i++ {
+			if match(h.published[i]) {
+				h.cursor = i + 1
+				message := h.published[i]
+				h.mutex.Unlock()
+				return message
+			}
+		}
+		changed := h.changed
+		h.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil
+		}
+	}
+}
+
+// ExpectFunc waits for a message satisfying match, published after the previously expected one,
+// and fails the test if it does not come within DefaultTimeout
+func (h *Harness) ExpectFunc(match func(*chik.Message) bool) *chik.Message {
+	h.t.Helper()
+	message := h.next(match, DefaultTimeout)
+	if message == nil {
+		h.t.Fatal("Expected message not published")
+	}
+	return message
+}
+
+// Expect waits for a command of the given type and decodes its payload into data, if not nil
+func (h *Harness) Expect(commandType types.CommandType, data interface{}) *chik.Message {
+	h.t.Helper()
+	message := h.next(IsType(commandType), DefaultTimeout)
+	if message == nil {
+		h.t.Fatalf("Expected %v not published", commandType)
+	}
+	if data != nil {
+		if err := json.Unmarshal(message.Command().Data, data); err != nil {
+			h.t.Fatalf("Cannot decode %v: %v", commandType, err)
+		}
+	}
+	return message
+}
+
+// Settle waits until no message is published for the given time, so that the handlers
+// are done reacting to the previous events before the test moves on
+func (h *Harness) Settle(quiet time.Duration) {
+	h.t.Helper()
+	deadline := time.After(DefaultTimeout)
+	for {
+		h.mutex.Lock()
+		changed := h.changed
+		h.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-time.After(quiet):
+			return
+		case <-deadline:
+			h.t.Fatal("Handlers did not settle")
+		}
+	}
+}
+
+// ExpectNone fails the test if a message satisfying match is published within the given time
+func (h *Harness) ExpectNone(match func(*chik.Message) bool, wait time.Duration) {
+	h.t.Helper()
+	if message := h.next(match, wait); message != nil {
+		h.t.Fatalf("Unexpected message published: %v", message)
+	}
+}
+
+// IsType matches messages carrying a command of the given type
+func IsType(commandType types.CommandType) func(*chik.Message) bool {
+	return func(message *chik.Message) bool {
+		return message.Command().Type == commandType
+	}
+}
@@ -0,0 +1,80 @@
+package chiktest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gochik/chik"
+	"github.com/gochik/chik/types"
+)
+
+type tickHandler struct {
+	chik.BaseHandler
+	ticks chan time.Time
+}
+
+func (h *tickHandler) String() string {
+	return "tick"
+}
+
+func (h *tickHandler) Setup(controller *chik.Controller) (chik.Interrupts, error) {
+	return chik.Interrupts{Timer: chik.NewTimer(10*time.Second, false)}, nil
+}
+
+func (h *tickHandler) HandleTimerEvent(name string, tick time.Time, controller *chik.Controller) error {
+	h.ticks <- tick
+	controller.Pub(types.NewCommand(types.NullCommandType, types.TimeIndication(tick.Unix())), chik.LoopbackID)
+	return nil
+}
+
+func TestFakeClock(t *testing.T) {
+	clock := NewFakeClock(Epoch)
+	timer := clock.NewTimer(time.Minute)
+	stopped := clock.NewTimer(time.Second)
+	if !stopped.Stop() || clock.Pending() != 1 {
+		t.Fatal("Timer not stopped")
+	}
+
+	clock.Advance(30 * time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("Timer fired early")
+	default:
+	}
+
+	clock.Advance(time.Hour)
+	select {
+	case tick := <-timer.C():
+		if !tick.Equal(Epoch.Add(time.Minute)) {
+			t.Fatalf("Unexpected tick time: %v", tick)
+		}
+	default:
+		t.Fatal("Timer did not fire")
+	}
+	if !clock.Now().Equal(Epoch.Add(30*time.Second + time.Hour)) {
+		t.Fatalf("Unexpected clock time: %v", clock.Now())
+	}
+}
+
+func TestSimulatedHours(t *testing.T) {
+	handler := &tickHandler{ticks: make(chan time.Time, 1000)}
+	harness := New(t, handler)
+
+	started := time.Now()
+	harness.Advance(2 * time.Hour)
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Fatalf("Simulation too slow: %v", elapsed)
+	}
+
+	var last types.TimeIndication
+	for i := 0; i < 720; i++ {
+		harness.Expect(types.NullCommandType, &last)
+	}
+	if time.Unix(int64(last), 0).UTC() != Epoch.Add(2*time.Hour) {
+		t.Fatalf("Unexpected last tick: %v", last)
+	}
+	harness.ExpectNone(IsType(types.NullCommandType), 50*time.Millisecond)
+	if len(handler.ticks) != 720 {
+		t.Fatalf("Expected 720 ticks, got %d", len(handler.ticks))
+	}
+}
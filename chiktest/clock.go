@@ -0,0 +1,146 @@
+package chiktest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gochik/chik"
+)
+
+// settleTime is how long Advance waits for a fired timer to be armed again
+const settleTime = 20 * time.Millisecond
+
+// FakeClock is a chik.Clock whose time only moves when Advance is called
+type FakeClock struct {
+	sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	changed chan struct{}
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+// NewFakeClock creates a FakeClock set at the given time
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now:     now,
+		timers:  make([]*fakeTimer, 0),
+		changed: make(chan struct{}),
+	}
+}
+
+// Now returns the simulated time
+func (c *FakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// NewTimer creates a timer firing when the clock is advanced past the given duration
+func (c *FakeClock) NewTimer(d time.Duration) chik.ClockTimer {
+	c.Lock()
+	defer c.Unlock()
+	timer := &fakeTimer{
+		clock:    c,
+		deadline: c.now.Add(d),
+		c:        make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		timer.c <- c.now
+		return timer
+	}
+	c.timers = append(c.timers, timer)
+	sort.SliceStable(c.timers, func(i, j int) bool {
+		return c.timers[i].deadline.Before(c.timers[j].deadline)
+	})
+	c.notify()
+	return timer
+}
+
+// notify wakes up the goroutines waiting for timers, the lock must be held
+func (c *FakeClock) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// remove deletes a pending timer, the lock must be held
+func (c *FakeClock) remove(timer *fakeTimer) bool {
+	for i, t := range c.timers {
+		if t == timer {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			c.notify()
+			return true
+		}
+	}
+	return false
+}
+
+// Pending returns the number of timers waiting to fire
+func (c *FakeClock) Pending() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil waits until at least n timers are pending or the timeout expires,
+// it returns false on timeout
+func (c *FakeClock) BlockUntil(n int, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		c.Lock()
+		pending := len(c.timers)
+		changed := c.changed
+		c.Unlock()
+		if pending >= n {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// Advance moves the clock forward firing, in order, every timer expiring in the meanwhile.
+// After a timer fires Advance waits for it to be armed again, so that periodic timers
+// fire once per period even when the clock is moved by several periods
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Lock()
+	target := c.now.Add(d)
+	c.Unlock()
+	for {
+		c.Lock()
+		if len(c.timers) == 0 || c.timers[0].deadline.After(target) {
+			c.now = target
+			c.Unlock()
+			return
+		}
+		timer := c.timers[0]
+		c.timers = c.timers[1:]
+		if timer.deadline.After(c.now) {
+			c.now = timer.deadline
+		}
+		pending := len(c.timers)
+		timer.c <- c.now
+		c.notify()
+		c.Unlock()
+
+		c.BlockUntil(pending+1, settleTime)
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	return t.clock.remove(t)
+}
@@ -0,0 +1,40 @@
+package chiktest
+
+import (
+	"github.com/gochik/chik"
+	"github.com/gochik/chik/handlers/io/bus"
+	"github.com/gochik/chik/handlers/io/bus/softbus"
+
+	iohandler "github.com/gochik/chik/handlers/io"
+)
+
+// Device describes a device of the IO fixture
+type Device struct {
+	ID    string
+	Kind  bus.DeviceKind
+	Value interface{}
+}
+
+// IO is an io handler whose devices only exist in memory, it needs the status handler
+type IO struct {
+	chik.Handler
+	Bus *softbus.SoftBus
+}
+
+// NewIO creates an IO fixture with the given devices
+func NewIO(devices ...Device) *IO {
+	softBus := softbus.NewSoftBus()
+	for _, device := range devices {
+		softBus.AddDevice(device.ID, device.Kind, device.Value)
+	}
+	return &IO{
+		Handler: iohandler.NewWithBuses(map[string]bus.Bus{softBus.String(): softBus}),
+		Bus:     softBus,
+	}
+}
+
+// Set changes the value of a device as if it was changed by the outside world,
+// the io handler then updates the status
+func (f *IO) Set(id string, value interface{}) error {
+	return f.Bus.Inject(id, value)
+}
@@ -0,0 +1,41 @@
+package chik
+
+import (
+	"time"
+)
+
+// Clock is the source of time of a Controller, handlers should get the current time
+// from Controller.Now so that they can be tested with a simulated clock
+type Clock interface {
+	Now() time.Time
+
+	// NewTimer creates a ClockTimer firing once after the given duration
+	NewTimer(d time.Duration) ClockTimer
+}
+
+// ClockTimer is a single shot timer created by a Clock
+type ClockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// RealClock is the Clock based on the system time
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) ClockTimer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
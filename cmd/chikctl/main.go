@@ -0,0 +1,280 @@
+// Command chikctl talks to a running node through its Unix domain socket (see Controller.ListenUnix).
+// Every reply is printed to stdout as a JSON object per line: {"type": "...", "data": ...}
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gochik/chik"
+	"github.com/gochik/chik/handlers/actor"
+	"github.com/gochik/chik/handlers/status"
+	"github.com/gochik/chik/handlers/systemd"
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+)
+
+const usage = `Usage: chikctl [flags] <command> [arguments]
+
+Commands:
+  digital <appliance> <set|reset|toggle|push>   send a digital command
+  analog [-relative] <appliance> <value>        send an analog command
+  status [query]                                dump the status
+  watch [query]                                 print every status change until interrupted
+  actions get                                   list the actor actions
+  actions set <action json>                     create or replace an action
+  actions reset <id>                            delete an action
+  version                                       query the software version
+  systemd <unit> <get|set|reset>                query, start or stop a systemd unit
+
+Flags:
+`
+
+// resubscribeInterval keeps the status subscription alive while watching
+const resubscribeInterval = 5 * time.Minute
+
+var actions = map[string]types.Action{
+	"set":    types.SET,
+	"reset":  types.RESET,
+	"toggle": types.TOGGLE,
+	"push":   types.PUSH,
+	"get":    types.GET,
+}
+
+type output struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+type client struct {
+	controller *chik.Controller
+	remoteCtx  context.Context
+	node       uuid.UUID
+	timeout    time.Duration
+	out        io.Writer
+}
+
+func parseAction(name string) (types.Action, error) {
+	action, ok := actions[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown action %q", name)
+	}
+	return action, nil
+}
+
+func connect(ctx context.Context, socket string, timeout time.Duration, out io.Writer) (*client, error) {
+	conn, err := net.DialTimeout("unix", socket, timeout)
+	if err != nil {
+		return nil, err
+	}
+	controller := chik.NewControllerWithID(uuid.Must(uuid.NewV4()))
+	handshakes := controller.Sub(types.HandshakeCommandType.String())
+	defer controller.Unsub(handshakes)
+	remoteCtx, _ := chik.StartRemote(controller, conn, 0)
+
+	select {
+	case data := <-handshakes:
+		return &client{controller, remoteCtx, data.(*chik.Message).SenderUUID(), timeout, out}, nil
+	case <-remoteCtx.Done():
+		return nil, context.Cause(remoteCtx)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(timeout):
+		return nil, errors.New("no handshake received from the node")
+	}
+}
+
+func (c *client) print(command *types.Command) error {
+	return json.NewEncoder(c.out).Encode(output{command.Type.String(), command.Data})
+}
+
+// send publishes a command that gets no reply
+func (c *client) send(commandType types.CommandType, content interface{}) error {
+	command := types.NewCommand(commandType, content)
+	c.controller.Pub(command, c.node)
+	return c.print(command)
+}
+
+func (c *client) request(ctx context.Context, commandType types.CommandType, content interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	reply, err := c.controller.Request(ctx, types.NewCommand(commandType, content), c.node)
+	if err != nil {
+		return err
+	}
+	if reply.Command().Type == types.ErrorReplyCommandType {
+		var content types.ErrorReply
+		json.Unmarshal(reply.Command().Data, &content)
+		return fmt.Errorf("%v refused: %s", content.Type, content.Error)
+	}
+	return c.print(reply.Command())
+}
+
+func (c *client) watch(ctx context.Context, query string) error {
+	notifications := c.controller.Sub(types.StatusNotificationCommandType.String())
+	defer c.controller.Unsub(notifications)
+	subscribe := func() {
+		c.controller.Pub(types.NewCommand(types.StatusCommandType, status.StatusCommand{Action: types.SET, Query: query}), c.node)
+	}
+	subscribe()
+	ticker := time.NewTicker(resubscribeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			subscribe()
+		case data := <-notifications:
+			if err := c.print(data.(*chik.Message).Command()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *client) actions(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing actions subcommand")
+	}
+	action, err := parseAction(args[0])
+	if err != nil {
+		return err
+	}
+	request := actor.ActionCommand{Action: action}
+	switch action {
+	case types.GET:
+	case types.SET:
+		if len(args) != 2 {
+			return errors.New("usage: actions set <action json>")
+		}
+		if err := json.Unmarshal([]byte(args[1]), &request.Value); err != nil {
+			return fmt.Errorf("invalid action: %w", err)
+		}
+	case types.RESET:
+		if len(args) != 2 {
+			return errors.New("usage: actions reset <id>")
+		}
+		request.Value.ID = args[1]
+	default:
+		return fmt.Errorf("unsupported actions subcommand %q", args[0])
+	}
+	return c.request(ctx, types.ActionRequestCommandType, request)
+}
+
+func (c *client) execute(ctx context.Context, args []string) error {
+	command, args := args[0], args[1:]
+	switch command {
+	case "digital":
+		if len(args) != 2 {
+			return errors.New("usage: digital <appliance> <action>")
+		}
+		action, err := parseAction(args[1])
+		if err != nil {
+			return err
+		}
+		return c.send(types.DigitalCommandType, types.DigitalCommand{Action: action, ApplianceID: args[0]})
+
+	case "analog":
+		flags := flag.NewFlagSet("analog", flag.ContinueOnError)
+		relative := flags.Bool("relative", false, "add the value to the current one")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() != 2 {
+			return errors.New("usage: analog [-relative] <appliance> <value>")
+		}
+		value, err := strconv.ParseFloat(flags.Arg(1), 64)
+		if err != nil {
+			return fmt.Errorf("invalid value: %w", err)
+		}
+		content := types.AnalogCommand{ApplianceID: flags.Arg(0), Value: value}
+		if *relative {
+			content.ValueType = types.Relative
+		}
+		return c.send(types.AnalogCommandType, content)
+
+	case "status", "watch":
+		query := ""
+		if len(args) > 0 {
+			query = args[0]
+		}
+		if command == "watch" {
+			return c.watch(ctx, query)
+		}
+		return c.request(ctx, types.StatusCommandType, status.StatusCommand{Action: types.GET, Query: query})
+
+	case "actions":
+		return c.actions(ctx, args)
+
+	case "version":
+		return c.request(ctx, types.VersionRequestCommandType, types.SimpleCommand{Action: types.GET})
+
+	case "systemd":
+		if len(args) != 2 {
+			return errors.New("usage: systemd <unit> <get|set|reset>")
+		}
+		action, err := parseAction(args[1])
+		if err != nil {
+			return err
+		}
+		return c.request(ctx, types.SystemdRequestCommandType, systemd.SystemdRequestCommand{Action: action, ServiceName: args[0]})
+	}
+	return fmt.Errorf("unknown command %q", command)
+}
+
+func run(ctx context.Context, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("chikctl", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	socket := flags.String("socket", "/run/chik.sock", "path of the node socket")
+	timeout := flags.Duration("timeout", 5*time.Second, "how long to wait for a reply")
+	verbose := flags.Bool("v", false, "log the connection activity to stderr")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("missing command")
+	}
+	if !*verbose {
+		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+	}
+
+	client, err := connect(ctx, *socket, *timeout, out)
+	if err != nil {
+		return fmt.Errorf("cannot connect to %s: %w", *socket, err)
+	}
+	err = client.execute(ctx, flags.Args())
+	// the stop command follows the pending ones: waiting for it flushes them
+	client.controller.Pub(types.NewCommand(types.RemoteStopCommandType, nil), chik.LoopbackID)
+	select {
+	case <-client.remoteCtx.Done():
+	case <-time.After(*timeout):
+	}
+	return err
+}
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if err := run(ctx, os.Args[1:], os.Stdout); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gochik/chik"
+	"github.com/gochik/chik/handlers/version"
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+)
+
+func startNode(t *testing.T) (*chik.Controller, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "chik.sock")
+	node := chik.NewControllerWithID(uuid.Must(uuid.NewV4()))
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go node.Start(ctx, []chik.Handler{version.New("1.2.3")})
+	go node.ListenUnix(ctx, path)
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); err == nil {
+			return node, path
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Socket not created")
+	return nil, ""
+}
+
+func TestVersion(t *testing.T) {
+	_, path := startNode(t)
+	out := bytes.Buffer{}
+	if err := run(context.Background(), []string{"-socket", path, "version"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var result output
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatalf("Invalid output %q: %v", out.String(), err)
+	}
+	var indication types.VersionIndication
+	json.Unmarshal(result.Data, &indication)
+	if result.Type != types.VersionReplyCommandType.String() || indication.CurrentVersion != "1.2.3" {
+		t.Fatalf("Unexpected output: %s", out.String())
+	}
+}
+
+func TestDigital(t *testing.T) {
+	node, path := startNode(t)
+	commands := node.Sub(types.DigitalCommandType.String())
+	out := bytes.Buffer{}
+	if err := run(context.Background(), []string{"-socket", path, "digital", "light", "toggle"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-commands:
+		var command types.DigitalCommand
+		json.Unmarshal(data.(*chik.Message).Command().Data, &command)
+		if command.ApplianceID != "light" || command.Action != types.TOGGLE {
+			t.Fatalf("Unexpected command: %+v", command)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Command not received")
+	}
+}
+
+func TestInvalidArguments(t *testing.T) {
+	_, path := startNode(t)
+	for _, args := range [][]string{
+		{"digital", "light"},
+		{"digital", "light", "dim"},
+		{"analog", "dimmer", "bright"},
+		{"actions", "set", "{"},
+		{"unknown"},
+	} {
+		out := bytes.Buffer{}
+		if err := run(context.Background(), append([]string{"-socket", path}, args...), &out); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+}
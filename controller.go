@@ -2,10 +2,11 @@ package chik
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 
-	"github.com/cskr/pubsub"
 	"github.com/gochik/chik/config"
 	"github.com/gochik/chik/types"
 	"github.com/gofrs/uuid"
@@ -16,50 +17,33 @@ import (
 // BufferSize is the size of channel buffers
 const BufferSize = 10
 
+// statsInterval is how often delivery stats are reported into the handlers health
+const statsInterval = 10 * time.Second
+
 // MaxIdleTime is the maximum time to wait before closing a connection for inactivity
 const MaxIdleTime = 2 * time.Minute
 
 // LoopbackID is the id internal only messages are sent to
 var LoopbackID = uuid.Nil
 
-type Timer struct {
-	triggerAtStart bool
-	ticker         *time.Ticker
-}
-
-// NewTimer creates a new timer given an interval and the option to fire when started
-func NewTimer(interval time.Duration, triggerAtStart bool) Timer {
-	return Timer{
-		triggerAtStart,
-		time.NewTicker(interval),
-	}
-}
-
-// NewStartupActionTimer creates a timer that fires only at start and then never triggers again
-func NewStartupActionTimer() Timer {
-	return Timer{
-		true,
-		&time.Ticker{C: make(chan time.Time, 0)},
-	}
-}
-
-// NewEmptyTimer creates a timer that does never fire
-func NewEmptyTimer() Timer {
-	return Timer{
-		false,
-		&time.Ticker{C: make(chan time.Time, 0)},
-	}
-}
-
-type Interrupts struct {
-	Timer Timer
-	Event <-chan interface{}
-}
-
 type Controller struct {
-	ID     uuid.UUID
-	pubSub *pubsub.PubSub
-	wg     sync.WaitGroup
+	ID            uuid.UUID
+	pubSub        *broker
+	wg            sync.WaitGroup
+	supervisor    *supervisor
+	requests      sync.Map
+	subscriptions sync.Map
+	counters      sync.Map
+	ctx           context.Context
+	lifecycle     sync.Mutex
+	stopping      bool
+	nodes         []*handlerNode
+	interceptors  interceptors
+	clock         Clock
+	cipher        Cipher
+	outbox        *outbox
+	routes        routes
+	authenticate  func(peer uuid.UUID) bool
 }
 
 // NewController creates a new controller
@@ -88,12 +72,59 @@ func NewController() *Controller {
 	}
 	log.Info().Str("identity", identity.String())
 
+	controller := NewControllerWithID(identity)
+	policy, err := LoadAccessPolicy()
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid access policy, denying every remote command")
+		policy = denyAllPolicy()
+	}
+	if policy != nil {
+		controller.UseAccessPolicy(policy)
+	}
+
+	var outboxPath string
+	config.GetStruct("outbox", &outboxPath)
+	if outboxPath != "" {
+		if err := controller.SetOutbox(outboxPath); err != nil {
+			log.Warn().Err(err).Msg("Cannot load outbox, reliable messages are kept in memory")
+		}
+	}
+	return controller
+}
+
+// NewControllerWithID creates a controller with the given identity,
+// unlike NewController it does not read or write the config file
+func NewControllerWithID(identity uuid.UUID) *Controller {
 	return &Controller{
-		ID:     identity,
-		pubSub: pubsub.New(BufferSize),
+		ID:         identity,
+		pubSub:     newBroker(),
+		supervisor: newSupervisor(),
+		clock:      RealClock,
+		outbox:     newOutbox(),
 	}
 }
 
+// SetClock replaces the clock of the controller, it must be called before Start
+func (c *Controller) SetClock(clock Clock) {
+	c.clock = clock
+}
+
+// SetCipher sets the Cipher applied to the messages exchanged by the remotes started afterwards
+func (c *Controller) SetCipher(cipher Cipher) {
+	c.cipher = cipher
+}
+
+// Authenticated tells whether the peer connected to the controller has proved to be the given one,
+// eg: with a TLS client certificate (see Server.Authenticate)
+func (c *Controller) Authenticated(peer uuid.UUID) bool {
+	return c.authenticate != nil && c.authenticate(peer)
+}
+
+// Now returns the current time according to the controller clock
+func (c *Controller) Now() time.Time {
+	return c.clock.Now()
+}
+
 func topicsAsStrings(topics []types.CommandType) []string {
 	result := make([]string, len(topics))
 	for _, topic := range topics {
@@ -102,146 +133,384 @@ func topicsAsStrings(topics []types.CommandType) []string {
 	return result
 }
 
-func (c *Controller) runHandler(ctx context.Context, h Handler) (subContext context.Context) {
-	subContext, cancel := context.WithCancel(ctx)
+// runHandler sets up the handler and starts its event loop.
+// The returned channel is closed once the handler has been torn down,
+// the error that caused the event loop to end is stored into node.err
+func (c *Controller) runHandler(ctx context.Context, node *handlerNode) <-chan struct{} {
+	h := node.handler
+	done := make(chan struct{})
 	interrupts, err := h.Setup(c)
 	if err != nil {
 		log.Err(err).Str("handler", h.String()).Msg("setup error")
-		cancel()
-		return
+		node.err = fmt.Errorf("setup: %w", err)
+		close(done)
+		return done
+	}
+	subscribedTopics := c.pubSub.sub(c.subscriptionOptions(h.String()), false, c.deliveryCounters(h.String()), topicsAsStrings(h.Topics())...)
+	ticks := make(chan timerEvent)
+	stopTimers := make(chan struct{})
+	interrupts.Timer.run(c.clock, "", ticks, stopTimers)
+	for name, timer := range interrupts.Timers {
+		timer.run(c.clock, name, ticks, stopTimers)
 	}
-	subscribedTopics := c.Sub(topicsAsStrings(h.Topics())...)
+	node.setReady()
+	c.supervisor.update(c, h.String(), func(health *HandlerHealth) {
+		health.State = HandlerRunning
+	})
 	go func() {
 		defer func() {
-			// FIXME: c.Unsub(subscribedTopics)
-			interrupts.Timer.ticker.Stop()
+			c.Unsub(subscribedTopics)
+			close(stopTimers)
+			if c.ctx.Err() != nil {
+				// Controller is shutting down: handlers depending on this one are torn down first
+				for _, dependent := range node.dependents {
+					<-dependent.stoppedChannel()
+				}
+			}
 			h.Teardown()
-			cancel()
+			close(done)
 		}()
 
-		if interrupts.Timer.triggerAtStart {
-			if err := h.HandleTimerEvent(time.Now(), c); err != nil {
-				log.Err(err).Str("handler", h.String()).Msg("Error during first timer call")
-				return
+		node.err = c.handlerLoop(ctx, h, interrupts, subscribedTopics, ticks)
+		if node.err != nil {
+			log.Err(node.err).Str("handler", h.String()).Msg("Handler failed")
+		}
+	}()
+
+	return done
+}
+
+func (c *Controller) handlerLoop(ctx context.Context, h Handler, interrupts Interrupts, subscribedTopics chan interface{}, ticks <-chan timerEvent) error {
+	if interrupts.Timer.triggerAtStart {
+		if err := h.HandleTimerEvent("", c.Now(), c); err != nil {
+			return fmt.Errorf("first timer call: %w", err)
+		}
+	}
+	for name, timer := range interrupts.Timers {
+		if timer.triggerAtStart {
+			if err := h.HandleTimerEvent(name, c.Now(), c); err != nil {
+				return fmt.Errorf("first %s timer call: %w", name, err)
 			}
 		}
-		for {
-			select {
-			case <-ctx.Done():
-				return
-
-			case rawMessage, ok := <-subscribedTopics:
-				if !ok {
-					log.Error().
-						Str("handler", h.String()).
-						Msg("Message channel closed. Quitting")
-					return
-				}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
 
-				if err := h.HandleMessage(rawMessage.(*Message), c); err != nil {
-					log.Err(err).Str("handler", h.String()).Msg("Error during first timer call")
-					return
-				}
+		case rawMessage, ok := <-subscribedTopics:
+			if !ok {
+				return errors.New("message channel closed")
+			}
 
-			case tick := <-interrupts.Timer.ticker.C:
-				if err := h.HandleTimerEvent(tick, c); err != nil {
-					return
-				}
+			message := c.interceptDelivery(h.String(), rawMessage.(*Message))
+			if message == nil {
+				continue
+			}
+			if err := h.HandleMessage(message, c); err != nil {
+				return fmt.Errorf("message: %w", err)
+			}
 
-			case event := <-interrupts.Event:
-				if err := h.HandleChannelEvent(event, c); err != nil {
-					return
-				}
+		case event := <-ticks:
+			if err := h.HandleTimerEvent(event.name, event.tick, c); err != nil {
+				return fmt.Errorf("timer event: %w", err)
+			}
+
+		case event := <-interrupts.Event:
+			if err := h.HandleChannelEvent(event, c); err != nil {
+				return fmt.Errorf("channel event: %w", err)
 			}
 		}
-	}()
+	}
+}
 
-	return
+// launch starts supervising the given handler, the caller must hold the lifecycle lock
+func (c *Controller) launch(node *handlerNode) {
+	ctx, cancel := context.WithCancel(c.ctx)
+	node.Lock()
+	node.running = true
+	node.cancel = cancel
+	node.stopped = make(chan struct{})
+	node.Unlock()
+
+	c.wg.Add(1)
+	go c.executeHandler(ctx, node)
 }
 
-func (c *Controller) executeHandler(ctx context.Context, h Handler) (err error) {
-	log.Info().Str("handler", h.String()).Msg("Starting handler")
+// executeHandler runs the handler restarting it on failures as defined by its RestartPolicy
+func (c *Controller) executeHandler(ctx context.Context, node *handlerNode) {
+	name := node.String()
 	defer func() {
-		log.Info().Str("handler", h.String()).Msg("Stopping handler")
+		node.Lock()
+		node.running = false
+		node.cancel()
+		close(node.stopped)
+		node.Unlock()
 		c.wg.Done()
 	}()
 
-	subctx := c.runHandler(ctx, h)
+	for _, dependency := range node.dependencies {
+		select {
+		case <-ctx.Done():
+			return
 
-	for {
+		case <-dependency.ready:
+			continue
+
+		case <-dependency.failed:
+		}
+		// the dependency can still be started again (see StartHandler)
+		log.Error().Str("handler", name).Msgf("Dependency %s failed, handler blocked", dependency)
+		c.supervisor.update(c, name, func(health *HandlerHealth) {
+			health.State = HandlerBlocked
+			health.LastError = fmt.Sprintf("dependency %s failed", dependency)
+		})
+		node.setFailed()
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			c.supervisor.update(c, name, func(health *HandlerHealth) {
+				health.State = HandlerStopped
+			})
+			return
 
-		case <-subctx.Done():
-			<-time.After(5 * time.Second)
-			c.wg.Add(1)
-			go c.executeHandler(ctx, h)
+		case <-dependency.ready:
+		}
+	}
+
+	policy := c.supervisor.policy(name)
+	backoff := time.Duration(0)
+	failures := make([]time.Time, 0)
+	for {
+		log.Info().Str("handler", name).Msg("Starting handler")
+		c.supervisor.update(c, name, func(health *HandlerHealth) {
+			health.State = HandlerStarting
+		})
+		startedAt := time.Now()
+		<-c.runHandler(ctx, node)
+		log.Info().Str("handler", name).Msg("Stopping handler")
+
+		if ctx.Err() != nil {
+			c.supervisor.update(c, name, func(health *HandlerHealth) {
+				health.State = HandlerStopped
+			})
 			return
 		}
+
+		lastError := "unknown error"
+		if node.err != nil {
+			lastError = node.err.Error()
+		}
+
+		now := time.Now()
+		if policy.MaxBackoff > 0 && now.Sub(startedAt) > policy.MaxBackoff {
+			// the handler has been running long enough: start again with the shortest wait
+			backoff = 0
+		}
+		backoff = policy.nextBackoff(backoff)
+
+		recentFailures := failures[:0]
+		for _, failure := range failures {
+			if now.Sub(failure) < policy.Window {
+				recentFailures = append(recentFailures, failure)
+			}
+		}
+		failures = append(recentFailures, now)
+
+		if policy.MaxRestarts > 0 && len(failures) > policy.MaxRestarts {
+			log.Error().Str("handler", name).Msgf("Handler failed %d times in %v, giving up", len(failures), policy.Window)
+			c.supervisor.update(c, name, func(health *HandlerHealth) {
+				health.State = HandlerFailed
+				health.LastError = lastError
+			})
+			node.setFailed()
+			return
+		}
+
+		log.Warn().Str("handler", name).Msgf("Restarting handler in %v", backoff)
+		c.supervisor.update(c, name, func(health *HandlerHealth) {
+			health.State = HandlerBackingOff
+			health.LastError = lastError
+			health.Restarts++
+		})
+
+		select {
+		case <-ctx.Done():
+			c.supervisor.update(c, name, func(health *HandlerHealth) {
+				health.State = HandlerStopped
+			})
+			return
+
+		case <-time.After(backoff):
+		}
 	}
 }
 
-// Start starts every registered handler
-func (c *Controller) Start(ctx context.Context, handlers []Handler) {
-	// TODO: order handlers by dependencies
-	for _, h := range handlers {
-		c.wg.Add(1)
-		go c.executeHandler(ctx, h)
+// Start starts every registered handler following the order given by Handler.Dependencies():
+// an handler is set up only after every handler it depends on completed its setup and
+// it is torn down only after every handler depending on it has been torn down.
+// Failing handlers are restarted following their RestartPolicy (see SetRestartPolicy).
+// Start blocks until ctx is done. An error is returned without starting anything
+// if a dependency is missing or if dependencies contain a cycle
+func (c *Controller) Start(ctx context.Context, handlers []Handler) error {
+	nodes, err := sortHandlers(handlers)
+	if err != nil {
+		log.Err(err).Msg("Cannot start handlers")
+		return err
+	}
+
+	c.lifecycle.Lock()
+	c.ctx = ctx
+	c.nodes = nodes
+	for _, node := range nodes {
+		c.launch(node)
+	}
+	c.lifecycle.Unlock()
+
+	statsTicker := time.NewTicker(statsInterval)
+	defer statsTicker.Stop()
+	retryTicker := time.NewTicker(OutboxRetryInterval)
+	defer retryTicker.Stop()
+	handshakes := c.Sub(types.HandshakeCommandType.String())
+	for loop := true; loop; {
+		select {
+		case <-ctx.Done():
+			loop = false
+
+		case <-statsTicker.C:
+			c.publishDeliveryStats()
+
+		case <-retryTicker.C:
+			c.retryOutbox(false)
+
+		case <-handshakes:
+			// a new connection is up: pending messages are sent right away
+			c.retryOutbox(true)
+		}
 	}
+	c.Unsub(handshakes)
+	c.lifecycle.Lock()
+	c.stopping = true
+	c.lifecycle.Unlock()
 	c.wg.Wait()
 	log.Info().Msg("Controller terminated")
-	c.pubSub.Shutdown()
+	c.pubSub.shutdown()
+	return nil
 }
 
 // PubMessage publishes a Message
 func (c *Controller) PubMessage(message *Message, topics ...string) {
-	c.pubSub.TryPub(message, topics...)
+	message = c.interceptPublish(message, topics)
+	if message == nil {
+		return
+	}
+	if message.replyTo != uuid.Nil {
+		if pending, ok := c.requests.Load(message.replyTo); ok {
+			select {
+			case pending.(chan *Message) <- message:
+			default:
+			}
+		}
+	}
+	c.pubSub.pub(message, topics...)
 }
 
 // Pub publishes a Message composed by the given Command
 func (c *Controller) Pub(command *types.Command, receiverID uuid.UUID) {
+	c.pub(NewMessage(receiverID, command))
+}
+
+// pub publishes the message on the outgoing topic or, if it is internal, on the topic of its type
+func (c *Controller) pub(message *Message) {
 	messageKind := types.AnyOutgoingCommandType.String()
-	if receiverID == LoopbackID {
-		messageKind = command.Type.String()
+	if message.receiver == LoopbackID {
+		messageKind = message.command.Type.String()
 	}
 
-	c.PubMessage(NewMessage(receiverID, command), messageKind)
+	c.PubMessage(message, messageKind)
 }
 
 // Sub Subscribes to one or more message types
 func (c *Controller) Sub(topics ...string) chan interface{} {
-	return c.pubSub.Sub(topics...)
+	return c.pubSub.sub(DefaultSubscriptionOptions, false, nil, topics...)
+}
+
+// SubWithOptions subscribes to one or more message types queuing messages as defined by options
+func (c *Controller) SubWithOptions(options SubscriptionOptions, topics ...string) chan interface{} {
+	return c.pubSub.sub(options, false, nil, topics...)
 }
 
 // SubOnce subscribes to the first event of one of the given topics, then it deletes the subscription
 func (c *Controller) SubOnce(topics ...string) chan interface{} {
-	return c.pubSub.SubOnce(topics...)
+	return c.pubSub.sub(DefaultSubscriptionOptions, true, nil, topics...)
 }
 
+// Unsub deletes a subscription, the subscription channel is closed
 func (c *Controller) Unsub(subscription chan interface{}) {
-	go func() {
-		for i := 0; i < 100; i++ {
-			select {
-			case _, ok := <-subscription:
-				if !ok {
-					return
-				}
-				continue
+	c.pubSub.unsub(subscription)
+}
 
-			default:
-				return
-			}
-		}
-	}()
-	c.pubSub.Unsub(subscription)
+// SetDeliveryPolicy sets how messages are queued for the handler with the given name.
+// It needs to be called before Start
+func (c *Controller) SetDeliveryPolicy(handler string, options SubscriptionOptions) {
+	c.subscriptions.Store(handler, options)
+}
+
+func (c *Controller) subscriptionOptions(handler string) SubscriptionOptions {
+	if options, ok := c.subscriptions.Load(handler); ok {
+		return options.(SubscriptionOptions)
+	}
+	return DefaultSubscriptionOptions
+}
+
+func (c *Controller) deliveryCounters(handler string) *deliveryCounters {
+	counters, _ := c.counters.LoadOrStore(handler, &deliveryCounters{})
+	return counters.(*deliveryCounters)
+}
+
+// DeliveryStats returns the message delivery counters of every handler
+func (c *Controller) DeliveryStats() map[string]DeliveryStats {
+	result := make(map[string]DeliveryStats)
+	c.counters.Range(func(key, value interface{}) bool {
+		result[key.(string)] = value.(*deliveryCounters).stats()
+		return true
+	})
+	return result
+}
+
+// publishDeliveryStats reports dropped messages into the handlers health
+func (c *Controller) publishDeliveryStats() {
+	for handler, stats := range c.DeliveryStats() {
+		dropped := stats.Dropped
+		c.supervisor.update(c, handler, func(health *HandlerHealth) {
+			health.Dropped = dropped
+		})
+	}
 }
 
 // Reply sends back a reply message
 func (c *Controller) Reply(request *Message, replyType types.CommandType, replyContent interface{}) {
-	receiver := request.SenderUUID()
 	command := types.NewCommand(replyType, replyContent)
 
 	// If sender is null the message is internal, otherwise it needs to go out
-	c.Pub(command, receiver)
+	c.pub(NewReply(request, command))
+}
+
+// Request sends a command to the given receiver and waits for the matching reply.
+// Use LoopbackID as receiver to query local handlers.
+// An error is returned if ctx is done before a reply is received
+func (c *Controller) Request(ctx context.Context, command *types.Command, receiverID uuid.UUID) (*Message, error) {
+	request := NewRequest(receiverID, command)
+	reply := make(chan *Message, 1)
+	c.requests.Store(request.requestID, reply)
+	defer c.requests.Delete(request.requestID)
+
+	c.pub(request)
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("request %v: %w", request.requestID, ctx.Err())
+
+	case message := <-reply:
+		return message, nil
+	}
 }
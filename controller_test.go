@@ -5,6 +5,8 @@ import (
 	"errors"
 	"testing"
 	"time"
+
+	"github.com/gochik/chik/types"
 )
 
 type testHandler struct {
@@ -48,3 +50,269 @@ func TestHandlerError(t *testing.T) {
 		t.Fatal("Handler error recovery failed: ", handler.currentValue)
 	}
 }
+
+type orderedHandler struct {
+	BaseHandler
+	name         string
+	dependencies []string
+	events       chan string
+}
+
+func (h *orderedHandler) String() string {
+	return h.name
+}
+
+func (h *orderedHandler) Dependencies() []string {
+	return h.dependencies
+}
+
+func (h *orderedHandler) Setup(controller *Controller) (Interrupts, error) {
+	h.events <- "setup " + h.name
+	return Interrupts{Timer: NewEmptyTimer()}, nil
+}
+
+func (h *orderedHandler) Teardown() {
+	h.events <- "teardown " + h.name
+}
+
+func TestHandlersOrder(t *testing.T) {
+	events := make(chan string, 6)
+	handlers := []Handler{
+		&orderedHandler{name: "actor", dependencies: []string{"io", "status"}, events: events},
+		&orderedHandler{name: "io", dependencies: []string{"status"}, events: events},
+		&orderedHandler{name: "status", events: events},
+	}
+	cont := NewController()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- cont.Start(ctx, handlers) }()
+
+	for _, expected := range []string{"setup status", "setup io", "setup actor"} {
+		if event := <-events; event != expected {
+			t.Fatalf("Expecting %q, got %q", expected, event)
+		}
+	}
+	cancel()
+	for _, expected := range []string{"teardown actor", "teardown io", "teardown status"} {
+		if event := <-events; event != expected {
+			t.Fatalf("Expecting %q, got %q", expected, event)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInvalidDependencies(t *testing.T) {
+	for _, val := range []struct {
+		Name     string
+		Handlers []Handler
+	}{
+		{"Missing dependency", []Handler{
+			&orderedHandler{name: "io", dependencies: []string{"status"}},
+		}},
+		{"Cycle", []Handler{
+			&orderedHandler{name: "a", dependencies: []string{"b"}},
+			&orderedHandler{name: "b", dependencies: []string{"a"}},
+		}},
+		{"Duplicated", []Handler{
+			&orderedHandler{name: "a"},
+			&orderedHandler{name: "a"},
+		}},
+	} {
+		cont := NewController()
+		if err := cont.Start(context.Background(), val.Handlers); err == nil {
+			t.Errorf("%s test failed", val.Name)
+		}
+	}
+}
+
+type failingHandler struct {
+	BaseHandler
+}
+
+func (h *failingHandler) String() string {
+	return "failing"
+}
+
+func (h *failingHandler) Setup(controller *Controller) (Interrupts, error) {
+	return Interrupts{}, errors.New("always failing")
+}
+
+func TestHandlerPermanentFailure(t *testing.T) {
+	cont := NewController()
+	cont.SetRestartPolicy("failing", RestartPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     40 * time.Millisecond,
+		Multiplier:     2,
+		MaxRestarts:    3,
+		Window:         time.Minute,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cont.Start(ctx, []Handler{&failingHandler{}})
+
+	time.Sleep(500 * time.Millisecond)
+	health := cont.HandlersHealth()["failing"]
+	if health.State != HandlerFailed {
+		t.Fatalf("Unexpected handler state: %v", health.State)
+	}
+	if health.Restarts != 3 {
+		t.Errorf("Unexpected restart count: %d", health.Restarts)
+	}
+	if health.LastError == "" {
+		t.Error("Last error has not been reported")
+	}
+}
+
+func TestBlockedDependents(t *testing.T) {
+	cont := NewController()
+	cont.SetRestartPolicy("failing", RestartPolicy{InitialBackoff: 10 * time.Millisecond, MaxRestarts: 1, Window: time.Minute})
+	events := make(chan string, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cont.Start(ctx, []Handler{
+		&failingHandler{},
+		&orderedHandler{name: "dependent", dependencies: []string{"failing"}, events: events},
+		&orderedHandler{name: "transitive", dependencies: []string{"dependent"}, events: events},
+	})
+
+	time.Sleep(200 * time.Millisecond)
+	health := cont.HandlersHealth()
+	for _, name := range []string{"dependent", "transitive"} {
+		if health[name].State != HandlerBlocked || health[name].LastError == "" {
+			t.Errorf("Unexpected %s health: %+v", name, health[name])
+		}
+	}
+	if len(events) != 0 {
+		t.Errorf("Blocked handler set up: %v", <-events)
+	}
+}
+
+// healthWatcher reads the health of the handlers whenever it is published
+type healthWatcher struct {
+	BaseHandler
+	updates chan map[string]HandlerHealth
+}
+
+func (h *healthWatcher) String() string {
+	return "watcher"
+}
+
+func (h *healthWatcher) Topics() []types.CommandType {
+	return []types.CommandType{types.StatusUpdateCommandType}
+}
+
+func (h *healthWatcher) HandleMessage(message *Message, controller *Controller) error {
+	time.Sleep(time.Millisecond)
+	select {
+	case h.updates <- controller.HandlersHealth():
+	default:
+	}
+	return nil
+}
+
+func TestHealthSubscriber(t *testing.T) {
+	cont := NewController()
+	cont.SetRestartPolicy("failing", RestartPolicy{InitialBackoff: time.Millisecond, MaxRestarts: 20, Window: time.Minute})
+	cont.SetDeliveryPolicy("watcher", SubscriptionOptions{Policy: Block, BufferSize: 1})
+	watcher := &healthWatcher{updates: make(chan map[string]HandlerHealth, 100)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cont.Start(ctx, []Handler{watcher, &failingHandler{}})
+
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case health := <-watcher.updates:
+			if health["failing"].State == HandlerFailed {
+				return
+			}
+		case <-deadline:
+			t.Fatal("Health publishing blocked")
+		}
+	}
+}
+
+type echoHandler struct {
+	BaseHandler
+}
+
+func (h *echoHandler) Topics() []types.CommandType {
+	return []types.CommandType{types.VersionRequestCommandType}
+}
+
+func (h *echoHandler) HandleMessage(message *Message, controller *Controller) error {
+	controller.Reply(message, types.VersionReplyCommandType, types.VersionIndication{CurrentVersion: "echo"})
+	return nil
+}
+
+func TestRequest(t *testing.T) {
+	cont := NewController()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cont.Start(ctx, []Handler{&echoHandler{}})
+	time.Sleep(10 * time.Millisecond)
+
+	requestCtx, requestCancel := context.WithTimeout(ctx, time.Second)
+	defer requestCancel()
+	reply, err := cont.Request(requestCtx, types.NewCommand(types.VersionRequestCommandType, nil), LoopbackID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Command().Type != types.VersionReplyCommandType {
+		t.Errorf("Unexpected reply: %v", reply)
+	}
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer timeoutCancel()
+	_, err = cont.Request(timeoutCtx, types.NewCommand(types.StatusCommandType, nil), LoopbackID)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expecting a timeout, got %v", err)
+	}
+}
+
+func TestHandlerManagement(t *testing.T) {
+	events := make(chan string, 10)
+	cont := NewController()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cont.Start(ctx, []Handler{
+		&orderedHandler{name: "status", events: events},
+		&orderedHandler{name: "io", dependencies: []string{"status"}, events: events},
+	})
+	<-events
+	<-events
+
+	if err := cont.StopHandler("io"); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-events; event != "teardown io" {
+		t.Fatalf("Unexpected event %q", event)
+	}
+	if err := cont.StopHandler("io"); err == nil {
+		t.Error("Stopping a stopped handler must fail")
+	}
+	if err := cont.StartHandler("io"); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-events; event != "setup io" {
+		t.Fatalf("Unexpected event %q", event)
+	}
+	if err := cont.RestartHandler("status"); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"teardown status", "setup status"} {
+		if event := <-events; event != expected {
+			t.Fatalf("Expecting %q, got %q", expected, event)
+		}
+	}
+	if err := cont.StartHandler("unknown"); err == nil {
+		t.Error("Starting an unknown handler must fail")
+	}
+
+	handlers := cont.Handlers()
+	if len(handlers) != 2 || handlers[1].Name != "io" || handlers[1].Dependencies[0] != "status" {
+		t.Errorf("Unexpected handlers list: %v", handlers)
+	}
+}
@@ -0,0 +1,154 @@
+package chik
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a Schedule defined by a standard 5 fields cron expression:
+// minute hour day-of-month month day-of-week
+type cronSchedule struct {
+	minute, hour, dayOfMonth, month, dayOfWeek uint64
+	anyDayOfMonth, anyDayOfWeek                bool
+}
+
+var cronShortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a cron expression like "0 7 * * 1-5" into a Schedule.
+// Every field accepts "*", single values, ranges ("1-5"), lists ("1,3,5") and steps ("*/15", "0-30/10").
+// Day of week goes from 0 (Sunday) to 7 (Sunday again). Shortcuts like @daily or @hourly are accepted too.
+// As in standard cron when both day of month and day of week are restricted either of them has to match
+func ParseCron(expression string) (Schedule, error) {
+	expression = strings.TrimSpace(expression)
+	if shortcut, ok := cronShortcuts[expression]; ok {
+		expression = shortcut
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expecting 5 fields, got %d", expression, len(fields))
+	}
+
+	var err error
+	schedule := &cronSchedule{
+		anyDayOfMonth: fields[2] == "*",
+		anyDayOfWeek:  fields[4] == "*",
+	}
+	for _, field := range []struct {
+		value    string
+		min, max int
+		result   *uint64
+	}{
+		{fields[0], 0, 59, &schedule.minute},
+		{fields[1], 0, 23, &schedule.hour},
+		{fields[2], 1, 31, &schedule.dayOfMonth},
+		{fields[3], 1, 12, &schedule.month},
+		{fields[4], 0, 7, &schedule.dayOfWeek},
+	} {
+		*field.result, err = parseCronField(field.value, field.min, field.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", expression, err)
+		}
+	}
+
+	// 7 is an alias for Sunday
+	if schedule.dayOfWeek&(1<<7) != 0 {
+		schedule.dayOfWeek |= 1
+	}
+	return schedule, nil
+}
+
+func parseCronField(field string, min, max int) (result uint64, err error) {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if rangePart, stepPart, found := strings.Cut(part, "/"); found {
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+			part = rangePart
+		}
+
+		first, last := min, max
+		switch {
+		case part == "*":
+
+		case strings.Contains(part, "-"):
+			from, to, _ := strings.Cut(part, "-")
+			first, err = strconv.Atoi(from)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", from)
+			}
+			last, err = strconv.Atoi(to)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", to)
+			}
+
+		default:
+			first, err = strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			last = first
+			if step != 1 {
+				last = max
+			}
+		}
+
+		if first < min || last > max || first > last {
+			return 0, fmt.Errorf("value %q out of range %d-%d", part, min, max)
+		}
+		for i := first; i <= last; i += step {
+			result |= 1 << uint(i)
+		}
+	}
+	return
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dayOfMonth := s.dayOfMonth&(1<<uint(t.Day())) != 0
+	dayOfWeek := s.dayOfWeek&(1<<uint(t.Weekday())) != 0
+	if s.anyDayOfMonth || s.anyDayOfWeek {
+		return dayOfMonth && dayOfWeek
+	}
+	return dayOfMonth || dayOfWeek
+}
+
+// Next returns the first time matching the expression strictly after the given one
+func (s *cronSchedule) Next(after time.Time) time.Time {
+	location := after.Location()
+	t := time.Date(after.Year(), after.Month(), after.Day(), after.Hour(), after.Minute(), 0, 0, location).Add(time.Minute)
+
+	// no expression needs more than a few years to match, give up after that
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, location)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, location)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, location)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,42 @@
+package chik
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// 2021-03-05 is a Friday
+	start := time.Date(2021, 3, 5, 6, 30, 20, 0, time.UTC)
+	for _, val := range []struct {
+		Expression string
+		Expected   time.Time
+	}{
+		{"* * * * *", time.Date(2021, 3, 5, 6, 31, 0, 0, time.UTC)},
+		{"0 7 * * 1-5", time.Date(2021, 3, 5, 7, 0, 0, 0, time.UTC)},
+		{"0 7 * * 6,7", time.Date(2021, 3, 6, 7, 0, 0, 0, time.UTC)},
+		{"0 7 * * 0", time.Date(2021, 3, 7, 7, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2021, 3, 5, 6, 45, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"30 6 10 * 1", time.Date(2021, 3, 8, 6, 30, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2021, 3, 5, 7, 0, 0, 0, time.UTC)},
+	} {
+		schedule, err := ParseCron(val.Expression)
+		if err != nil {
+			t.Errorf("%s: %v", val.Expression, err)
+			continue
+		}
+		if next := schedule.Next(start); !next.Equal(val.Expected) {
+			t.Errorf("%s: expecting %v got %v", val.Expression, val.Expected, next)
+		}
+	}
+}
+
+func TestInvalidCron(t *testing.T) {
+	for _, expression := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := ParseCron(expression); err == nil {
+			t.Errorf("Expecting an error parsing %q", expression)
+		}
+	}
+}
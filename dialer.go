@@ -0,0 +1,156 @@
+package chik
+
+import (
+	"context"
+	"crypto/tls"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gochik/chik/config"
+	"github.com/gochik/chik/types"
+)
+
+// Reconnection delays used when the Dialer does not set them
+const (
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 2 * time.Minute
+)
+
+// stableSession is how long a connection must last for the reconnection backoff to be reset
+const stableSession = time.Minute
+
+// Dialer connects a controller to a remote address and keeps it connected.
+// Every state change is published on the loopback address as a ConnectionStateCommandType
+type Dialer struct {
+	// Address is either an host:port pair or a ws:// or wss:// url to connect via WebSocket
+	Address string
+
+	// TLS, if set, is used to secure the connection. Otherwise, if Token is set,
+	// the TLS configuration is obtained by config.TLSConfig
+	TLS   *tls.Config
+	Token string
+
+	// Reconnection delays grow from InitialBackoff to MaxBackoff, randomized by up to a half
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Timeout is the read timeout of the connection (see StartRemote)
+	Timeout time.Duration
+
+	// Heartbeat is the name of the handler restarted at every new session, empty to disable
+	Heartbeat string
+}
+
+// NewDialer creates a Dialer with the default settings
+func NewDialer(address string) *Dialer {
+	return &Dialer{
+		Address:        address,
+		InitialBackoff: defaultInitialBackoff,
+		MaxBackoff:     defaultMaxBackoff,
+		Timeout:        MaxIdleTime,
+		Heartbeat:      "heartbeat",
+	}
+}
+
+func (d *Dialer) publishState(controller *Controller, state string, reason error) {
+	content := types.ConnectionState{State: state, Address: d.Address}
+	if reason != nil {
+		content.Reason = reason.Error()
+	}
+	logger.Info().Str("address", d.Address).Str("reason", content.Reason).Msgf("Connection %s", state)
+	controller.Pub(types.NewCommand(types.ConnectionStateCommandType, content), LoopbackID)
+}
+
+// wait sleeps for a randomized backoff, it returns the next backoff and false if ctx is done
+func (d *Dialer) wait(ctx context.Context, backoff time.Duration) (time.Duration, bool) {
+	delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	select {
+	case <-ctx.Done():
+		return backoff, false
+	case <-time.After(delay):
+	}
+	backoff *= 2
+	if backoff > d.MaxBackoff {
+		backoff = d.MaxBackoff
+	}
+	return backoff, true
+}
+
+func (d *Dialer) dial(ctx context.Context) (Transport, error) {
+	if d.TLS == nil && d.Token != "" {
+		tlsConfig, err := config.TLSConfig(ctx, d.Token)
+		if err != nil {
+			return nil, err
+		}
+		d.TLS = tlsConfig
+	}
+	if strings.HasPrefix(d.Address, "ws://") || strings.HasPrefix(d.Address, "wss://") {
+		return DialWebSocket(ctx, d.Address, "http"+strings.TrimPrefix(d.Address, "ws"), d.TLS)
+	}
+
+	var conn net.Conn
+	var err error
+	if d.TLS != nil {
+		dialer := tls.Dialer{Config: d.TLS}
+		conn, err = dialer.DialContext(ctx, "tcp", d.Address)
+	} else {
+		dialer := net.Dialer{}
+		conn, err = dialer.DialContext(ctx, "tcp", d.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamTransport(conn), nil
+}
+
+// Run connects the controller and reconnects it every time the connection drops, until ctx is done
+func (d *Dialer) Run(ctx context.Context, controller *Controller) {
+	if d.InitialBackoff <= 0 {
+		d.InitialBackoff = defaultInitialBackoff
+	}
+	if d.MaxBackoff <= 0 {
+		d.MaxBackoff = defaultMaxBackoff
+	}
+	if d.MaxBackoff < d.InitialBackoff {
+		d.MaxBackoff = d.InitialBackoff
+	}
+	backoff := d.InitialBackoff
+	for ctx.Err() == nil {
+		d.publishState(controller, types.Connecting, nil)
+		transport, err := d.dial(ctx)
+		if err != nil {
+			d.publishState(controller, types.Disconnected, err)
+			var ok bool
+			if backoff, ok = d.wait(ctx, backoff); !ok {
+				return
+			}
+			continue
+		}
+
+		startedAt := time.Now()
+		remoteCtx, cancel := StartRemoteTransport(controller, transport, d.Timeout)
+		d.publishState(controller, types.Connected, nil)
+		if d.Heartbeat != "" {
+			if err := controller.RestartHandler(d.Heartbeat); err != nil {
+				logger.Warn().Msgf("Cannot restart %s: %v", d.Heartbeat, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-remoteCtx.Done():
+		}
+		<-remoteCtx.Done()
+		d.publishState(controller, types.Disconnected, context.Cause(remoteCtx))
+
+		if time.Since(startedAt) >= stableSession {
+			backoff = d.InitialBackoff
+		}
+		var ok bool
+		if backoff, ok = d.wait(ctx, backoff); !ok {
+			return
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package chik
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+)
+
+func expectState(t *testing.T, states chan interface{}, expected string) types.ConnectionState {
+	t.Helper()
+	select {
+	case data := <-states:
+		var state types.ConnectionState
+		json.Unmarshal(data.(*Message).Command().Data, &state)
+		if state.State != expected {
+			t.Fatalf("Expected %s state, got %+v", expected, state)
+		}
+		return state
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s state not published", expected)
+	}
+	return types.ConnectionState{}
+}
+
+func TestDialerReconnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	connections := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connections <- conn
+		}
+	}()
+
+	client := NewControllerWithID(uuid.Must(uuid.NewV4()))
+	states := client.Sub(types.ConnectionStateCommandType.String())
+	dialer := NewDialer(listener.Addr().String())
+	dialer.InitialBackoff = 10 * time.Millisecond
+	dialer.Heartbeat = ""
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dialer.Run(ctx, client)
+
+	expectState(t, states, types.Connecting)
+	expectState(t, states, types.Connected)
+	(<-connections).Close()
+	if state := expectState(t, states, types.Disconnected); state.Reason == "" {
+		t.Error("Disconnection reason not reported")
+	}
+
+	expectState(t, states, types.Connecting)
+	expectState(t, states, types.Connected)
+	conn := <-connections
+	defer conn.Close()
+	if _, err := ParseMessage(conn); err != nil {
+		t.Fatalf("Handshake not received after reconnecting: %v", err)
+	}
+}
+
+func TestDialerDefaultBackoff(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	client := NewControllerWithID(uuid.Must(uuid.NewV4()))
+	states := client.Sub(types.ConnectionStateCommandType.String())
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	(&Dialer{Address: address}).Run(ctx, client)
+
+	attempts := 0
+	for drained := false; !drained; {
+		select {
+		case data := <-states:
+			var state types.ConnectionState
+			json.Unmarshal(data.(*Message).Command().Data, &state)
+			if state.State == types.Connecting {
+				attempts++
+			}
+		case <-time.After(50 * time.Millisecond):
+			drained = true
+		}
+	}
+	if attempts > 1 {
+		t.Fatalf("%d connection attempts without backoff", attempts)
+	}
+}
+
+func TestDialWebSocketCancel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// accepts the connection but never answers the handshake
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if _, err := DialWebSocket(ctx, "ws://"+listener.Addr().String(), "http://localhost", nil); err == nil {
+		t.Fatal("Handshake completed without a server")
+	}
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		t.Fatalf("Dial not cancelled: %v", elapsed)
+	}
+}
@@ -0,0 +1,306 @@
+// Package e2e encrypts and authenticates the messages exchanged between two endpoints,
+// so that relays in the middle only see the sender and the receiver of each message.
+//
+// Messages are sealed with NaCl box (Curve25519, XSalsa20 and Poly1305) using the sender
+// private key and the receiver public key. Peer public keys are exchanged during pairing
+// and stored in the "e2e" config key. The relay hands them out, so they are checked against
+// the pairing code, whose secret part the relay never sees (see NewPairingCode).
+//
+// Pairing goes as follows: the creator asks the relay for a code and shows the one returned by
+// Cipher.NewPairingCode, that adds a secret and a tag binding the creator key to it. The other peer
+// splits the code read by the user with ParsePairingCode, gets the creator key from the relay with
+// the relay part of the code, checks it with Cipher.RedeemPairing and sends the returned proof along
+// with its own key. The creator takes that key with Cipher.ApplyPairing only if the proof matches.
+package e2e
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gochik/chik"
+	"github.com/gochik/chik/config"
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/nacl/box"
+)
+
+var logger = log.With().Str("component", "e2e").Logger()
+
+const configKey = "e2e"
+
+// MaxAge is how old a sealed message can be when it is opened,
+// older messages and messages already opened are refused to prevent replays
+const MaxAge = 2 * time.Minute
+
+// Key is a Curve25519 key
+type Key [32]byte
+
+type keysConfig struct {
+	PublicKey  string            `json:"public_key" mapstructure:"public_key"`
+	PrivateKey string            `json:"private_key" mapstructure:"private_key"`
+	Peers      map[string]string `json:"peers" mapstructure:"peers"`
+}
+
+// String returns the base64 encoding of the key
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// ParseKey decodes a base64 encoded key
+func ParseKey(encoded string) (key Key, err error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return
+	}
+	if len(data) != len(key) {
+		return key, fmt.Errorf("Invalid key length %d", len(data))
+	}
+	copy(key[:], data)
+	return
+}
+
+// GenerateKeys creates a new key pair
+func GenerateKeys() (public Key, private Key, err error) {
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+	return *publicKey, *privateKey, nil
+}
+
+// Cipher is a chik.Cipher sealing the messages directed to the peers whose key is known.
+// Plain messages coming from those peers are refused
+type Cipher struct {
+	sync.RWMutex
+	id      uuid.UUID
+	public  Key
+	private Key
+	peers   map[uuid.UUID]Key
+	opened  map[[24]byte]time.Time
+	// secrets of the pairing codes created, with their expiration
+	secrets map[string]time.Time
+}
+
+// New creates a Cipher for the controller with the given id
+func New(id uuid.UUID, public Key, private Key) *Cipher {
+	return &Cipher{
+		id:      id,
+		public:  public,
+		private: private,
+		peers:   make(map[uuid.UUID]Key),
+		opened:  make(map[[24]byte]time.Time),
+		secrets: make(map[string]time.Time),
+	}
+}
+
+// FromConfig creates a Cipher with the keys stored in the config, a key pair is generated
+// and saved if there is none
+func FromConfig(id uuid.UUID) (*Cipher, error) {
+	var conf keysConfig
+	config.GetStruct(configKey, &conf)
+	public, err := ParseKey(conf.PublicKey)
+	var private Key
+	if err == nil {
+		private, err = ParseKey(conf.PrivateKey)
+	}
+	generated := err != nil
+	if generated {
+		if public, private, err = GenerateKeys(); err != nil {
+			return nil, err
+		}
+	}
+
+	cipher := New(id, public, private)
+	for peer, encoded := range conf.Peers {
+		key, err := ParseKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key for peer %s: %w", peer, err)
+		}
+		peerID, err := uuid.FromString(peer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer id %s: %w", peer, err)
+		}
+		cipher.peers[peerID] = key
+	}
+	if generated {
+		logger.Warn().Msg("Cannot get keys from config file, new ones have been generated")
+		if err := cipher.Save(); err != nil {
+			logger.Warn().Msgf("Cannot save keys: %v", err)
+		}
+	}
+	return cipher, nil
+}
+
+// Enable loads the Cipher from the config and sets it on the controller
+func Enable(controller *chik.Controller) (*Cipher, error) {
+	cipher, err := FromConfig(controller.ID)
+	if err != nil {
+		return nil, err
+	}
+	controller.SetCipher(cipher)
+	return cipher, nil
+}
+
+// Save writes the keys into the config file
+func (c *Cipher) Save() error {
+	c.RLock()
+	conf := keysConfig{
+		PublicKey:  c.public.String(),
+		PrivateKey: c.private.String(),
+		Peers:      make(map[string]string, len(c.peers)),
+	}
+	for peer, key := range c.peers {
+		conf.Peers[peer.String()] = key.String()
+	}
+	c.RUnlock()
+	config.Set(configKey, conf)
+	return config.Sync()
+}
+
+// PublicKey returns the key peers use to seal the messages for this controller
+func (c *Cipher) PublicKey() Key {
+	return c.public
+}
+
+// SetPeerKey sets the public key of a peer, from now on messages exchanged with it are sealed
+func (c *Cipher) SetPeerKey(peer uuid.UUID, key Key) {
+	c.Lock()
+	defer c.Unlock()
+	c.peers[peer] = key
+}
+
+// RemovePeer forgets the key of a peer
+func (c *Cipher) RemovePeer(peer uuid.UUID) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.peers, peer)
+}
+
+// PeerKey returns the public key of a peer
+func (c *Cipher) PeerKey(peer uuid.UUID) (Key, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	key, ok := c.peers[peer]
+	return key, ok
+}
+
+// ApplyPairing takes the keys of the peers paired through a relay and forgets the revoked ones
+// (see types.Pairing), call Save to keep them. A new key is taken only with the proof that its
+// peer redeemed a code created by NewPairingCode, the keys already known are left as they are
+func (c *Cipher) ApplyPairing(pairing types.Pairing) error {
+	for _, peer := range pairing.Paired {
+		if peer.PublicKey == "" {
+			continue
+		}
+		key, err := ParseKey(peer.PublicKey)
+		if err != nil {
+			return fmt.Errorf("invalid key of %v: %w", peer.ID, err)
+		}
+		if known, ok := c.PeerKey(peer.ID); ok && known == key {
+			continue
+		}
+		if peer.Proof == "" || !c.verify(peer.Proof, key) {
+			return fmt.Errorf("the key of %v has not been proved", peer.ID)
+		}
+		c.SetPeerKey(peer.ID, key)
+	}
+	for _, peer := range pairing.Revoked {
+		c.RemovePeer(peer)
+	}
+	return nil
+}
+
+// Seal encrypts the message if its receiver key is known, the sealed content carries
+// the sealing time and the whole message so that relays cannot alter the envelope
+// without being noticed
+func (c *Cipher) Seal(message *chik.Message) (*chik.Message, error) {
+	receiver, _ := message.ReceiverUUID()
+	key, ok := c.PeerKey(receiver)
+	if !ok || message.Command().Type == types.EncryptedCommandType {
+		return message, nil
+	}
+	data, err := message.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	plain := binary.BigEndian.AppendUint64(make([]byte, 0, 8+len(data)), uint64(time.Now().UnixNano()))
+	plain = append(plain, data...)
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	sealed := types.EncryptedCommand{
+		Nonce: nonce[:],
+		Box:   box.Seal(nil, plain, &nonce, (*[32]byte)(&key), (*[32]byte)(&c.private)),
+	}
+	return chik.NewMessageFrom(message.SenderUUID(), receiver, types.NewCommand(types.EncryptedCommandType, sealed)), nil
+}
+
+// Open decrypts a sealed message, plain messages are accepted only from peers without a key
+func (c *Cipher) Open(message *chik.Message) (*chik.Message, error) {
+	sender := message.SenderUUID()
+	key, ok := c.PeerKey(sender)
+	if message.Command().Type != types.EncryptedCommandType {
+		if ok {
+			return nil, fmt.Errorf("plain %v from %v refused", message.Command().Type, sender)
+		}
+		return message, nil
+	}
+	if !ok {
+		return nil, fmt.Errorf("no key for %v", sender)
+	}
+
+	var sealed types.EncryptedCommand
+	if err := json.Unmarshal(message.Command().Data, &sealed); err != nil {
+		return nil, err
+	}
+	if len(sealed.Nonce) != 24 {
+		return nil, errors.New("invalid nonce")
+	}
+	var nonce [24]byte
+	copy(nonce[:], sealed.Nonce)
+	plain, ok := box.Open(nil, sealed.Box, &nonce, (*[32]byte)(&key), (*[32]byte)(&c.private))
+	if !ok || len(plain) < 8 {
+		return nil, fmt.Errorf("cannot authenticate message from %v", sender)
+	}
+	if err := c.checkReplay(nonce, time.Unix(0, int64(binary.BigEndian.Uint64(plain)))); err != nil {
+		return nil, err
+	}
+	opened, err := chik.ParseMessage(bytes.NewReader(plain[8:]))
+	if err != nil {
+		return nil, err
+	}
+	receiver, _ := opened.ReceiverUUID()
+	if opened.SenderUUID() != sender || receiver != c.id {
+		return nil, errors.New("sealed envelope does not match")
+	}
+	return opened, nil
+}
+
+// checkReplay refuses stale messages and messages already opened
+func (c *Cipher) checkReplay(nonce [24]byte, sealedAt time.Time) error {
+	now := time.Now()
+	if now.Sub(sealedAt) > MaxAge || sealedAt.Sub(now) > MaxAge {
+		return fmt.Errorf("message sealed at %v refused", sealedAt)
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.opened[nonce]; ok {
+		return errors.New("replayed message refused")
+	}
+	for n, at := range c.opened {
+		if now.Sub(at) > MaxAge {
+			delete(c.opened, n)
+		}
+	}
+	c.opened[nonce] = sealedAt
+	return nil
+}
@@ -0,0 +1,178 @@
+package e2e
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gochik/chik"
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+)
+
+func newCipher(t *testing.T) *Cipher {
+	public, private, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(uuid.Must(uuid.NewV4()), public, private)
+}
+
+func pair(a, b *Cipher) {
+	a.SetPeerKey(b.id, b.PublicKey())
+	b.SetPeerKey(a.id, a.PublicKey())
+}
+
+func openDoor(sender, receiver uuid.UUID) *chik.Message {
+	command := types.NewCommand(types.DigitalCommandType, types.DigitalCommand{Action: types.PUSH, ApplianceID: "door"})
+	return chik.NewMessageFrom(sender, receiver, command)
+}
+
+func TestSealOpen(t *testing.T) {
+	phone, home := newCipher(t), newCipher(t)
+	pair(phone, home)
+
+	message := openDoor(phone.id, home.id)
+	sealed, err := phone.Seal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed.Command().Type != types.EncryptedCommandType || sealed.SenderUUID() != phone.id {
+		t.Fatalf("Message not sealed: %v", sealed)
+	}
+	opened, err := home.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !chik.Equal(message, opened) {
+		t.Fatalf("Expected %v, got %v", message, opened)
+	}
+
+	if _, err := home.Open(sealed); err == nil {
+		t.Error("Replayed message accepted")
+	}
+}
+
+func TestRelayTampering(t *testing.T) {
+	phone, home, relay := newCipher(t), newCipher(t), newCipher(t)
+	pair(phone, home)
+
+	if _, err := home.Open(openDoor(phone.id, home.id)); err == nil {
+		t.Error("Plain message from a paired peer accepted")
+	}
+
+	sealed, _ := phone.Seal(openDoor(phone.id, home.id))
+	var content types.EncryptedCommand
+	json.Unmarshal(sealed.Command().Data, &content)
+	content.Box[len(content.Box)-1] ^= 1
+	tampered := chik.NewMessageFrom(phone.id, home.id, types.NewCommand(types.EncryptedCommandType, content))
+	if _, err := home.Open(tampered); err == nil {
+		t.Error("Tampered message accepted")
+	}
+
+	// a relay knowing the home public key cannot impersonate the phone
+	relay.SetPeerKey(home.id, home.PublicKey())
+	forged, _ := relay.Seal(openDoor(phone.id, home.id))
+	if _, err := home.Open(forged); err == nil {
+		t.Error("Forged message accepted")
+	}
+
+	// messages for unpaired peers are left untouched
+	other := uuid.Must(uuid.NewV4())
+	plain := openDoor(phone.id, other)
+	if sealed, _ := phone.Seal(plain); sealed != plain {
+		t.Error("Message for an unpaired peer sealed")
+	}
+}
+
+func TestKeyEncoding(t *testing.T) {
+	public, _, _ := GenerateKeys()
+	parsed, err := ParseKey(public.String())
+	if err != nil || parsed != public {
+		t.Fatalf("Key not parsed back: %v", err)
+	}
+	if _, err := ParseKey("c2hvcnQ="); err == nil {
+		t.Error("Short key accepted")
+	}
+	if err := newCipher(t).checkReplay([24]byte{}, time.Now().Add(-MaxAge-time.Second)); err == nil {
+		t.Error("Stale message accepted")
+	}
+}
+
+func TestApplyPairing(t *testing.T) {
+	phone, home := newCipher(t), newCipher(t)
+	paired := types.PairedPeer{ID: phone.id, PublicKey: phone.PublicKey().String()}
+	if err := home.ApplyPairing(types.Pairing{Paired: []types.PairedPeer{paired}}); err == nil {
+		t.Fatal("Key without proof accepted")
+	}
+
+	shown, err := home.NewPairingCode("ABCDEFGH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := ParsePairingCode(strings.ToLower(shown))
+	if err != nil || code.Relay != "ABCDEFGH" {
+		t.Fatalf("Unexpected code %v: %+v %v", shown, code, err)
+	}
+	paired.Proof, err = phone.RedeemPairing(code, types.PairedPeer{ID: home.id, PublicKey: home.PublicKey().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, ok := phone.PeerKey(home.id); !ok || key != home.PublicKey() {
+		t.Fatal("Key of the creator not set")
+	}
+	if err := home.ApplyPairing(types.Pairing{Paired: []types.PairedPeer{paired}}); err != nil {
+		t.Fatal(err)
+	}
+	if key, ok := home.PeerKey(phone.id); !ok || key != phone.PublicKey() {
+		t.Fatal("Paired key not set")
+	}
+	// known keys need no proof, eg: when the pairings are listed
+	if err := home.ApplyPairing(types.Pairing{Paired: []types.PairedPeer{{ID: phone.id, PublicKey: phone.PublicKey().String()}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := home.ApplyPairing(types.Pairing{Paired: []types.PairedPeer{{ID: phone.id, PublicKey: "invalid"}}}); err == nil {
+		t.Error("Invalid key accepted")
+	}
+
+	home.ApplyPairing(types.Pairing{Revoked: []uuid.UUID{phone.id}})
+	if _, ok := home.PeerKey(phone.id); ok {
+		t.Error("Revoked key kept")
+	}
+}
+
+func TestPairingKeysReplaced(t *testing.T) {
+	phone, home, relay := newCipher(t), newCipher(t), newCipher(t)
+	shown, _ := home.NewPairingCode("ABCDEFGH")
+	code, _ := ParsePairingCode(shown)
+
+	// the relay hands out its own key in place of the one of the creator
+	if _, err := phone.RedeemPairing(code, types.PairedPeer{ID: home.id, PublicKey: relay.PublicKey().String()}); err == nil {
+		t.Fatal("Replaced key of the creator accepted")
+	}
+	if _, ok := phone.PeerKey(home.id); ok {
+		t.Fatal("Replaced key of the creator set")
+	}
+
+	// the relay hands out its own key in place of the one of the redeemer, with or without a proof
+	proof, err := phone.RedeemPairing(code, types.PairedPeer{ID: home.id, PublicKey: home.PublicKey().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, _ := relay.RedeemPairing(code, types.PairedPeer{ID: home.id, PublicKey: home.PublicKey().String()})
+	forged = forged[:len(forged)-4] + "AAA="
+	for _, current := range []string{"", proof, forged} {
+		replaced := types.PairedPeer{ID: phone.id, PublicKey: relay.PublicKey().String(), Proof: current}
+		if err := home.ApplyPairing(types.Pairing{Paired: []types.PairedPeer{replaced}}); err == nil {
+			t.Fatalf("Replaced key of the redeemer accepted with proof %q", current)
+		}
+	}
+
+	// the wrong proofs discard the secret, so that it cannot be guessed
+	paired := types.PairedPeer{ID: phone.id, PublicKey: phone.PublicKey().String(), Proof: proof}
+	if err := home.ApplyPairing(types.Pairing{Paired: []types.PairedPeer{paired}}); err == nil {
+		t.Fatal("Proof accepted after a wrong one")
+	}
+}
@@ -0,0 +1,127 @@
+package e2e
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gochik/chik/types"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// PairingTTL is how long the secret of a pairing code created by NewPairingCode can be proved
+const PairingTTL = 10 * time.Minute
+
+// The part of a pairing code added by the creator: a secret, never sent to the relay,
+// followed by a tag binding the public key of the creator to the secret
+const (
+	secretLength = 4
+	tagLength    = 4
+)
+
+var codeEncoding = base32.NewEncoding("ABCDEFGHJKLMNPQRSTUVWXYZ23456789").WithPadding(base32.NoPadding)
+
+// PairingCode is a pairing code read by the user, see ParsePairingCode
+type PairingCode struct {
+	// Relay is the part of the code the relay knows, to be sent in the pairing requests
+	Relay  string
+	secret string
+	tag    string
+}
+
+// ParsePairingCode splits a code created by NewPairingCode, the separators are ignored
+func ParsePairingCode(code string) (PairingCode, error) {
+	code = strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(code))
+	if len(code) <= secretLength+tagLength {
+		return PairingCode{}, errors.New("pairing code too short")
+	}
+	relay := len(code) - secretLength - tagLength
+	return PairingCode{
+		Relay:  code[:relay],
+		secret: code[relay : relay+secretLength],
+		tag:    code[relay+secretLength:],
+	}, nil
+}
+
+// keyTag binds the key to the secret of a pairing code
+func keyTag(secret string, key Key) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(key[:])
+	return codeEncoding.EncodeToString(mac.Sum(nil))[:tagLength]
+}
+
+// NewPairingCode extends the code created by the relay with a secret and the tag of this cipher key,
+// the result is shown to the user of the peer to pair. The secret is kept for PairingTTL to check
+// the key of that peer (see ApplyPairing)
+func (c *Cipher) NewPairingCode(relayCode string) (string, error) {
+	random := make([]byte, secretLength)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	secret := codeEncoding.EncodeToString(random)[:secretLength]
+	now := time.Now()
+	c.Lock()
+	for pending, expires := range c.secrets {
+		if now.After(expires) {
+			delete(c.secrets, pending)
+		}
+	}
+	c.secrets[secret] = now.Add(PairingTTL)
+	c.Unlock()
+
+	code := relayCode + secret + keyTag(secret, c.public)
+	groups := make([]string, 0, len(code)/4+1)
+	for len(code) > 4 {
+		groups = append(groups, code[:4])
+		code = code[4:]
+	}
+	return strings.Join(append(groups, code), "-"), nil
+}
+
+// RedeemPairing checks the key of the peer that created the code, as handed out by the relay,
+// and takes it. It returns the proof to send along with the pairing request, that tells the
+// creator that this cipher key has not been replaced by the relay
+func (c *Cipher) RedeemPairing(code PairingCode, creator types.PairedPeer) (string, error) {
+	key, err := ParseKey(creator.PublicKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid key of %v: %w", creator.ID, err)
+	}
+	if !hmac.Equal([]byte(keyTag(code.secret, key)), []byte(code.tag)) {
+		return "", fmt.Errorf("the key of %v does not match the pairing code", creator.ID)
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+	proof := box.Seal(nonce[:], []byte(code.secret), &nonce, (*[32]byte)(&key), (*[32]byte)(&c.private))
+	c.SetPeerKey(creator.ID, key)
+	return base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verify tells whether the proof of a redeemed code comes from the owner of key, the secret is consumed.
+// A wrong proof discards every pending secret, so that they cannot be guessed
+func (c *Cipher) verify(proof string, key Key) bool {
+	var secret []byte
+	data, err := base64.StdEncoding.DecodeString(proof)
+	if err == nil && len(data) >= 24 {
+		var nonce [24]byte
+		copy(nonce[:], data)
+		secret, _ = box.Open(nil, data[24:], &nonce, (*[32]byte)(&key), (*[32]byte)(&c.private))
+	}
+	c.Lock()
+	defer c.Unlock()
+	expires, ok := c.secrets[string(secret)]
+	if secret == nil || !ok {
+		logger.Warn().Msg("Wrong pairing proof, discarding the pending pairing codes")
+		c.secrets = make(map[string]time.Time)
+		return false
+	}
+	delete(c.secrets, string(secret))
+	return !time.Now().After(expires)
+}
@@ -0,0 +1,202 @@
+package chik
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/gochik/chik/msgpack"
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+)
+
+// Features advertised in the Handshake, a remote uses the ones supported by both sides
+const (
+	FeatureCompact     = "msgpack"
+	FeatureCompression = "flate"
+)
+
+// CompressionThreshold is the content size above which compression is attempted
+const CompressionThreshold = 512
+
+// maxInflatedSize bounds the size of a decompressed message content
+const maxInflatedSize = 16 * 1024 * 1024
+
+// Content markers: JSON content always starts with '{', other encodings are
+// identified by their first byte
+const (
+	compactMarker byte = 0x01
+	flateMarker   byte = 0x02
+)
+
+// Encoding describes how the message content is serialized on a connection
+type Encoding struct {
+	// Compact uses MessagePack instead of JSON
+	Compact bool
+
+	// Compress deflates the contents larger than CompressionThreshold
+	Compress bool
+}
+
+// negotiateEncoding returns the encoding to use with a peer supporting the given features
+func negotiateEncoding(features []string) Encoding {
+	var encoding Encoding
+	for _, feature := range features {
+		switch feature {
+		case FeatureCompact:
+			encoding.Compact = true
+		case FeatureCompression:
+			encoding.Compress = true
+		}
+	}
+	return encoding
+}
+
+// supportedFeatures are the features advertised by this implementation
+func supportedFeatures() []string {
+	return []string{FeatureCompact, FeatureCompression}
+}
+
+// advertisedEncoding is what a peer may use to send to us, after reading our handshake
+var advertisedEncoding = negotiateEncoding(supportedFeatures())
+
+func uuidOrNil(id uuid.UUID) interface{} {
+	if id == uuid.Nil {
+		return nil
+	}
+	return id.Bytes()
+}
+
+func (m *Message) compactContent() ([]byte, error) {
+	var data interface{}
+	if len(m.command.Data) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(m.command.Data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&data); err != nil {
+			return nil, err
+		}
+	}
+	content, err := msgpack.Marshal([]interface{}{
+		int64(m.command.Type),
+		data,
+		uuidOrNil(m.requestID),
+		uuidOrNil(m.replyTo),
+		uuidOrNil(m.messageID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{compactMarker}, content...), nil
+}
+
+func (m *Message) parseCompactContent(data []byte) error {
+	value, err := msgpack.Unmarshal(data)
+	if err != nil {
+		return err
+	}
+	fields, ok := value.([]interface{})
+	if !ok || len(fields) != 5 {
+		return errors.New("Invalid compact message")
+	}
+	commandType, ok := fields[0].(int64)
+	if !ok || commandType < 0 || commandType > math.MaxUint8 {
+		return errors.New("Invalid compact message type")
+	}
+	payload, err := json.Marshal(fields[1])
+	if err != nil {
+		return err
+	}
+	m.command = &types.Command{Type: types.CommandType(commandType), Data: payload}
+	for i, id := range []*uuid.UUID{&m.requestID, &m.replyTo, &m.messageID} {
+		if fields[i+2] == nil {
+			continue
+		}
+		raw, ok := fields[i+2].([]byte)
+		if !ok {
+			return errors.New("Invalid compact message id")
+		}
+		if *id, err = uuid.FromBytes(raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deflate(data []byte) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	buffer.WriteByte(flateMarker)
+	writer, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func inflate(data []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+	result, err := io.ReadAll(io.LimitReader(reader, maxInflatedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(result) > maxInflatedSize {
+		return nil, fmt.Errorf("Message content exceeds %d bytes once decompressed", maxInflatedSize)
+	}
+	return result, nil
+}
+
+// encodeContent serializes the message content with the given encoding
+func (m *Message) encodeContent(encoding Encoding) ([]byte, error) {
+	var data []byte
+	var err error
+	if encoding.Compact {
+		data, err = m.compactContent()
+	} else {
+		data, err = m.jsonContent()
+	}
+	if err != nil || !encoding.Compress || len(data) <= CompressionThreshold {
+		return data, err
+	}
+	compressed, err := deflate(data)
+	if err != nil || len(compressed) >= len(data) {
+		return data, nil
+	}
+	return compressed, nil
+}
+
+// parseContent decodes the message content, that must be JSON or use the accepted encoding
+func (m *Message) parseContent(data []byte, accepted Encoding) error {
+	switch data[0] {
+	case flateMarker:
+		if !accepted.Compress {
+			return errors.New("Compressed message not negotiated")
+		}
+		inflated, err := inflate(data[1:])
+		if err != nil {
+			return err
+		}
+		if len(inflated) == 0 || inflated[0] == flateMarker {
+			return errors.New("Invalid compressed message")
+		}
+		return m.parseContent(inflated, accepted)
+
+	case compactMarker:
+		if !accepted.Compact {
+			return errors.New("Compact message not negotiated")
+		}
+		return m.parseCompactContent(data[1:])
+
+	default:
+		return m.parseJSONContent(data)
+	}
+}
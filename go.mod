@@ -5,7 +5,6 @@ go 1.20
 require (
 	github.com/PaesslerAG/gval v1.1.2
 	github.com/creachadair/jrpc2 v0.34.2
-	github.com/cskr/pubsub v1.0.2
 	github.com/gochik/gpio v1.2.0
 	github.com/gochik/modbus v0.0.0-20200809120227-19556d19cd9e
 	github.com/gochik/sunrisesunset v0.0.0-20201119120622-b882a324fa0f
@@ -17,6 +16,7 @@ require (
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
 	github.com/thoas/go-funk v0.9.1
 	go.step.sm/crypto v0.13.0
+	golang.org/x/crypto v0.0.0-20211215165025-cf75a172585e
 	golang.org/x/exp v0.0.0-20231006140011-7918f672742d
 	golang.org/x/net v0.0.0-20211216030914-fe4d6282115f
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
@@ -68,7 +68,6 @@ require (
 	go.mozilla.org/pkcs7 v0.0.0-20210826202110-33d05740a352 // indirect
 	go.step.sm/cli-utils v0.7.0 // indirect
 	go.step.sm/linkedca v0.7.0 // indirect
-	golang.org/x/crypto v0.0.0-20211215165025-cf75a172585e // indirect
 	golang.org/x/sys v0.13.0 // indirect
 	golang.org/x/text v0.3.7 // indirect
 	google.golang.org/genproto v0.0.0-20210719143636-1d5a45f8e492 // indirect
@@ -0,0 +1,120 @@
+package chik
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// handlerNode is a vertex of the graph built from Handler.Dependencies()
+type handlerNode struct {
+	sync.Mutex
+	handler      Handler
+	dependencies []*handlerNode
+	dependents   []*handlerNode
+	ready        chan struct{}
+	readyOnce    sync.Once
+	// failed is closed when the handler gives up without completing its setup
+	failed     chan struct{}
+	failedOnce sync.Once
+	stopped    chan struct{}
+	running    bool
+	cancel     context.CancelFunc
+	err        error
+}
+
+func newHandlerNode(h Handler) *handlerNode {
+	stopped := make(chan struct{})
+	close(stopped)
+	return &handlerNode{
+		handler: h,
+		ready:   make(chan struct{}),
+		failed:  make(chan struct{}),
+		stopped: stopped,
+	}
+}
+
+// setReady marks the handler as set up, unlocking the handlers depending on it
+func (n *handlerNode) setReady() {
+	n.readyOnce.Do(func() { close(n.ready) })
+}
+
+// setFailed tells the handlers depending on this one that it is not going to be ready
+func (n *handlerNode) setFailed() {
+	n.failedOnce.Do(func() { close(n.failed) })
+}
+
+// stoppedChannel returns a channel that is closed when the handler is not running
+func (n *handlerNode) stoppedChannel() <-chan struct{} {
+	n.Lock()
+	defer n.Unlock()
+	return n.stopped
+}
+
+func (n *handlerNode) String() string {
+	return n.handler.String()
+}
+
+// sortHandlers builds the dependency graph of the given handlers and returns it in topological order.
+// Handlers without a relation between each other keep the order they have been given.
+// An error is returned on duplicated names, missing dependencies or dependency cycles
+func sortHandlers(handlers []Handler) ([]*handlerNode, error) {
+	nodes := make([]*handlerNode, 0, len(handlers))
+	byName := make(map[string]*handlerNode, len(handlers))
+	for _, h := range handlers {
+		name := h.String()
+		if _, exists := byName[name]; exists {
+			return nil, fmt.Errorf("handler %q is registered more than once", name)
+		}
+		node := newHandlerNode(h)
+		byName[name] = node
+		nodes = append(nodes, node)
+	}
+
+	inDegree := make(map[*handlerNode]int, len(nodes))
+	for _, node := range nodes {
+		for _, dependency := range node.handler.Dependencies() {
+			dep, ok := byName[dependency]
+			if !ok {
+				return nil, fmt.Errorf("handler %q depends on %q that is not registered", node, dependency)
+			}
+			node.dependencies = append(node.dependencies, dep)
+			dep.dependents = append(dep.dependents, node)
+			inDegree[node]++
+		}
+	}
+
+	result := make([]*handlerNode, 0, len(nodes))
+	for len(result) < len(nodes) {
+		progress := false
+		for _, node := range nodes {
+			if inDegree[node] != 0 {
+				continue
+			}
+			inDegree[node] = -1
+			result = append(result, node)
+			for _, dependent := range node.dependents {
+				inDegree[dependent]--
+			}
+			progress = true
+		}
+		if !progress {
+			break
+		}
+	}
+
+	if len(result) < len(nodes) {
+		cycle := make([]string, 0)
+		for _, node := range nodes {
+			if inDegree[node] > 0 {
+				cycle = append(cycle, node.String())
+			}
+		}
+		sort.Strings(cycle)
+		return nil, fmt.Errorf("dependency cycle detected between handlers: %s", strings.Join(cycle, ", "))
+	}
+
+	return result, nil
+}
@@ -16,7 +16,9 @@ type Handler interface {
 	Topics() []types.CommandType
 	Setup(controller *Controller) (Interrupts, error)
 	HandleMessage(message *Message, controller *Controller) error
-	HandleTimerEvent(tick time.Time, controller *Controller) error
+	// HandleTimerEvent is called when a timer fires, name is the key of the timer in Interrupts.Timers
+	// or empty for Interrupts.Timer
+	HandleTimerEvent(name string, tick time.Time, controller *Controller) error
 	HandleChannelEvent(event interface{}, controller *Controller) error
 	Teardown()
 }
@@ -43,7 +45,7 @@ func (s *BaseHandler) HandleMessage(message *Message, controller *Controller) er
 	return nil
 }
 
-func (s *BaseHandler) HandleTimerEvent(tick time.Time, controller *Controller) error {
+func (s *BaseHandler) HandleTimerEvent(name string, tick time.Time, controller *Controller) error {
 	return nil
 }
 
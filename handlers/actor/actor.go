@@ -34,6 +34,12 @@ type actor struct {
 	previousState map[string]interface{}
 }
 
+func init() {
+	chik.RegisterHandler("actions", func() (chik.Handler, error) {
+		return New(), nil
+	})
+}
+
 // New creates a new actor handler
 func New() chik.Handler {
 	actions := make([]Action, 0)
@@ -78,7 +84,7 @@ func (h *actor) executeActions(controller *chik.Controller, currentState map[str
 }
 
 func (h *actor) Dependencies() []string {
-	return []string{"io", "status", "time"}
+	return []string{"io", "status", "datetime"}
 }
 
 func (h *actor) Topics() []types.CommandType {
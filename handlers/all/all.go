@@ -0,0 +1,19 @@
+// Package all registers every handler that can be created by name (see chik.CreateHandlers).
+// Import it for its side effects when the list of handlers comes from the config file:
+//
+//	import _ "github.com/gochik/chik/handlers/all"
+package all
+
+import (
+	_ "github.com/gochik/chik/handlers/actor"
+	_ "github.com/gochik/chik/handlers/badge"
+	_ "github.com/gochik/chik/handlers/control"
+	_ "github.com/gochik/chik/handlers/datetime"
+	_ "github.com/gochik/chik/handlers/heartbeat"
+	_ "github.com/gochik/chik/handlers/heating"
+	_ "github.com/gochik/chik/handlers/io"
+	_ "github.com/gochik/chik/handlers/snapcast"
+	_ "github.com/gochik/chik/handlers/status"
+	_ "github.com/gochik/chik/handlers/systemd"
+	_ "github.com/gochik/chik/handlers/telegram"
+)
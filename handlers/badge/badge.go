@@ -4,7 +4,6 @@ import (
 	"encoding/hex"
 	"errors"
 	"io"
-	"time"
 
 	"github.com/gochik/chik"
 	"github.com/gochik/chik/config"
@@ -32,6 +31,12 @@ type TagReader struct {
 	status  *chik.StatusHolder
 }
 
+func init() {
+	chik.RegisterHandler(name, func() (chik.Handler, error) {
+		return New(), nil
+	})
+}
+
 func New() chik.Handler {
 	var c conf
 	err := config.GetStruct(name, &c)
@@ -98,7 +103,7 @@ func (r *TagReader) HandleChannelEvent(event any, controller *chik.Controller) e
 		if !ok {
 			s = make(status)
 		}
-		s[identity] = types.TimeIndication(time.Now().Unix())
+		s[identity] = types.TimeIndication(controller.Now().Unix())
 		return s, true
 	})
 	return nil
@@ -0,0 +1,99 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gochik/chik"
+	"github.com/gochik/chik/types"
+	"github.com/rs/zerolog/log"
+)
+
+const name = "control"
+
+var logger = log.With().Str("handler", name).Logger()
+
+// HandlerCommand is the content of a HandlerRequestCommandType message.
+// Action can be:
+// GET: list registered handlers
+// SET: start the given handler
+// RESET: stop the given handler
+// TOGGLE: restart the given handler (stop followed by a start)
+type HandlerCommand struct {
+	Action  types.Action `json:"action"`
+	Handler string       `json:"handler,omitempty"`
+}
+
+// HandlerReply is the content of a HandlerReplyCommandType message,
+// it always contains the current state of every handler
+type HandlerReply struct {
+	Handlers []chik.HandlerInfo `json:"handlers"`
+	Error    string             `json:"error,omitempty"`
+}
+
+type control struct {
+	chik.BaseHandler
+}
+
+func init() {
+	chik.RegisterHandler(name, func() (chik.Handler, error) {
+		return New(), nil
+	})
+}
+
+// New creates a control handler, it allows to inspect, stop, start and restart handlers at runtime
+func New() chik.Handler {
+	return &control{}
+}
+
+func (h *control) Topics() []types.CommandType {
+	return []types.CommandType{types.HandlerRequestCommandType}
+}
+
+func (h *control) execute(command HandlerCommand, controller *chik.Controller) error {
+	if command.Action != types.GET && command.Handler == name {
+		return fmt.Errorf("%s handler cannot be managed by itself", name)
+	}
+
+	switch command.Action {
+	case types.GET:
+		return nil
+
+	case types.SET:
+		logger.Info().Msgf("Starting %s", command.Handler)
+		return controller.StartHandler(command.Handler)
+
+	case types.RESET:
+		logger.Info().Msgf("Stopping %s", command.Handler)
+		return controller.StopHandler(command.Handler)
+
+	case types.TOGGLE:
+		logger.Info().Msgf("Restarting %s", command.Handler)
+		return controller.RestartHandler(command.Handler)
+
+	default:
+		return fmt.Errorf("unsupported action %v", command.Action)
+	}
+}
+
+func (h *control) HandleMessage(message *chik.Message, controller *chik.Controller) error {
+	var command HandlerCommand
+	err := json.Unmarshal(message.Command().Data, &command)
+	if err != nil {
+		logger.Warn().Msg("Unexpected message")
+		return nil
+	}
+
+	reply := HandlerReply{}
+	if err := h.execute(command, controller); err != nil {
+		logger.Err(err).Msg("Handler command failed")
+		reply.Error = err.Error()
+	}
+	reply.Handlers = controller.Handlers()
+	controller.Reply(message, types.HandlerReplyCommandType, reply)
+	return nil
+}
+
+func (h *control) String() string {
+	return name
+}
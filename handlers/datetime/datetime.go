@@ -36,6 +36,12 @@ type datetime struct {
 	status *chik.StatusHolder
 }
 
+func init() {
+	chik.RegisterHandler("datetime", func() (chik.Handler, error) {
+		return New(), nil
+	})
+}
+
 // New creates a new DateTime handler.
 // it updates the global status with the current date and time once every minute
 // it allows to execute actions based on the current time
@@ -66,7 +72,7 @@ func (h *datetime) Setup(controller *chik.Controller) (chik.Interrupts, error) {
 	return chik.Interrupts{Timer: chik.NewTimer(10*time.Second, true)}, nil
 }
 
-func (h *datetime) HandleTimerEvent(tick time.Time, controller *chik.Controller) error {
+func (h *datetime) HandleTimerEvent(name string, tick time.Time, controller *chik.Controller) error {
 	if h.data.Day != tick.Day() {
 		sunrise, sunset, _ := sunrisesunset.GetSunriseSunset(h.conf.Latitude, h.conf.Longitude, tick)
 		h.data.Sunrise = types.TimeIndication(sunrise.Unix())
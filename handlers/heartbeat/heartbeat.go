@@ -13,10 +13,17 @@ var logger = log.With().Str("handler", "heartbeat").Logger()
 
 const maxErrors uint32 = 300
 
+// heartbeat sends a periodic heartbeat to every connected peer
+// and stops the connection to the ones that stopped answering
 type heartbeat struct {
 	chik.BaseHandler
-	errors   uint32
-	remoteID uuid.UUID
+	errors map[uuid.UUID]uint32
+}
+
+func init() {
+	chik.RegisterHandler("heartbeat", func() (chik.Handler, error) {
+		return New(), nil
+	})
 }
 
 // New creates a new heartbeat handler
@@ -29,30 +36,37 @@ func (h *heartbeat) Topics() []types.CommandType {
 }
 
 func (h *heartbeat) Setup(controller *chik.Controller) (chik.Interrupts, error) {
+	h.errors = make(map[uuid.UUID]uint32)
 	return chik.Interrupts{Timer: chik.NewTimer((chik.MaxIdleTime/3)*2, true)}, nil
 }
 
 func (h *heartbeat) HandleMessage(message *chik.Message, controller *chik.Controller) error {
-	if h.remoteID == uuid.Nil {
-		h.remoteID = message.SenderUUID()
-	}
-
 	if message.Command().Type == types.HeartbeatType {
-		logger.Debug().Msg("Heartbeat received")
-		h.errors = 0
+		logger.Debug().Str("peer", message.SenderUUID().String()).Msg("Heartbeat received")
+		h.errors[message.SenderUUID()] = 0
 	}
 	return nil
 }
 
-func (h *heartbeat) HandleTimerEvent(tick time.Time, controller *chik.Controller) error {
-	logger.Debug().Msg("Sending heartbeat")
-	controller.PubMessage(chik.NewMessage(h.remoteID, types.NewCommand(types.HeartbeatType, nil)),
-		types.AnyOutgoingCommandType.String())
-	h.errors = h.errors + 1
-	if h.errors >= maxErrors {
-		logger.Error().Msg("Heartbeat threshold exceeded: shutting down remote connection")
-		controller.Pub(types.NewCommand(types.RemoteStopCommandType, nil), h.remoteID)
+func (h *heartbeat) HandleTimerEvent(name string, tick time.Time, controller *chik.Controller) error {
+	peers := controller.Peers()
+	if len(peers) == 0 {
+		// the peer is not known yet: the heartbeat takes the default route
+		peers = []uuid.UUID{uuid.Nil}
+	}
+	// peers that are not connected anymore are forgotten
+	errors := make(map[uuid.UUID]uint32, len(peers))
+	for _, peer := range peers {
+		logger.Debug().Str("peer", peer.String()).Msg("Sending heartbeat")
+		controller.PubMessage(chik.NewMessage(peer, types.NewCommand(types.HeartbeatType, nil)),
+			types.AnyOutgoingCommandType.String())
+		errors[peer] = h.errors[peer] + 1
+		if errors[peer] >= maxErrors {
+			logger.Error().Str("peer", peer.String()).Msg("Heartbeat threshold exceeded: shutting down remote connection")
+			controller.Pub(types.NewCommand(types.RemoteStopCommandType, nil), peer)
+		}
 	}
+	h.errors = errors
 	return nil
 }
 
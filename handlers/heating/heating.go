@@ -37,6 +37,12 @@ type heating struct {
 	Threshold float64 `json:"threshold"`
 }
 
+func init() {
+	chik.RegisterHandler("heating", func() (chik.Handler, error) {
+		return New(), nil
+	})
+}
+
 // New creates an heating controller
 func New() chik.Handler {
 	h := heating{
@@ -132,7 +138,7 @@ func (h *heating) HandleMessage(message *chik.Message, controller *chik.Controll
 			controller.Pub(types.NewCommand(types.DigitalCommandType, command), chik.LoopbackID)
 			continue
 		}
-		timeDiff := time.Now().Sub(r.lastHeatingStatusChange)
+		timeDiff := controller.Now().Sub(r.lastHeatingStatusChange)
 		if r.currentTemperature > r.targetTemperature+h.Threshold && r.isHeating && (timeDiff < 15*time.Minute || timeDiff > MinimumRunningTime) {
 			command := types.DigitalCommand{
 				Action:      types.RESET,
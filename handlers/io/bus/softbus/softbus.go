@@ -2,28 +2,35 @@ package softbus
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/gochik/chik/handlers/io/bus"
 	"github.com/gochik/chik/types"
 	"github.com/rs/zerolog/log"
-	funk "github.com/thoas/go-funk"
 )
 
 var logger = log.With().Str("handler", "io").Str("bus", "soft").Logger()
 
 type softDevice struct {
+	mutex sync.Mutex
 	Id    string
 	Type  bus.DeviceKind
 	Value interface{}
 }
 
-type softBus struct {
+// SoftBus is a bus of devices that only exist in memory
+type SoftBus struct {
 	devices map[string]*softDevice
 	updates chan string
 }
 
 func New() bus.Bus {
-	return &softBus{make(map[string]*softDevice), make(chan string, 0)}
+	return NewSoftBus()
+}
+
+// NewSoftBus creates an empty SoftBus, devices are added by AddDevice or by the bus config
+func NewSoftBus() *SoftBus {
+	return &SoftBus{make(map[string]*softDevice), make(chan string, 0)}
 }
 
 func (d *softDevice) ID() string {
@@ -35,6 +42,8 @@ func (d *softDevice) Kind() bus.DeviceKind {
 }
 
 func (d *softDevice) Description() bus.DeviceDescription {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	var state interface{}
 	switch d.Kind() {
 	case bus.DigitalInputDevice, bus.DigitalOutputDevice:
@@ -62,6 +71,8 @@ func (d *softDevice) Description() bus.DeviceDescription {
 }
 
 func (d *softDevice) TurnOn() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	if d.Type != bus.DigitalOutputDevice {
 		logger.Error().Msgf("Cannot turn on %v, it is not a digital output device", d.Id)
 		return
@@ -70,6 +81,8 @@ func (d *softDevice) TurnOn() {
 }
 
 func (d *softDevice) TurnOff() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	if d.Type != bus.DigitalOutputDevice {
 		logger.Error().Msgf("Cannot turn off %v, it is not a digital output device", d.Id)
 		return
@@ -78,6 +91,8 @@ func (d *softDevice) TurnOff() {
 }
 
 func (d *softDevice) Toggle() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	if d.Type != bus.DigitalOutputDevice {
 		logger.Error().Msgf("Cannot toggle %v, it is not a digital output device", d.Id)
 		return
@@ -86,6 +101,8 @@ func (d *softDevice) Toggle() {
 }
 
 func (d *softDevice) SetValue(value float64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	if d.Type != bus.AnalogOutputDevice {
 		logger.Error().Msgf("Cannot set value on %v, it is not an analog output device", d.Id)
 		return
@@ -94,6 +111,8 @@ func (d *softDevice) SetValue(value float64) {
 }
 
 func (d *softDevice) AddValue(value float64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	if d.Type != bus.AnalogOutputDevice {
 		logger.Error().Msgf("Cannot set value on %v, it is not an analog output device", d.Id)
 		return
@@ -101,21 +120,42 @@ func (d *softDevice) AddValue(value float64) {
 	d.Value = d.Value.(float64) + value
 }
 
-func (a *softBus) Initialize(config interface{}) {
+func (a *SoftBus) Initialize(config interface{}) {
 	var devices []*softDevice
 	err := types.Decode(config, &devices)
 	if err != nil {
 		logger.Error().Msgf("Failed initializing bus: %v", err)
 	}
-	a.devices = funk.ToMap(devices, "Id").(map[string]*softDevice)
+	for _, device := range devices {
+		a.devices[device.Id] = device
+	}
+}
+
+// AddDevice adds a device to the bus, it must be called before the bus is initialized
+func (a *SoftBus) AddDevice(id string, kind bus.DeviceKind, value interface{}) {
+	a.devices[id] = &softDevice{Id: id, Type: kind, Value: value}
+}
+
+// Inject changes the value of a device as if it was changed by the outside world,
+// it blocks until the change is notified to the bus listener
+func (a *SoftBus) Inject(id string, value interface{}) error {
+	device, ok := a.devices[id]
+	if !ok {
+		return fmt.Errorf("No soft device with ID: %s found", id)
+	}
+	device.mutex.Lock()
+	device.Value = value
+	device.mutex.Unlock()
+	a.updates <- id
+	return nil
 }
 
-func (a *softBus) Deinitialize() {
+func (a *SoftBus) Deinitialize() {
 	logger.Debug().Msg("Deinitialize called")
 	close(a.updates)
 }
 
-func (a *softBus) Device(id string) (bus.Device, error) {
+func (a *SoftBus) Device(id string) (bus.Device, error) {
 	device, ok := a.devices[id]
 	if !ok {
 		return nil, fmt.Errorf("No soft device with ID: %s found", id)
@@ -123,7 +163,7 @@ func (a *softBus) Device(id string) (bus.Device, error) {
 	return device, nil
 }
 
-func (a *softBus) DeviceIds() []string {
+func (a *SoftBus) DeviceIds() []string {
 	result := make([]string, 0, len(a.devices))
 	for k := range a.devices {
 		result = append(result, k)
@@ -131,10 +171,10 @@ func (a *softBus) DeviceIds() []string {
 	return result
 }
 
-func (a *softBus) DeviceChanges() <-chan string {
+func (a *SoftBus) DeviceChanges() <-chan string {
 	return a.updates
 }
 
-func (a *softBus) String() string {
+func (a *SoftBus) String() string {
 	return "soft"
 }
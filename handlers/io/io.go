@@ -32,10 +32,22 @@ type io struct {
 	deviceChanges chan interface{}
 }
 
-// New creates a new IO handler
+func init() {
+	chik.RegisterHandler("io", func() (chik.Handler, error) {
+		return New(), nil
+	})
+}
+
+// New creates a new IO handler using the buses available on the platform
 func New() chik.Handler {
+	return NewWithBuses(platform.CreateBuses())
+}
+
+// NewWithBuses creates a new IO handler using the given buses, indexed by name.
+// Buses are initialized with the content of the actuators.<name> config key
+func NewWithBuses(buses map[string]bus.Bus) chik.Handler {
 	return &io{
-		actuators:     platform.CreateBuses(),
+		actuators:     buses,
 		busByDevice:   make(map[string]bus.Bus),
 		status:        chik.NewStatusHolder("io"),
 		wg:            sync.WaitGroup{},
@@ -78,7 +90,7 @@ func (h *io) setStatus(controller *chik.Controller, applianceID string) {
 		if device, err := h.getDevice(applianceID); err == nil {
 			status[applianceID] = CurrentStatus{
 				device.Description(),
-				types.TimeIndication(time.Now().Unix()),
+				types.TimeIndication(controller.Now().Unix()),
 			}
 		}
 		return status, false
@@ -186,7 +198,7 @@ func (h *io) Setup(controller *chik.Controller) (chik.Interrupts, error) {
 			device, _ := v.Device(id)
 			initialStatus[id] = CurrentStatus{
 				device.Description(),
-				types.TimeIndication(time.Now().Unix()),
+				types.TimeIndication(controller.Now().Unix()),
 			}
 		}
 		h.listenForDeviceChanges(v.DeviceChanges(), controller)
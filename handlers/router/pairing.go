@@ -0,0 +1,234 @@
+package router
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gochik/chik"
+	"github.com/gochik/chik/config"
+	"github.com/gochik/chik/types"
+	uuid "github.com/gofrs/uuid"
+)
+
+// PairingCodeTTL is how long a pairing code can be used
+const PairingCodeTTL = 10 * time.Minute
+
+const (
+	pairingsConfigKey = "pairings"
+	codeAlphabet      = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	codeLength        = 8
+)
+
+type pairingCode struct {
+	peer    uuid.UUID
+	key     string
+	expires time.Time
+}
+
+// loadPairings reads the pairings stored by a previous run
+func (r *relay) loadPairings() {
+	var stored map[string]map[string]string
+	config.GetStruct(pairingsConfigKey, &stored)
+	for peer, paired := range stored {
+		for other, key := range paired {
+			r.pair(uuid.FromStringOrNil(peer), uuid.FromStringOrNil(other), key)
+		}
+	}
+}
+
+func (r *relay) savePairings() {
+	r.Lock()
+	stored := make(map[string]map[string]string, len(r.pairings))
+	for peer, paired := range r.pairings {
+		stored[peer.String()] = make(map[string]string, len(paired))
+		for other, key := range paired {
+			stored[peer.String()][other.String()] = key
+		}
+	}
+	r.Unlock()
+	config.Set(pairingsConfigKey, stored)
+	if err := config.Sync(); err != nil {
+		logger.Warn().Msgf("Cannot save pairings: %v", err)
+	}
+}
+
+// pair records that peer is paired with other, whose public key is key. The caller must hold the lock
+func (r *relay) pair(peer uuid.UUID, other uuid.UUID, key string) {
+	if peer == uuid.Nil || other == uuid.Nil {
+		return
+	}
+	if r.pairings[peer] == nil {
+		r.pairings[peer] = make(map[uuid.UUID]string)
+	}
+	r.pairings[peer][other] = key
+}
+
+// allowed tells whether peer can reach other: always, unless pairing is required
+func (r *relay) allowed(peer uuid.UUID, other uuid.UUID) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.reachable(peer, other)
+}
+
+// reachable is allowed for the callers holding the lock
+func (r *relay) reachable(peer uuid.UUID, other uuid.UUID) bool {
+	if !r.conf.RequirePairing || peer == other {
+		return true
+	}
+	_, paired := r.pairings[peer][other]
+	return paired
+}
+
+func (r *relay) paired(peer uuid.UUID) []types.PairedPeer {
+	r.Lock()
+	defer r.Unlock()
+	result := make([]types.PairedPeer, 0, len(r.pairings[peer]))
+	for other, key := range r.pairings[peer] {
+		result = append(result, types.PairedPeer{ID: other, PublicKey: key})
+	}
+	return result
+}
+
+func (r *relay) createCode(peer uuid.UUID, key string, now time.Time) (string, time.Time, error) {
+	random := make([]byte, codeLength)
+	if _, err := rand.Read(random); err != nil {
+		return "", time.Time{}, err
+	}
+	code := make([]byte, codeLength)
+	for i, b := range random {
+		code[i] = codeAlphabet[int(b)%len(codeAlphabet)]
+	}
+	expires := now.Add(PairingCodeTTL)
+
+	r.Lock()
+	defer r.Unlock()
+	for existing, current := range r.codes {
+		if now.After(current.expires) {
+			delete(r.codes, existing)
+		}
+	}
+	r.codes[string(code)] = pairingCode{peer, key, expires}
+	return string(code), expires, nil
+}
+
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// lookup returns the peer that created the code, that can still be redeemed
+func (r *relay) lookup(code string, now time.Time) (pairingCode, bool) {
+	r.Lock()
+	defer r.Unlock()
+	current, ok := r.codes[normalizeCode(code)]
+	return current, ok && !now.After(current.expires)
+}
+
+// redeem consumes the code pairing the two peers, it returns the peer that created the code
+func (r *relay) redeem(code string, peer uuid.UUID, key string, now time.Time) (pairingCode, error) {
+	code = normalizeCode(code)
+	r.Lock()
+	current, ok := r.codes[code]
+	delete(r.codes, code)
+	if !ok || now.After(current.expires) {
+		r.Unlock()
+		return pairingCode{}, errors.New("invalid or expired pairing code")
+	}
+	if current.peer == peer {
+		r.Unlock()
+		return pairingCode{}, errors.New("cannot pair a peer with itself")
+	}
+	r.pair(peer, current.peer, current.key)
+	r.pair(current.peer, peer, key)
+	r.Unlock()
+	r.savePairings()
+	return current, nil
+}
+
+func (r *relay) revoke(peer uuid.UUID, other uuid.UUID) bool {
+	r.Lock()
+	_, ok := r.pairings[peer][other]
+	delete(r.pairings[peer], other)
+	delete(r.pairings[other], peer)
+	for _, id := range []uuid.UUID{peer, other} {
+		if len(r.pairings[id]) == 0 {
+			delete(r.pairings, id)
+		}
+	}
+	r.Unlock()
+	if ok {
+		r.savePairings()
+	}
+	return ok
+}
+
+func replyError(message *chik.Message, controller *chik.Controller, err error) {
+	logger.Warn().Str("peer", message.SenderUUID().String()).Msgf("%v refused: %v", message.Command().Type, err)
+	controller.Reply(message, types.ErrorReplyCommandType, types.ErrorReply{Type: message.Command().Type, Error: err.Error()})
+}
+
+// handlePairing serves the pairing requests sent to the relay
+func (h *forwarding) handlePairing(message *chik.Message, controller *chik.Controller) error {
+	var request types.PairingRequest
+	if err := json.Unmarshal(message.Command().Data, &request); err != nil {
+		logger.Warn().Msgf("Invalid pairing request: %v", err)
+		return nil
+	}
+
+	switch request.Action {
+	case types.SET:
+		if request.Code == "" {
+			code, expires, err := h.relay.createCode(h.id, request.PublicKey, controller.Now())
+			if err != nil {
+				replyError(message, controller, err)
+				return nil
+			}
+			logger.Info().Str("peer", h.id.String()).Msg("Pairing code created")
+			controller.Reply(message, types.PairingCommandType, types.Pairing{Code: code, Expires: expires})
+			return nil
+		}
+		creator, err := h.relay.redeem(request.Code, h.id, request.PublicKey, controller.Now())
+		if err != nil {
+			replyError(message, controller, err)
+			return nil
+		}
+		logger.Info().Str("peer", h.id.String()).Str("with", creator.peer.String()).Msg("Peers paired")
+		controller.Reply(message, types.PairingCommandType, types.Pairing{
+			Paired: []types.PairedPeer{{ID: creator.peer, PublicKey: creator.key}},
+		})
+		h.relay.notify(creator.peer, types.NewCommand(types.PairingCommandType, types.Pairing{
+			Paired: []types.PairedPeer{{ID: h.id, PublicKey: request.PublicKey, Proof: request.Proof}},
+		}))
+
+	case types.GET:
+		if request.Code == "" {
+			controller.Reply(message, types.PairingCommandType, types.Pairing{Paired: h.relay.paired(h.id)})
+			return nil
+		}
+		creator, ok := h.relay.lookup(request.Code, controller.Now())
+		if !ok {
+			replyError(message, controller, errors.New("invalid or expired pairing code"))
+			return nil
+		}
+		controller.Reply(message, types.PairingCommandType, types.Pairing{
+			Paired: []types.PairedPeer{{ID: creator.peer, PublicKey: creator.key}},
+		})
+
+	case types.RESET:
+		if !h.relay.revoke(h.id, request.Peer) {
+			replyError(message, controller, errors.New("not paired"))
+			return nil
+		}
+		logger.Info().Str("peer", h.id.String()).Str("with", request.Peer.String()).Msg("Pairing revoked")
+		h.relay.unwatch(h.id, []uuid.UUID{request.Peer})
+		h.relay.unwatch(request.Peer, []uuid.UUID{h.id})
+		controller.Reply(message, types.PairingCommandType, types.Pairing{Revoked: []uuid.UUID{request.Peer}})
+		h.relay.notify(request.Peer, types.NewCommand(types.PairingCommandType, types.Pairing{Revoked: []uuid.UUID{h.id}}))
+
+	default:
+		logger.Warn().Msgf("Unsupported pairing action %v", request.Action)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package router
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gochik/chik"
+	"github.com/gochik/chik/types"
+	uuid "github.com/gofrs/uuid"
+)
+
+func (r *relay) presence(id uuid.UUID) types.Presence {
+	_, online := r.peers.Load(id)
+	r.Lock()
+	defer r.Unlock()
+	return types.Presence{ID: id, Online: online, Since: r.since[id]}
+}
+
+func (r *relay) online() []types.Presence {
+	ids := make([]uuid.UUID, 0)
+	r.peers.Range(func(key, value interface{}) bool {
+		ids = append(ids, key.(uuid.UUID))
+		return true
+	})
+	result := make([]types.Presence, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, r.presence(id))
+	}
+	return result
+}
+
+func (r *relay) watch(watcher uuid.UUID, ids []uuid.UUID) {
+	r.Lock()
+	defer r.Unlock()
+	for _, id := range ids {
+		if r.watchers[id] == nil {
+			r.watchers[id] = make(map[uuid.UUID]struct{})
+		}
+		r.watchers[id][watcher] = struct{}{}
+		if r.watching[watcher] == nil {
+			r.watching[watcher] = make(map[uuid.UUID]struct{})
+		}
+		r.watching[watcher][id] = struct{}{}
+	}
+}
+
+func (r *relay) unwatch(watcher uuid.UUID, ids []uuid.UUID) {
+	r.Lock()
+	defer r.Unlock()
+	for _, id := range ids {
+		delete(r.watchers[id], watcher)
+		if len(r.watchers[id]) == 0 {
+			delete(r.watchers, id)
+			r.forget(id)
+		}
+		delete(r.watching[watcher], id)
+	}
+	if len(r.watching[watcher]) == 0 {
+		delete(r.watching, watcher)
+	}
+}
+
+// unwatchAll drops every subscription of the watcher, eg: when it disconnects
+func (r *relay) unwatchAll(watcher uuid.UUID) {
+	r.Lock()
+	ids := make([]uuid.UUID, 0, len(r.watching[watcher]))
+	for id := range r.watching[watcher] {
+		ids = append(ids, id)
+	}
+	r.Unlock()
+	r.unwatch(watcher, ids)
+}
+
+// forget drops the presence of an offline peer that is not watched nor paired, the caller must hold the lock.
+// Peers are known for queuing the messages sent to them (see known), in that case expire forgets them
+func (r *relay) forget(id uuid.UUID) {
+	if _, online := r.peers.Load(id); online || r.conf.QueueSize > 0 {
+		return
+	}
+	if len(r.watchers[id]) == 0 && len(r.pairings[id]) == 0 {
+		delete(r.since, id)
+	}
+}
+
+// changed records the new presence of the peer and notifies its watchers
+func (r *relay) changed(id uuid.UUID, online bool, at time.Time) {
+	r.Lock()
+	r.since[id] = at
+	watchers := make([]uuid.UUID, 0, len(r.watchers[id]))
+	for watcher := range r.watchers[id] {
+		watchers = append(watchers, watcher)
+	}
+	if !online {
+		r.forget(id)
+	}
+	r.Unlock()
+
+	logger.Info().Str("peer", id.String()).Bool("online", online).Msg("Presence changed")
+	command := types.NewCommand(types.PresenceCommandType, []types.Presence{{ID: id, Online: online, Since: at}})
+	for _, watcher := range watchers {
+		r.notify(watcher, command)
+	}
+}
+
+// handlePresence serves the presence requests sent to the relay
+func (h *forwarding) handlePresence(message *chik.Message, controller *chik.Controller) error {
+	var request types.PresenceRequest
+	if err := json.Unmarshal(message.Command().Data, &request); err != nil {
+		logger.Warn().Msgf("Invalid presence request: %v", err)
+		return nil
+	}
+
+	listOnline := len(request.Peers) == 0
+	// when pairing is required only the presence of paired peers is disclosed
+	peers := make([]uuid.UUID, 0, len(request.Peers))
+	for _, id := range request.Peers {
+		if h.relay.allowed(h.id, id) {
+			peers = append(peers, id)
+		}
+	}
+	request.Peers = peers
+
+	switch request.Action {
+	case types.SET:
+		h.relay.watch(h.id, request.Peers)
+	case types.RESET:
+		h.relay.unwatch(h.id, request.Peers)
+	case types.GET:
+		if listOnline {
+			online := make([]types.Presence, 0)
+			for _, current := range h.relay.online() {
+				if h.relay.allowed(h.id, current.ID) {
+					online = append(online, current)
+				}
+			}
+			controller.Reply(message, types.PresenceCommandType, online)
+			return nil
+		}
+	default:
+		logger.Warn().Msgf("Unsupported presence action %v", request.Action)
+		return nil
+	}
+
+	result := make([]types.Presence, 0, len(request.Peers))
+	for _, id := range request.Peers {
+		result = append(result, h.relay.presence(id))
+	}
+	controller.Reply(message, types.PresenceCommandType, result)
+	return nil
+}
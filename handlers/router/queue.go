@@ -0,0 +1,191 @@
+package router
+
+import (
+	"time"
+
+	"github.com/gochik/chik"
+	"github.com/gochik/chik/e2e"
+	"github.com/gochik/chik/types"
+	uuid "github.com/gofrs/uuid"
+)
+
+// maxPurgeInterval is the longest time an expired message waits for its report
+const maxPurgeInterval = time.Minute
+
+type queuedMessage struct {
+	message *chik.Message
+	expires time.Time
+	// reported is set when the sender has been told that the message is queued
+	reported bool
+}
+
+// forward sends the message to its receiver, if it is offline the message is queued
+// and the sender gets a delivery report. It returns false if the message cannot be delivered
+func (r *relay) forward(receiver uuid.UUID, message *chik.Message, now time.Time) bool {
+	r.Lock()
+	// the lock orders the check with the flush of the queue when the receiver connects
+	if remote, online := r.peers.Load(receiver); online {
+		if _, pending := r.queues[receiver]; !pending && !r.flushing[receiver] {
+			r.Unlock()
+			remote.(*chik.Controller).PubMessage(message, types.AnyOutgoingCommandType.String())
+			return true
+		}
+		// the queued messages are being delivered, this one follows them
+		r.queues[receiver] = append(r.queues[receiver], queuedMessage{message: message, expires: r.expiry(message, now)})
+		r.Unlock()
+		return true
+	}
+	if r.conf.QueueSize <= 0 || !r.known(receiver) {
+		r.Unlock()
+		return false
+	}
+	queue, exists := r.queues[receiver]
+	if !exists && len(r.queues) >= r.conf.MaxQueues {
+		r.Unlock()
+		logger.Warn().Str("peer", receiver.String()).Msg("Too many queues, dropping the message")
+		r.report(message, types.Dropped)
+		return true
+	}
+	queue = append(queue, queuedMessage{message: message, expires: r.expiry(message, now), reported: true})
+	var dropped *chik.Message
+	if len(queue) > r.conf.QueueSize {
+		dropped = queue[0].message
+		queue = queue[1:]
+	}
+	r.queues[receiver] = queue
+	r.Unlock()
+
+	if dropped != nil {
+		logger.Warn().Str("peer", receiver.String()).Msg("Queue full, dropping the oldest message")
+		r.report(dropped, types.Dropped)
+	}
+	logger.Debug().Str("peer", receiver.String()).Msg("Receiver offline, message queued")
+	r.report(message, types.Queued)
+	return true
+}
+
+// expiry returns when a message queued now expires: sealed messages are refused by their receiver
+// once they are older than e2e.MaxAge, they are dropped before being delivered in vain
+func (r *relay) expiry(message *chik.Message, now time.Time) time.Time {
+	ttl := r.conf.QueueTTL
+	if message.Command().Type == types.EncryptedCommandType && ttl > e2e.MaxAge {
+		ttl = e2e.MaxAge
+	}
+	return now.Add(ttl)
+}
+
+// known tells whether the relay queues messages for the peer: it has been connected within the queue TTL,
+// or it is paired. The caller must hold the lock
+func (r *relay) known(peer uuid.UUID) bool {
+	if _, seen := r.since[peer]; seen {
+		return true
+	}
+	return len(r.pairings[peer]) > 0
+}
+
+// purgeInterval is how often the expired messages are purged
+func (r *relay) purgeInterval() time.Duration {
+	if r.conf.QueueTTL < maxPurgeInterval {
+		return r.conf.QueueTTL
+	}
+	return maxPurgeInterval
+}
+
+// expire removes the expired messages from every queue and reports them to their senders.
+// Every session calls it on its timer, it does nothing if another session did it recently
+func (r *relay) expire(now time.Time) {
+	r.Lock()
+	if now.Sub(r.purged) < r.purgeInterval()/2 {
+		r.Unlock()
+		return
+	}
+	r.purged = now
+	expired := make([]*chik.Message, 0)
+	for receiver, queue := range r.queues {
+		if r.flushing[receiver] {
+			continue
+		}
+		live := queue[:0]
+		for _, current := range queue {
+			if now.After(current.expires) {
+				expired = append(expired, current.message)
+			} else {
+				live = append(live, current)
+			}
+		}
+		if len(live) == 0 {
+			delete(r.queues, receiver)
+		} else {
+			r.queues[receiver] = live
+		}
+	}
+	// offline peers without messages are forgotten after a while
+	for id, since := range r.since {
+		if _, online := r.peers.Load(id); online || now.Sub(since) < r.conf.QueueTTL {
+			continue
+		}
+		if len(r.queues[id]) == 0 && len(r.watchers[id]) == 0 && len(r.pairings[id]) == 0 {
+			delete(r.since, id)
+		}
+	}
+	r.Unlock()
+
+	for _, current := range expired {
+		r.report(current, types.Expired)
+	}
+}
+
+// flush delivers the messages queued for a peer that just connected through remote.
+// The messages forwarded meanwhile are queued after them, to keep the order
+func (r *relay) flush(peer uuid.UUID, remote *chik.Controller, now time.Time) {
+	total := 0
+	for {
+		r.Lock()
+		queue := r.queues[peer]
+		delete(r.queues, peer)
+		if len(queue) == 0 {
+			delete(r.flushing, peer)
+			r.Unlock()
+			break
+		}
+		r.flushing[peer] = true
+		states := make([]string, len(queue))
+		for i, current := range queue {
+			switch {
+			case now.After(current.expires):
+				states[i] = types.Expired
+			// the pairing may have been revoked in the meantime
+			case !r.reachable(current.message.SenderUUID(), peer):
+				states[i] = types.Dropped
+			default:
+				states[i] = types.Delivered
+			}
+		}
+		r.Unlock()
+
+		for i, current := range queue {
+			if states[i] == types.Delivered {
+				remote.PubMessage(current.message, types.AnyOutgoingCommandType.String())
+			}
+			if current.reported {
+				r.report(current.message, states[i])
+			}
+		}
+		total += len(queue)
+	}
+	if total > 0 {
+		logger.Info().Str("peer", peer.String()).Msgf("Flushed %d queued messages", total)
+	}
+}
+
+// report tells the sender of a queued message what happened to it
+func (r *relay) report(message *chik.Message, state string) {
+	receiver, _ := message.ReceiverUUID()
+	r.notify(message.SenderUUID(), types.NewCommand(types.DeliveryReportCommandType, types.DeliveryReport{
+		Receiver:  receiver,
+		Type:      message.Command().Type,
+		MessageID: message.MessageID(),
+		RequestID: message.RequestID(),
+		State:     state,
+	}))
+}
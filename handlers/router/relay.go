@@ -0,0 +1,167 @@
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gochik/chik"
+	"github.com/gochik/chik/config"
+	"github.com/gochik/chik/e2e"
+	"github.com/gochik/chik/types"
+	uuid "github.com/gofrs/uuid"
+	"github.com/mitchellh/mapstructure"
+)
+
+// DefaultQueueTTL is how long a queued message waits for its receiver when the config sets no queue_ttl,
+// sealed messages never wait longer since their receiver refuses them afterwards (see e2e.MaxAge)
+const DefaultQueueTTL = e2e.MaxAge
+
+// DefaultMaxQueues is how many offline receivers can have queued messages when the config sets no max_queues
+const DefaultMaxQueues = 1000
+
+const routerConfigKey = "router"
+
+// Session policies: which session wins when a peer connects again while its previous session is still open
+const (
+	NewestSession = "newest"
+	OldestSession = "oldest"
+)
+
+type routerConfig struct {
+	// RequirePairing restricts messages and presence to paired peers
+	RequirePairing bool `json:"require_pairing" mapstructure:"require_pairing"`
+	// QueueSize is how many messages are kept for each offline receiver, 0 drops them
+	QueueSize int `json:"queue_size" mapstructure:"queue_size"`
+	// QueueTTL is how long a queued message is kept, eg: "30s"
+	QueueTTL time.Duration `json:"queue_ttl" mapstructure:"queue_ttl"`
+	// MaxQueues is how many offline receivers can have queued messages at the same time
+	MaxQueues int `json:"max_queues" mapstructure:"max_queues"`
+	// SessionPolicy is NewestSession (the default) or OldestSession, that is also applied to the sessions
+	// of peers not authenticated (see chik.Controller.Authenticated)
+	SessionPolicy string `json:"session_policy" mapstructure:"session_policy"`
+}
+
+// relay is the state shared by the routers of every session of a relay
+type relay struct {
+	sync.Mutex
+	peers *sync.Map
+	// sessions is how many routers are running on the relay, guarded by relays
+	sessions int
+	// since is when each peer has been connected or disconnected the last time
+	since map[uuid.UUID]time.Time
+	// watchers are the peers subscribed to the presence of each peer, watching is the reverse index
+	watchers map[uuid.UUID]map[uuid.UUID]struct{}
+	watching map[uuid.UUID]map[uuid.UUID]struct{}
+
+	conf  routerConfig
+	codes map[string]pairingCode
+	// pairings maps each peer to its paired peers and their public keys
+	pairings map[uuid.UUID]map[uuid.UUID]string
+	// queues keep the messages for the offline receivers
+	queues map[uuid.UUID][]queuedMessage
+	// flushing are the peers whose queue is being delivered, purged is when the queues were last purged
+	flushing map[uuid.UUID]bool
+	purged   time.Time
+}
+
+// relays maps the peers map shared by the sessions to their relay state
+var relays = struct {
+	sync.Mutex
+	byPeers map[*sync.Map]*relay
+}{byPeers: make(map[*sync.Map]*relay)}
+
+// acquireRelay returns the relay state of the sessions sharing the peers map, each call is paired with releaseRelay
+func acquireRelay(peers *sync.Map) *relay {
+	relays.Lock()
+	defer relays.Unlock()
+	r, ok := relays.byPeers[peers]
+	if !ok {
+		r = &relay{
+			peers:    peers,
+			since:    make(map[uuid.UUID]time.Time),
+			watchers: make(map[uuid.UUID]map[uuid.UUID]struct{}),
+			watching: make(map[uuid.UUID]map[uuid.UUID]struct{}),
+			codes:    make(map[string]pairingCode),
+			pairings: make(map[uuid.UUID]map[uuid.UUID]string),
+			queues:   make(map[uuid.UUID][]queuedMessage),
+			flushing: make(map[uuid.UUID]bool),
+		}
+		r.loadConfig()
+		r.loadPairings()
+		relays.byPeers[peers] = r
+	}
+	r.sessions++
+	return r
+}
+
+// releaseRelay drops the relay state once no session runs on it and it keeps nothing,
+// the pairings are saved in the config and loaded again by the next session
+func releaseRelay(r *relay) {
+	relays.Lock()
+	defer relays.Unlock()
+	r.sessions--
+	if r.sessions > 0 {
+		return
+	}
+	r.Lock()
+	idle := len(r.since) == 0 && len(r.watchers) == 0 && len(r.codes) == 0 && len(r.queues) == 0
+	r.Unlock()
+	if idle {
+		delete(relays.byPeers, r.peers)
+	}
+}
+
+func (r *relay) loadConfig() {
+	config.GetStruct(routerConfigKey, &r.conf, mapstructure.StringToTimeDurationHookFunc())
+	if r.conf.QueueTTL <= 0 {
+		r.conf.QueueTTL = DefaultQueueTTL
+	}
+	if r.conf.MaxQueues <= 0 {
+		r.conf.MaxQueues = DefaultMaxQueues
+	}
+	switch r.conf.SessionPolicy {
+	case NewestSession, OldestSession:
+	default:
+		if r.conf.SessionPolicy != "" {
+			logger.Warn().Msgf("Unknown session policy %q, using %q", r.conf.SessionPolicy, NewestSession)
+		}
+		r.conf.SessionPolicy = NewestSession
+	}
+}
+
+// register stores the session controller of a peer. If the peer is already connected the session policy
+// decides whether the new session replaces the previous one, which is stopped, or it is rejected.
+// Only a session authenticated as the peer can replace another one, anyone could claim its id.
+// When pairing is required only authenticated sessions are registered, otherwise anyone could claim
+// the id of an offline peer and get its pairings
+func (r *relay) register(peer uuid.UUID, controller *chik.Controller) bool {
+	if r.conf.RequirePairing && !controller.Authenticated(peer) {
+		logger.Warn().Str("peer", peer.String()).Msg("Session not authenticated, pairing requires it")
+		return false
+	}
+	for {
+		previous, loaded := r.peers.LoadOrStore(peer, controller)
+		if !loaded {
+			return true
+		}
+		if r.conf.SessionPolicy == OldestSession {
+			return false
+		}
+		if !controller.Authenticated(peer) {
+			logger.Warn().Str("peer", peer.String()).Msg("Session not authenticated, it cannot take over the running one")
+			return false
+		}
+		if r.peers.CompareAndSwap(peer, previous, controller) {
+			logger.Info().Str("peer", peer.String()).Msg("Session taken over, stopping the previous one")
+			previous.(*chik.Controller).Pub(types.NewCommand(types.RemoteStopCommandType, nil), peer)
+			return true
+		}
+	}
+}
+
+// notify sends a command to a peer if it is connected
+func (r *relay) notify(peer uuid.UUID, command *types.Command) {
+	if remote, ok := r.peers.Load(peer); ok {
+		remote.(*chik.Controller).Pub(command, peer)
+	}
+}
@@ -1,9 +1,28 @@
+// Package router forwards the messages between the peers connected to a relay (see chik.Server).
+//
+// Requests sent to the relay itself:
+//   - PresenceRequestCommandType subscribes to (SET), unsubscribes from (RESET) or queries (GET) the presence
+//     of the given peers, a GET without peers lists the online ones. Replies and notifications are
+//     PresenceCommandType lists, subscriptions last until the subscriber disconnects.
+//   - PairingRequestCommandType with SET and no code returns a one-time code valid for 10 minutes,
+//     the other peer sends it back with SET to pair, and both get the public key of the other
+//     (see the e2e package to bind the keys to the code). GET with a code returns its creator,
+//     GET without one lists the paired peers and RESET revokes a pairing. Pairings are stored in the "pairings" config key.
+//
+// The "router" config key sets:
+//   - require_pairing: only paired peers exchange messages and see each other presence, and only
+//     authenticated sessions (see chik.Controller.Authenticated) are registered
+//   - queue_size, queue_ttl and max_queues: messages for offline peers, paired or connected within the queue_ttl,
+//     are queued and their senders get a DeliveryReportCommandType for each of them (see DefaultQueueTTL)
+//   - session_policy: whether a peer connecting again replaces its running session (NewestSession),
+//     provided that it is authenticated, or it is rejected (OldestSession)
 package router
 
 import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/gochik/chik"
 	"github.com/gochik/chik/types"
@@ -15,10 +34,14 @@ var logger = log.With().Str("handler", "router").Logger()
 
 type forwarding struct {
 	chik.BaseHandler
-	id    uuid.UUID
-	peers *sync.Map
+	id         uuid.UUID
+	peers      *sync.Map
+	relay      *relay
+	controller *chik.Controller
 }
 
+// New creates a router for a relay session, the routers of every session share the peers map
+// and through it the state of the relay (eg: the presence subscriptions)
 func New(peers *sync.Map) chik.Handler {
 	return &forwarding{
 		id:    uuid.Nil,
@@ -30,6 +53,19 @@ func (h *forwarding) Topics() []types.CommandType {
 	return []types.CommandType{types.AnyIncomingCommandType}
 }
 
+func (h *forwarding) Setup(controller *chik.Controller) (chik.Interrupts, error) {
+	h.relay = acquireRelay(h.peers)
+	if h.relay.conf.QueueSize <= 0 {
+		return chik.Interrupts{Timer: chik.NewEmptyTimer()}, nil
+	}
+	return chik.Interrupts{Timer: chik.NewTimer(h.relay.purgeInterval(), false)}, nil
+}
+
+func (h *forwarding) HandleTimerEvent(name string, tick time.Time, controller *chik.Controller) error {
+	h.relay.expire(tick)
+	return nil
+}
+
 func (h *forwarding) HandleMessage(message *chik.Message, controller *chik.Controller) error {
 	logger.Debug().Msg("Received a message to route")
 	sender := message.SenderUUID()
@@ -40,18 +76,23 @@ func (h *forwarding) HandleMessage(message *chik.Message, controller *chik.Contr
 	}
 
 	if h.id == uuid.Nil {
-		_, loaded := h.peers.LoadOrStore(sender, controller)
-		if loaded {
+		if !h.relay.register(sender, controller) {
 			logger.Warn().Msgf("Peer %v is already running. dropping this connection", sender)
 			controller.Pub(types.NewCommand(types.RemoteStopCommandType, nil), sender)
 			return errors.New("Cannot allocate an already existing peer")
 		}
 		logger.Debug().Msgf("Adding peer %v", sender)
 		h.id = sender
+		h.controller = controller
+		h.relay.changed(sender, true, controller.Now())
+		h.relay.flush(sender, controller, controller.Now())
 	} else if h.id != sender {
 		err := fmt.Errorf("Unexpected sender, expecting: %v got: %v", h.id, sender)
 		logger.Err(err).Msg("handle failed")
 		return err
+	} else if current, _ := h.peers.Load(sender); current != controller {
+		logger.Debug().Msgf("Session of %v replaced, dropping the message", sender)
+		return nil
 	}
 
 	receiver, err := message.ReceiverUUID()
@@ -60,6 +101,15 @@ func (h *forwarding) HandleMessage(message *chik.Message, controller *chik.Contr
 		return nil
 	}
 
+	if receiver == uuid.Nil || receiver == controller.ID {
+		switch message.Command().Type {
+		case types.PresenceRequestCommandType:
+			return h.handlePresence(message, controller)
+		case types.PairingRequestCommandType:
+			return h.handlePairing(message, controller)
+		}
+	}
+
 	switch receiver {
 	case uuid.Nil:
 		logger.Warn().Msg("No receiver specified")
@@ -70,22 +120,28 @@ func (h *forwarding) HandleMessage(message *chik.Message, controller *chik.Contr
 		return nil
 
 	default:
+		if !h.relay.allowed(sender, receiver) {
+			replyError(message, controller, fmt.Errorf("not paired with %v", receiver))
+			return nil
+		}
 		logger.Info().Msgf("Forwarding a message to: %v", receiver)
 
-		receiverRemote, _ := h.peers.Load(receiver)
-		if receiverRemote == nil {
+		if !h.relay.forward(receiver, message, controller.Now()) {
 			logger.Error().Msgf("Peer disconnected: %v", receiver)
-			return nil
 		}
-
-		receiverRemote.(*chik.Controller).PubMessage(message, types.AnyOutgoingCommandType.String())
 	}
 	return nil
 }
 
 func (h *forwarding) Teardown() {
 	logger.Info().Msgf("Disconnecting peer: %v", h.id)
-	h.peers.Delete(h.id)
+	// a session replaced by a newer one leaves the peer online
+	if h.id != uuid.Nil && h.peers.CompareAndDelete(h.id, h.controller) {
+		h.relay.unwatchAll(h.id)
+		h.relay.changed(h.id, false, h.controller.Now())
+	}
+	h.id = uuid.Nil
+	releaseRelay(h.relay)
 }
 
 func (h *forwarding) String() string {
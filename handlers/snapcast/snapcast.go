@@ -37,6 +37,12 @@ type snapcast struct {
 	events chan interface{}
 }
 
+func init() {
+	chik.RegisterHandler("snapcast", func() (chik.Handler, error) {
+		return New(), nil
+	})
+}
+
 func New() chik.Handler {
 	return &snapcast{
 		status: chik.NewStatusHolder("snapcast"),
@@ -148,7 +154,7 @@ func (h *snapcast) snapcastRequest(controller *chik.Controller, method string, p
 	return
 }
 
-func (h *snapcast) HandleTimerEvent(tick time.Time, controller *chik.Controller) (err error) {
+func (h *snapcast) HandleTimerEvent(name string, tick time.Time, controller *chik.Controller) (err error) {
 	if h.client == nil || !h.isServerAlive(controller) {
 		h.connect(controller)
 	}
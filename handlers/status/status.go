@@ -31,6 +31,12 @@ type StatusCommand struct {
 	Value  interface{}  `json:",omitempty"`
 }
 
+func init() {
+	chik.RegisterHandler("status", func() (chik.Handler, error) {
+		return New(), nil
+	})
+}
+
 // New creates a new status handler
 func New() chik.Handler {
 	return &handler{
@@ -80,7 +86,7 @@ func (h *handler) HandleMessage(message *chik.Message, remote *chik.Controller)
 				current.listeners = make(map[string]set, 1)
 			}
 			current.listeners[content.Query] = set{}
-			current.lastConact = time.Now()
+			current.lastConact = remote.Now()
 			h.subscribers[message.SenderUUID()] = current
 		}
 
@@ -100,7 +106,7 @@ func (h *handler) HandleMessage(message *chik.Message, remote *chik.Controller)
 		for k, v := range status {
 			h.currentStatus[k] = v
 			for id, data := range h.subscribers {
-				if time.Now().Sub(data.lastConact) > 10*time.Minute {
+				if remote.Now().Sub(data.lastConact) > 10*time.Minute {
 					inactiveSubscribers = append(inactiveSubscribers, id)
 				}
 				_, exists := data.listeners[k]
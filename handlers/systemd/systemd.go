@@ -36,6 +36,12 @@ type Systemd struct {
 	connection *dbus.Conn
 }
 
+func init() {
+	chik.RegisterHandler("systemd", func() (chik.Handler, error) {
+		return New(), nil
+	})
+}
+
 // New creates a telegram handler. useful for sending notifications about events
 func New() *Systemd {
 	return &Systemd{}
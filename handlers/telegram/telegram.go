@@ -41,16 +41,34 @@ type Telegram struct {
 	notifications    chan interface{}
 }
 
+func init() {
+	chik.RegisterHandler("telegram", func() (chik.Handler, error) {
+		t, err := create()
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	})
+}
+
 // New creates a telegram handler. useful for sending notifications about events
 func New() *Telegram {
+	t, err := create()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Creation failed")
+	}
+	return t
+}
+
+func create() (*Telegram, error) {
 	var t Telegram
 	err := config.GetStruct("telegram", &t)
 	if err != nil {
-		logger.Fatal().Err(err).Msg("Creation failed")
+		return nil, fmt.Errorf("cannot read telegram config: %w", err)
 	}
 	logger.Debug().Msgf("Telegram stuff: %v", t)
 	t.notifications = make(chan interface{}, 5)
-	return &t
+	return &t, nil
 }
 
 func (h *Telegram) Topics() []types.CommandType {
@@ -172,7 +190,7 @@ func (h *Telegram) HandleMessage(message *chik.Message, controller *chik.Control
 	return h.sendMessage(notification.Message)
 }
 
-func (h *Telegram) HandleTimerEvent(tick time.Time, controller *chik.Controller) error {
+func (h *Telegram) HandleTimerEvent(name string, tick time.Time, controller *chik.Controller) error {
 	return h.startBot()
 }
 
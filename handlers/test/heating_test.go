@@ -0,0 +1,56 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gochik/chik"
+	"github.com/gochik/chik/chiktest"
+	"github.com/gochik/chik/config"
+	"github.com/gochik/chik/handlers/heating"
+	"github.com/gochik/chik/handlers/io/bus"
+	"github.com/gochik/chik/handlers/status"
+	"github.com/gochik/chik/types"
+)
+
+func isDigitalCommand(action types.Action, appliance string) func(*chik.Message) bool {
+	return func(message *chik.Message) bool {
+		payload, err := message.Command().Payload()
+		if err != nil || message.Command().Type != types.DigitalCommandType {
+			return false
+		}
+		command := payload.(types.DigitalCommand)
+		return command.Action == action && command.ApplianceID == appliance
+	}
+}
+
+func TestHeatingMinimumRunningTime(t *testing.T) {
+	config.Set("heating", map[string]interface{}{
+		"threshold": 0.5,
+		"rooms": []map[string]interface{}{{
+			"id":                     "living",
+			"current_temperature_id": "temperature",
+			"target_temperature_id":  "target",
+			"thermal_valve_id":       "valve",
+		}},
+	})
+	io := chiktest.NewIO(
+		chiktest.Device{ID: "temperature", Kind: bus.AnalogInputDevice, Value: 18.0},
+		chiktest.Device{ID: "target", Kind: bus.AnalogOutputDevice, Value: 20.0},
+		chiktest.Device{ID: "valve", Kind: bus.DigitalOutputDevice, Value: false},
+	)
+	harness := chiktest.New(t, status.New(), io, heating.New())
+
+	harness.ExpectFunc(isDigitalCommand(types.SET, "valve"))
+	harness.Settle(50 * time.Millisecond)
+
+	// the room is warm, but the valve has been opened for less than the minimum running time
+	harness.Advance(30 * time.Minute)
+	io.Set("temperature", 21.0)
+	harness.Settle(50 * time.Millisecond)
+	harness.ExpectNone(isDigitalCommand(types.RESET, "valve"), 0)
+
+	harness.Advance(2 * time.Hour)
+	io.Set("temperature", 21.5)
+	harness.ExpectFunc(isDigitalCommand(types.RESET, "valve"))
+}
@@ -0,0 +1,217 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gochik/chik"
+	"github.com/gochik/chik/config"
+	"github.com/gochik/chik/e2e"
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+)
+
+func requestPairing(t *testing.T, relay testRelay, client TestClient, request types.PairingRequest) (types.Pairing, *types.ErrorReply) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	reply, err := client.remote.Request(ctx, types.NewCommand(types.PairingRequestCommandType, request), relay.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Command().Type == types.ErrorReplyCommandType {
+		var refused types.ErrorReply
+		json.Unmarshal(reply.Command().Data, &refused)
+		return types.Pairing{}, &refused
+	}
+	var pairing types.Pairing
+	if err := json.Unmarshal(reply.Command().Data, &pairing); err != nil {
+		t.Fatal(err)
+	}
+	return pairing, nil
+}
+
+func expectPairing(t *testing.T, notifications chan interface{}) types.Pairing {
+	t.Helper()
+	select {
+	case data := <-notifications:
+		var pairing types.Pairing
+		json.Unmarshal(data.(*chik.Message).Command().Data, &pairing)
+		return pairing
+	case <-time.After(time.Second):
+		t.Fatal("Pairing not notified")
+	}
+	return types.Pairing{}
+}
+
+// expectDelivery sends a digital command from sender to receiver and checks whether it is delivered
+func expectDelivery(t *testing.T, sender TestClient, receiver TestClient, delivered bool) {
+	t.Helper()
+	commands := receiver.remote.Sub(types.DigitalCommandType.String())
+	defer receiver.remote.Unsub(commands)
+	sender.remote.Pub(types.NewCommand(types.DigitalCommandType, types.DigitalCommand{Action: types.TOGGLE, ApplianceID: "light"}), receiver.id)
+	select {
+	case <-commands:
+		if !delivered {
+			t.Fatal("Message delivered to an unpaired peer")
+		}
+	case <-time.After(200 * time.Millisecond):
+		if delivered {
+			t.Fatal("Message to a paired peer not delivered")
+		}
+	}
+}
+
+func TestPairing(t *testing.T) {
+	config.Set("router", map[string]interface{}{"require_pairing": true})
+	t.Cleanup(func() {
+		config.Set("router", nil)
+		config.Set("pairings", nil)
+	})
+	relay := startRelay(t, authenticated)
+	house := connect(t, relay)
+	phone := connect(t, relay)
+	stranger := connect(t, relay)
+
+	expectDelivery(t, phone, house, false)
+
+	created, refused := requestPairing(t, relay, house, types.PairingRequest{Action: types.SET, PublicKey: "house key"})
+	if refused != nil || created.Code == "" || created.Expires.IsZero() {
+		t.Fatalf("Pairing code not created: %+v %+v", created, refused)
+	}
+
+	houseNotifications := house.remote.Sub(types.PairingCommandType.String())
+	paired, refused := requestPairing(t, relay, phone, types.PairingRequest{Action: types.SET, Code: created.Code, PublicKey: "phone key"})
+	if refused != nil || len(paired.Paired) != 1 || paired.Paired[0].ID != house.id || paired.Paired[0].PublicKey != "house key" {
+		t.Fatalf("Unexpected pairing: %+v %+v", paired, refused)
+	}
+	if notified := expectPairing(t, houseNotifications); len(notified.Paired) != 1 || notified.Paired[0].ID != phone.id || notified.Paired[0].PublicKey != "phone key" {
+		t.Fatalf("Unexpected pairing notification: %+v", notified)
+	}
+
+	// codes can be used only once
+	if _, refused := requestPairing(t, relay, stranger, types.PairingRequest{Action: types.SET, Code: created.Code}); refused == nil {
+		t.Fatal("Pairing code used twice")
+	}
+
+	expectDelivery(t, phone, house, true)
+	expectDelivery(t, house, phone, true)
+	expectDelivery(t, stranger, house, false)
+
+	online := map[uuid.UUID]bool{}
+	for _, current := range requestPresence(t, relay, phone, types.PresenceRequest{Action: types.GET}) {
+		online[current.ID] = current.Online
+	}
+	if !online[house.id] || online[stranger.id] {
+		t.Fatalf("Unexpected online peers: %v", online)
+	}
+
+	listed, _ := requestPairing(t, relay, phone, types.PairingRequest{Action: types.GET})
+	if len(listed.Paired) != 1 || listed.Paired[0].ID != house.id {
+		t.Fatalf("Unexpected pairings: %+v", listed)
+	}
+
+	revoked, refused := requestPairing(t, relay, phone, types.PairingRequest{Action: types.RESET, Peer: house.id})
+	if refused != nil || len(revoked.Revoked) != 1 || revoked.Revoked[0] != house.id {
+		t.Fatalf("Pairing not revoked: %+v %+v", revoked, refused)
+	}
+	if notified := expectPairing(t, houseNotifications); len(notified.Revoked) != 1 || notified.Revoked[0] != phone.id {
+		t.Fatalf("Unexpected revocation notification: %+v", notified)
+	}
+	expectDelivery(t, phone, house, false)
+}
+
+func TestUnauthenticatedRegistration(t *testing.T) {
+	config.Set("router", map[string]interface{}{"require_pairing": true})
+	t.Cleanup(func() {
+		config.Set("router", nil)
+		config.Set("pairings", nil)
+	})
+	var trusted atomic.Bool
+	trusted.Store(true)
+	relay := startRelay(t, func(relay *chik.Server) {
+		relay.Authenticate = func(transport chik.Transport, peer uuid.UUID) bool { return trusted.Load() }
+	})
+	house := connect(t, relay)
+	controller := chik.NewControllerWithID(uuid.Must(uuid.NewV4()))
+	_, disconnect := register(t, relay, controller)
+	phone := TestClient{controller, controller.ID}
+	created, _ := requestPairing(t, relay, house, types.PairingRequest{Action: types.SET})
+	if _, refused := requestPairing(t, relay, phone, types.PairingRequest{Action: types.SET, Code: created.Code}); refused != nil {
+		t.Fatalf("Pairing refused: %+v", refused)
+	}
+	disconnect()
+	waitFor(t, func() bool {
+		_, ok := relay.Peers().Load(phone.id)
+		return !ok
+	})
+
+	// anyone could claim the id of the offline phone and inherit its pairings
+	trusted.Store(false)
+	impostor := chik.NewControllerWithID(phone.id)
+	conn, err := net.Dial("tcp", relay.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteCtx, cancel := chik.StartRemote(impostor, conn, 10*time.Second)
+	t.Cleanup(cancel)
+	impostor.Pub(types.NewCommand(types.HeartbeatType, nil), relay.ID)
+	expectStopped(t, remoteCtx, true)
+	if _, ok := relay.Peers().Load(phone.id); ok {
+		t.Fatal("Unauthenticated session registered")
+	}
+}
+
+func TestPairingKeys(t *testing.T) {
+	t.Cleanup(func() { config.Set("pairings", nil) })
+	relay := startRelay(t)
+	house := connect(t, relay)
+	phone := connect(t, relay)
+	houseCipher := newCipher(t, house.id)
+	phoneCipher := newCipher(t, phone.id)
+
+	created, _ := requestPairing(t, relay, house, types.PairingRequest{Action: types.SET, PublicKey: houseCipher.PublicKey().String()})
+	shown, err := houseCipher.NewPairingCode(created.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the relay never gets the secret part of the code
+	code, err := e2e.ParsePairingCode(shown)
+	if err != nil || code.Relay != created.Code {
+		t.Fatalf("Unexpected code %v: %+v %v", shown, code, err)
+	}
+	creator, refused := requestPairing(t, relay, phone, types.PairingRequest{Action: types.GET, Code: code.Relay})
+	if refused != nil || len(creator.Paired) != 1 {
+		t.Fatalf("Creator not found: %+v %+v", creator, refused)
+	}
+	proof, err := phoneCipher.RedeemPairing(code, creator.Paired[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	houseNotifications := house.remote.Sub(types.PairingCommandType.String())
+	request := types.PairingRequest{Action: types.SET, Code: code.Relay, PublicKey: phoneCipher.PublicKey().String(), Proof: proof}
+	if _, refused := requestPairing(t, relay, phone, request); refused != nil {
+		t.Fatalf("Pairing refused: %+v", refused)
+	}
+	if err := houseCipher.ApplyPairing(expectPairing(t, houseNotifications)); err != nil {
+		t.Fatal(err)
+	}
+	if key, ok := houseCipher.PeerKey(phone.id); !ok || key != phoneCipher.PublicKey() {
+		t.Fatal("Key of the phone not set")
+	}
+}
+
+func newCipher(t *testing.T, id uuid.UUID) *e2e.Cipher {
+	t.Helper()
+	public, private, err := e2e.GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e2e.New(id, public, private)
+}
@@ -0,0 +1,132 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gochik/chik"
+	"github.com/gochik/chik/handlers/router"
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+)
+
+type testRelay struct {
+	*chik.Server
+	address string
+}
+
+// startRelay starts a relay server running the router, its sessions share the relay identity
+func startRelay(t *testing.T, options ...func(relay *chik.Server)) testRelay {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := chik.NewServer(uuid.Must(uuid.NewV4()), func(peers *sync.Map) []chik.Handler {
+		return []chik.Handler{router.New(peers)}
+	})
+	for _, option := range options {
+		option(relay)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go relay.Serve(ctx, listener)
+	return testRelay{relay, listener.Addr().String()}
+}
+
+// connect connects a new peer to the relay and registers it sending an heartbeat
+func connect(t *testing.T, relay testRelay) TestClient {
+	t.Helper()
+	controller := chik.NewControllerWithID(uuid.Must(uuid.NewV4()))
+	register(t, relay, controller)
+	return TestClient{controller, controller.ID}
+}
+
+// register connects the controller to the relay and waits for its registration,
+// it returns the context of the remote and the function disconnecting it
+func register(t *testing.T, relay testRelay, controller *chik.Controller) (context.Context, context.CancelFunc) {
+	t.Helper()
+	conn, err := net.Dial("tcp", relay.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteCtx, cancel := chik.StartRemote(controller, conn, 10*time.Second)
+	t.Cleanup(cancel)
+	controller.Pub(types.NewCommand(types.HeartbeatType, nil), relay.ID)
+	waitFor(t, func() bool {
+		_, ok := relay.Peers().Load(controller.ID)
+		return ok || remoteCtx.Err() != nil
+	})
+	if remoteCtx.Err() != nil {
+		t.Fatal("Peer not registered")
+	}
+	return remoteCtx, cancel
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func requestPresence(t *testing.T, relay testRelay, client TestClient, request types.PresenceRequest) []types.Presence {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	reply, err := client.remote.Request(ctx, types.NewCommand(types.PresenceRequestCommandType, request), relay.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result []types.Presence
+	if err := json.Unmarshal(reply.Command().Data, &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestPresence(t *testing.T) {
+	relay := startRelay(t)
+	house := connect(t, relay)
+	phone := connect(t, relay)
+
+	presence := requestPresence(t, relay, phone, types.PresenceRequest{Action: types.SET, Peers: []uuid.UUID{house.id}})
+	if len(presence) != 1 || presence[0].ID != house.id || !presence[0].Online || presence[0].Since.IsZero() {
+		t.Fatalf("Unexpected presence: %+v", presence)
+	}
+
+	online := map[uuid.UUID]bool{}
+	for _, current := range requestPresence(t, relay, phone, types.PresenceRequest{Action: types.GET}) {
+		online[current.ID] = current.Online
+	}
+	if !online[house.id] || !online[phone.id] {
+		t.Fatalf("Online peers not listed: %v", online)
+	}
+
+	notifications := phone.remote.Sub(types.PresenceCommandType.String())
+	disconnectedAt := time.Now()
+	house.remote.Pub(types.NewCommand(types.RemoteStopCommandType, nil), chik.LoopbackID)
+	select {
+	case data := <-notifications:
+		var changes []types.Presence
+		json.Unmarshal(data.(*chik.Message).Command().Data, &changes)
+		if len(changes) != 1 || changes[0].ID != house.id || changes[0].Online || changes[0].Since.Before(disconnectedAt.Add(-time.Second)) {
+			t.Fatalf("Unexpected notification: %+v", changes)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Presence change not notified")
+	}
+
+	presence = requestPresence(t, relay, phone, types.PresenceRequest{Action: types.GET, Peers: []uuid.UUID{house.id}})
+	if len(presence) != 1 || presence[0].Online {
+		t.Fatalf("Unexpected presence after disconnection: %+v", presence)
+	}
+}
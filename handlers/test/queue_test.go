@@ -0,0 +1,173 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gochik/chik"
+	"github.com/gochik/chik/chiktest"
+	"github.com/gochik/chik/config"
+	"github.com/gochik/chik/e2e"
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+)
+
+func expectReports(t *testing.T, reports chan interface{}, states ...string) {
+	t.Helper()
+	for _, state := range states {
+		select {
+		case data := <-reports:
+			var report types.DeliveryReport
+			json.Unmarshal(data.(*chik.Message).Command().Data, &report)
+			if report.State != state || report.Type != types.DigitalCommandType {
+				t.Fatalf("Unexpected report %+v, expecting %v", report, state)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Report %v not received", state)
+		}
+	}
+}
+
+func TestStoreAndForward(t *testing.T) {
+	config.Set("router", map[string]interface{}{"queue_size": 2, "queue_ttl": "500ms"})
+	t.Cleanup(func() { config.Set("router", nil) })
+	relay := startRelay(t)
+	phone := connect(t, relay)
+	reports := phone.remote.Sub(types.DeliveryReportCommandType.String())
+
+	house := chik.NewControllerWithID(uuid.Must(uuid.NewV4()))
+	_, disconnect := register(t, relay, house)
+	disconnect()
+	waitFor(t, func() bool {
+		_, ok := relay.Peers().Load(house.ID)
+		return !ok
+	})
+
+	for _, appliance := range []string{"first", "second", "third"} {
+		phone.remote.Pub(types.NewCommand(types.DigitalCommandType, types.DigitalCommand{Action: types.TOGGLE, ApplianceID: appliance}), house.ID)
+	}
+	// the queue keeps the newest two messages
+	expectReports(t, reports, types.Queued, types.Queued, types.Dropped, types.Queued)
+
+	house = chik.NewControllerWithID(house.ID)
+	commands := house.Sub(types.DigitalCommandType.String())
+	_, disconnect = register(t, relay, house)
+	for _, expected := range []string{"second", "third"} {
+		select {
+		case data := <-commands:
+			var command types.DigitalCommand
+			json.Unmarshal(data.(*chik.Message).Command().Data, &command)
+			if command.ApplianceID != expected {
+				t.Fatalf("Unexpected command %+v, expecting %v", command, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Queued command not delivered")
+		}
+	}
+	expectReports(t, reports, types.Delivered, types.Delivered)
+
+	disconnect()
+	waitFor(t, func() bool {
+		_, ok := relay.Peers().Load(house.ID)
+		return !ok
+	})
+	phone.remote.Pub(types.NewCommand(types.DigitalCommandType, types.DigitalCommand{Action: types.TOGGLE, ApplianceID: "late"}), house.ID)
+	expectReports(t, reports, types.Queued)
+	// the queues are purged periodically, not only when the receiver comes back
+	expectReports(t, reports, types.Expired)
+
+	house = chik.NewControllerWithID(house.ID)
+	commands = house.Sub(types.DigitalCommandType.String())
+	register(t, relay, house)
+	select {
+	case data := <-commands:
+		t.Fatalf("Expired command delivered: %v", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSealedMessagesExpiry(t *testing.T) {
+	config.Set("router", map[string]interface{}{"queue_size": 2, "queue_ttl": "10m"})
+	t.Cleanup(func() { config.Set("router", nil) })
+	clock := chiktest.NewFakeClock(chiktest.Epoch)
+	relay := startRelay(t, func(relay *chik.Server) {
+		relay.Configure = func(controller *chik.Controller) { controller.SetClock(clock) }
+	})
+	phone := connect(t, relay)
+	reports := phone.remote.Sub(types.DeliveryReportCommandType.String())
+
+	house := chik.NewControllerWithID(uuid.Must(uuid.NewV4()))
+	_, disconnect := register(t, relay, house)
+	disconnect()
+	waitFor(t, func() bool {
+		_, ok := relay.Peers().Load(house.ID)
+		return !ok
+	})
+
+	phone.remote.Pub(types.NewCommand(types.EncryptedCommandType, types.EncryptedCommand{Nonce: []byte{1}, Box: []byte{2}}), house.ID)
+	phone.remote.Pub(types.NewCommand(types.DigitalCommandType, types.DigitalCommand{Action: types.TOGGLE, ApplianceID: "light"}), house.ID)
+	expectReport := func(commandType types.CommandType, state string) {
+		t.Helper()
+		select {
+		case data := <-reports:
+			var report types.DeliveryReport
+			json.Unmarshal(data.(*chik.Message).Command().Data, &report)
+			if report.Type != commandType || report.State != state {
+				t.Fatalf("Unexpected report %+v, expecting %v %v", report, commandType, state)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Report %v %v not received", commandType, state)
+		}
+	}
+	expectReport(types.EncryptedCommandType, types.Queued)
+	expectReport(types.DigitalCommandType, types.Queued)
+
+	// the receiver would refuse the sealed message as stale, the plain one waits for the queue_ttl
+	clock.Advance(e2e.MaxAge + time.Minute)
+	house = chik.NewControllerWithID(house.ID)
+	incoming := house.Sub(types.AnyIncomingCommandType.String())
+	register(t, relay, house)
+	expectReport(types.EncryptedCommandType, types.Expired)
+	expectReport(types.DigitalCommandType, types.Delivered)
+	select {
+	case data := <-incoming:
+		if command := data.(*chik.Message).Command(); command.Type != types.DigitalCommandType {
+			t.Fatalf("Unexpected command delivered: %v", command)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Queued command not delivered")
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	config.Set("router", map[string]interface{}{"queue_size": 2, "max_queues": 1})
+	t.Cleanup(func() { config.Set("router", nil) })
+	relay := startRelay(t)
+	phone := connect(t, relay)
+	reports := phone.remote.Sub(types.DeliveryReportCommandType.String())
+
+	// nothing is queued for the peers that have never connected
+	phone.remote.Pub(types.NewCommand(types.DigitalCommandType, types.DigitalCommand{Action: types.TOGGLE, ApplianceID: "unknown"}), uuid.Must(uuid.NewV4()))
+	select {
+	case data := <-reports:
+		t.Fatalf("Unexpected report for an unknown peer: %v", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	houses := make([]uuid.UUID, 0, 2)
+	for i := 0; i < 2; i++ {
+		house := chik.NewControllerWithID(uuid.Must(uuid.NewV4()))
+		_, disconnect := register(t, relay, house)
+		disconnect()
+		waitFor(t, func() bool {
+			_, ok := relay.Peers().Load(house.ID)
+			return !ok
+		})
+		houses = append(houses, house.ID)
+	}
+	phone.remote.Pub(types.NewCommand(types.DigitalCommandType, types.DigitalCommand{Action: types.TOGGLE, ApplianceID: "first"}), houses[0])
+	expectReports(t, reports, types.Queued)
+	phone.remote.Pub(types.NewCommand(types.DigitalCommandType, types.DigitalCommand{Action: types.TOGGLE, ApplianceID: "second"}), houses[1])
+	expectReports(t, reports, types.Dropped)
+}
@@ -0,0 +1,98 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gochik/chik"
+	"github.com/gochik/chik/config"
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+)
+
+func expectStopped(t *testing.T, remoteCtx context.Context, stopped bool) {
+	t.Helper()
+	select {
+	case <-remoteCtx.Done():
+		if !stopped {
+			t.Fatal("Session stopped")
+		}
+	case <-time.After(200 * time.Millisecond):
+		if stopped {
+			t.Fatal("Session not stopped")
+		}
+	}
+}
+
+// authenticated makes every peer authenticated, as if it had a client certificate
+func authenticated(relay *chik.Server) {
+	relay.Authenticate = func(transport chik.Transport, peer uuid.UUID) bool { return true }
+}
+
+func TestSessionTakeover(t *testing.T) {
+	relay := startRelay(t, authenticated)
+	phone := connect(t, relay)
+	presence := phone.remote.Sub(types.PresenceCommandType.String())
+	id := uuid.Must(uuid.NewV4())
+	stale, _ := register(t, relay, chik.NewControllerWithID(id))
+	requestPresence(t, relay, phone, types.PresenceRequest{Action: types.SET, Peers: []uuid.UUID{id}})
+	<-presence
+
+	house := TestClient{chik.NewControllerWithID(id), id}
+	register(t, relay, house.remote)
+	expectStopped(t, stale, true)
+
+	// the new session refreshes the presence, the stale one going away leaves the peer online
+	select {
+	case data := <-presence:
+		var changes []types.Presence
+		json.Unmarshal(data.(*chik.Message).Command().Data, &changes)
+		if len(changes) != 1 || !changes[0].Online {
+			t.Fatalf("Unexpected presence change: %+v", changes)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Reconnection not notified")
+	}
+	select {
+	case data := <-presence:
+		t.Fatalf("Unexpected presence change: %v", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, ok := relay.Peers().Load(id); !ok {
+		t.Fatal("Peer removed by the stale session")
+	}
+	expectDelivery(t, phone, house, true)
+}
+
+func TestUnauthenticatedTakeover(t *testing.T) {
+	relay := startRelay(t)
+	phone := connect(t, relay)
+	house := connect(t, relay)
+	houseCtx, _ := relay.Peers().Load(house.id)
+
+	// anyone can claim the id of a peer, the running session is kept
+	duplicate, _ := register(t, relay, chik.NewControllerWithID(house.id))
+	expectStopped(t, duplicate, true)
+	if current, _ := relay.Peers().Load(house.id); current != houseCtx {
+		t.Fatal("Session taken over without authentication")
+	}
+	expectDelivery(t, phone, house, true)
+}
+
+func TestOldestSessionPolicy(t *testing.T) {
+	config.Set("router", map[string]interface{}{"session_policy": "oldest"})
+	t.Cleanup(func() { config.Set("router", nil) })
+	relay := startRelay(t, authenticated)
+	phone := connect(t, relay)
+	house := connect(t, relay)
+	houseCtx, _ := relay.Peers().Load(house.id)
+
+	duplicate, _ := register(t, relay, chik.NewControllerWithID(house.id))
+	expectStopped(t, duplicate, true)
+	if current, _ := relay.Peers().Load(house.id); current != houseCtx {
+		t.Fatal("Oldest session replaced")
+	}
+	expectDelivery(t, phone, house, true)
+}
@@ -15,9 +15,10 @@ type version struct {
 	Current string
 }
 
-// New creates a version holder
+// New creates a version holder, the version is also advertised to remote peers
 func New(currentVersion string) chik.Handler {
 	logger.Debug().Msgf("Version: %v", currentVersion)
+	chik.SoftwareVersion = currentVersion
 
 	return &version{Current: currentVersion}
 }
@@ -0,0 +1,145 @@
+package chik
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+)
+
+// Protocol version spoken on remote connections: peers with a different major version
+// are refused, a different minor version only affects the optional features
+const (
+	ProtocolMajor = 1
+	ProtocolMinor = 0
+)
+
+// HandshakeTimeout is how long a remote waits for the peer handshake before assuming
+// the peer predates the handshake and talking to it the legacy way
+const HandshakeTimeout = 5 * time.Second
+
+// SoftwareVersion is the version of the application, advertised to peers during the handshake
+var SoftwareVersion = "unknown"
+
+// Handshake is the first message exchanged on a remote connection
+type Handshake struct {
+	ID              uuid.UUID                    `json:"id"`
+	ProtocolMajor   int                          `json:"protocol_major"`
+	ProtocolMinor   int                          `json:"protocol_minor"`
+	SoftwareVersion string                       `json:"software_version"`
+	CommandTypes    map[string]types.CommandType `json:"command_types"`
+	Features        []string                     `json:"features,omitempty"`
+}
+
+// newHandshake describes the local controller
+func newHandshake(controller *Controller) Handshake {
+	commandTypes := make(map[string]types.CommandType)
+	for _, info := range types.CommandTypes() {
+		commandTypes[info.Name] = info.ID
+	}
+	return Handshake{
+		ID:              controller.ID,
+		ProtocolMajor:   ProtocolMajor,
+		ProtocolMinor:   ProtocolMinor,
+		SoftwareVersion: SoftwareVersion,
+		CommandTypes:    commandTypes,
+		Features:        supportedFeatures(),
+	}
+}
+
+// parseHandshake decodes an handshake, false is returned if the message is not one
+func parseHandshake(message *Message) (Handshake, bool) {
+	var handshake Handshake
+	if message.Command().Type != types.HandshakeCommandType {
+		return handshake, false
+	}
+	if err := json.Unmarshal(message.Command().Data, &handshake); err != nil || handshake.ProtocolMajor == 0 {
+		return handshake, false
+	}
+	return handshake, true
+}
+
+// peer is what a remote knows about the other side of the connection.
+// Command types are translated by name between the local and the peer numbering,
+// the types without a name on one side keep their number (eg: custom types routed by a relay)
+// unless the receiving side uses that number for another type, then they are dropped
+type peer struct {
+	sync.RWMutex
+	handshake *Handshake
+	toPeer    map[types.CommandType]types.CommandType
+	fromPeer  map[types.CommandType]types.CommandType
+	// peerTypes are the numbers of every type the peer has a name for
+	peerTypes map[types.CommandType]bool
+	encoding  Encoding
+}
+
+// agree validates the peer handshake and prepares the command types translation
+func (p *peer) agree(handshake Handshake) error {
+	if handshake.ProtocolMajor != ProtocolMajor {
+		return fmt.Errorf("peer %v speaks protocol %d.%d, %d.%d required",
+			handshake.ID, handshake.ProtocolMajor, handshake.ProtocolMinor, ProtocolMajor, ProtocolMinor)
+	}
+	toPeer := make(map[types.CommandType]types.CommandType)
+	fromPeer := make(map[types.CommandType]types.CommandType)
+	peerTypes := make(map[types.CommandType]bool)
+	for name, peerType := range handshake.CommandTypes {
+		peerTypes[peerType] = true
+		if localType, ok := types.CommandTypeByName(name); ok {
+			toPeer[localType] = peerType
+			fromPeer[peerType] = localType
+		}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.handshake = &handshake
+	p.toPeer = toPeer
+	p.fromPeer = fromPeer
+	p.peerTypes = peerTypes
+	p.encoding = negotiateEncoding(handshake.Features)
+	return nil
+}
+
+// Handshake returns the handshake received from the peer, nil for legacy peers
+func (p *peer) Handshake() *Handshake {
+	p.RLock()
+	defer p.RUnlock()
+	return p.handshake
+}
+
+// Encoding returns the encoding of the messages sent to the peer
+func (p *peer) Encoding() Encoding {
+	p.RLock()
+	defer p.RUnlock()
+	return p.encoding
+}
+
+// outgoing translates a command type to the peer numbering, false if the peer uses its number for another type
+func (p *peer) outgoing(commandType types.CommandType) (types.CommandType, bool) {
+	p.RLock()
+	defer p.RUnlock()
+	if p.handshake == nil {
+		return commandType, true
+	}
+	if translated, ok := p.toPeer[commandType]; ok {
+		return translated, true
+	}
+	return commandType, !p.peerTypes[commandType]
+}
+
+// incoming translates a command type from the peer numbering, false if its number is used locally for another type
+func (p *peer) incoming(commandType types.CommandType) (types.CommandType, bool) {
+	p.RLock()
+	defer p.RUnlock()
+	if p.handshake == nil {
+		return commandType, true
+	}
+	if translated, ok := p.fromPeer[commandType]; ok {
+		return translated, true
+	}
+	_, taken := commandType.Info()
+	return commandType, !taken
+}
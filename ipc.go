@@ -0,0 +1,82 @@
+package chik
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ListenUnix serves local clients (eg: chikctl) on a Unix domain socket until ctx is done.
+// Every connection is a remote of the controller using the usual message framing,
+// local remotes have no read timeout and never take the default route
+func (c *Controller) ListenUnix(ctx context.Context, path string) error {
+	listener, err := listenPrivate(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	logger.Info().Str("path", path).Msg("Listening for local clients")
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		remoteCtx, cancel := startRemote(c, NewStreamTransport(conn), 0, true)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-ctx.Done():
+				cancel()
+			case <-remoteCtx.Done():
+			}
+		}()
+	}
+}
+
+// listenPrivate creates the socket inside a private directory and then moves it to path,
+// so that other users cannot connect before its permissions are restricted
+func listenPrivate(path string) (*net.UnixListener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		// left behind by a previous run, replaced below
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".chik-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	private := filepath.Join(dir, "socket")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: private, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the socket is removed from path when the listener stops
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(private, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(private, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
@@ -0,0 +1,78 @@
+package chik
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chik.sock")
+	node := NewControllerWithID(uuid.Must(uuid.NewV4()))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go node.Start(ctx, []Handler{&echoHandler{}})
+	listening := make(chan error)
+	go func() { listening <- node.ListenUnix(ctx, path) }()
+
+	var conn net.Conn
+	waitFor(t, func() bool {
+		var err error
+		conn, err = net.Dial("unix", path)
+		return err == nil
+	})
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Unexpected socket permissions: %v %v", info, err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Fatalf("Private directory left behind: %v", entries)
+	}
+	client := NewControllerWithID(uuid.Must(uuid.NewV4()))
+	incoming := client.Sub(types.AnyIncomingCommandType.String())
+	remoteCtx, remoteCancel := StartRemote(client, conn, 0)
+	defer remoteCancel()
+
+	requestCtx, requestCancel := context.WithTimeout(remoteCtx, time.Second)
+	defer requestCancel()
+	reply, err := client.Request(requestCtx, types.NewCommand(types.VersionRequestCommandType, nil), node.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.SenderUUID() != node.ID {
+		t.Errorf("Unexpected reply sender: %v", reply.SenderUUID())
+	}
+	<-incoming
+
+	// local clients do not take the default route
+	node.Pub(types.NewCommand(types.HeartbeatType, nil), uuid.Must(uuid.NewV4()))
+	select {
+	case data := <-incoming:
+		t.Fatalf("Message for an unknown peer sent to a local client: %v", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case err := <-listening:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Listener not closed")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Socket not removed: %v", err)
+	}
+	select {
+	case <-remoteCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Local client not disconnected")
+	}
+}
@@ -0,0 +1,148 @@
+package journal
+
+import (
+	"context"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gochik/chik"
+)
+
+// settleTime is how long the clock waits for a fired timer to be armed again
+const settleTime = 10 * time.Millisecond
+
+// Clock is the chik.Clock of a replayed controller (see chik.Controller.SetClock and ReplayOptions):
+// Replay moves it to the recorded time of every entry, firing in order the timers expiring meanwhile
+type Clock struct {
+	sync.Mutex
+	now     time.Time
+	timers  []*clockTimer
+	changed chan struct{}
+}
+
+type clockTimer struct {
+	clock    *Clock
+	deadline time.Time
+	c        chan time.Time
+}
+
+// NewClock creates a Clock set at the time of the first entry of the given journal files
+func NewClock(paths ...string) (*Clock, error) {
+	clock := &Clock{changed: make(chan struct{})}
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := NewReader(file).Next()
+		file.Close()
+		if err == nil {
+			clock.now = entry.Time
+			return clock, nil
+		}
+		if err != io.EOF {
+			return nil, err
+		}
+	}
+	return clock, nil
+}
+
+// Now returns the recorded time of the entry being replayed
+func (c *Clock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// NewTimer creates a timer firing when the clock reaches the given duration from now
+func (c *Clock) NewTimer(d time.Duration) chik.ClockTimer {
+	c.Lock()
+	defer c.Unlock()
+	timer := &clockTimer{
+		clock:    c,
+		deadline: c.now.Add(d),
+		c:        make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		timer.c <- c.now
+		return timer
+	}
+	c.timers = append(c.timers, timer)
+	sort.SliceStable(c.timers, func(i, j int) bool {
+		return c.timers[i].deadline.Before(c.timers[j].deadline)
+	})
+	c.notify()
+	return timer
+}
+
+// notify wakes up set waiting for timers to be armed again, the lock must be held
+func (c *Clock) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// moveTo moves the clock to the given time, after giving the handlers the time to handle
+// what happened at the current one
+func (c *Clock) moveTo(ctx context.Context, target time.Time) error {
+	c.Lock()
+	wait := target.After(c.now)
+	c.Unlock()
+	if wait {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(settleTime):
+		}
+	}
+	c.set(target)
+	return nil
+}
+
+// set moves the clock to the given time, the clock never goes back
+func (c *Clock) set(target time.Time) {
+	c.Lock()
+	for {
+		if len(c.timers) == 0 || c.timers[0].deadline.After(target) {
+			if target.After(c.now) {
+				c.now = target
+			}
+			c.Unlock()
+			return
+		}
+		timer := c.timers[0]
+		c.timers = c.timers[1:]
+		if timer.deadline.After(c.now) {
+			c.now = timer.deadline
+		}
+		timer.c <- c.now
+		changed := c.changed
+		c.Unlock()
+
+		// periodic timers are armed again by their handler
+		select {
+		case <-changed:
+		case <-time.After(settleTime):
+		}
+		c.Lock()
+	}
+}
+
+func (t *clockTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *clockTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			t.clock.notify()
+			return true
+		}
+	}
+	return false
+}
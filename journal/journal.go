@@ -0,0 +1,217 @@
+// Package journal records the messages published on a controller and replays them offline.
+//
+// Every journal entry is composed by the publication time, the topics and the message
+// encoded with Message.Bytes:
+//
+//	| int64 unix nano | uint16 topics count | (uint16 length, topic)... | message bytes |
+package journal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gochik/chik"
+	"github.com/rs/zerolog/log"
+)
+
+var logger = log.With().Str("component", "journal").Logger()
+
+// Entry is a recorded message
+type Entry struct {
+	Time    time.Time
+	Topics  []string
+	Message *chik.Message
+}
+
+// Recorder writes entries to a journal file, rotating it when it exceeds the maximum size.
+// Rotated files get a numeric suffix: path.1 is the most recent one, path.<maxFiles-1> the oldest
+type Recorder struct {
+	sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+}
+
+// NewRecorder opens, or creates, the journal at the given path.
+// A maxSize of 0 disables rotation, maxFiles is the number of files kept including the current one
+func NewRecorder(path string, maxSize int64, maxFiles int) (*Recorder, error) {
+	r := &Recorder{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Recorder) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.writer = bufio.NewWriter(file)
+	r.size = info.Size()
+	return nil
+}
+
+func (r *Recorder) rotate() error {
+	if err := r.closeFile(); err != nil {
+		return err
+	}
+	if r.maxFiles > 1 {
+		os.Remove(rotatedPath(r.path, r.maxFiles-1))
+		for i := r.maxFiles - 2; i > 0; i-- {
+			os.Rename(rotatedPath(r.path, i), rotatedPath(r.path, i+1))
+		}
+		if err := os.Rename(r.path, rotatedPath(r.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *Recorder) closeFile() error {
+	if err := r.writer.Flush(); err != nil {
+		return err
+	}
+	return r.file.Close()
+}
+
+func rotatedPath(path string, index int) string {
+	return fmt.Sprintf("%s.%d", path, index)
+}
+
+// Record appends a message to the journal
+func (r *Recorder) Record(at time.Time, message *chik.Message, topics []string) error {
+	data, err := message.Bytes()
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(data)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return fmt.Errorf("journal rotation failed: %w", err)
+		}
+	}
+
+	header := make([]byte, 0, 10)
+	header = binary.BigEndian.AppendUint64(header, uint64(at.UnixNano()))
+	header = binary.BigEndian.AppendUint16(header, uint16(len(topics)))
+	for _, topic := range topics {
+		header = binary.BigEndian.AppendUint16(header, uint16(len(topic)))
+		header = append(header, topic...)
+	}
+	for _, chunk := range [][]byte{header, data} {
+		n, err := r.writer.Write(chunk)
+		r.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	// entries are flushed right away so that nothing is lost on crashes
+	return r.writer.Flush()
+}
+
+// Interceptor returns a chik.PublishInterceptor recording every message published on the controller
+// (see chik.Controller.UsePublish), at the time of the controller clock
+func (r *Recorder) Interceptor(controller *chik.Controller) chik.PublishInterceptor {
+	return func(message *chik.Message, topics []string) (*chik.Message, error) {
+		if err := r.Record(controller.Now(), message, topics); err != nil {
+			logger.Err(err).Msg("Cannot record message")
+		}
+		return message, nil
+	}
+}
+
+// Close flushes and closes the journal
+func (r *Recorder) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.closeFile()
+}
+
+// Reader reads entries from a journal file
+type Reader struct {
+	reader *bufio.Reader
+}
+
+// NewReader creates a Reader
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{bufio.NewReader(reader)}
+}
+
+// Next returns the next entry, io.EOF when the journal ends
+func (r *Reader) Next() (entry Entry, err error) {
+	var timestamp int64
+	if err = binary.Read(r.reader, binary.BigEndian, &timestamp); err != nil {
+		return
+	}
+	entry.Time = time.Unix(0, timestamp)
+
+	var count uint16
+	if err = binary.Read(r.reader, binary.BigEndian, &count); err != nil {
+		return entry, unexpectedEOF(err)
+	}
+	entry.Topics = make([]string, count)
+	for i := range entry.Topics {
+		var length uint16
+		if err = binary.Read(r.reader, binary.BigEndian, &length); err != nil {
+			return entry, unexpectedEOF(err)
+		}
+		topic := make([]byte, length)
+		if _, err = io.ReadFull(r.reader, topic); err != nil {
+			return entry, unexpectedEOF(err)
+		}
+		entry.Topics[i] = string(topic)
+	}
+
+	entry.Message, err = chik.ParseMessage(r.reader)
+	return entry, unexpectedEOF(err)
+}
+
+// unexpectedEOF reports a journal truncated in the middle of an entry
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Files returns the files of the journal at the given path, from the oldest to the current one
+func Files(path string) []string {
+	result := make([]string, 0)
+	rotated := make([]string, 0)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotatedPath(path, i)); err != nil {
+			break
+		}
+		rotated = append(rotated, rotatedPath(path, i))
+	}
+	for i := len(rotated) - 1; i >= 0; i-- {
+		result = append(result, rotated[i])
+	}
+	if _, err := os.Stat(path); err == nil {
+		result = append(result, path)
+	}
+	return result
+}
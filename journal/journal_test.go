@@ -0,0 +1,223 @@
+package journal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gochik/chik"
+	"github.com/gochik/chik/chiktest"
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+)
+
+func digitalCommand(appliance string) *types.Command {
+	return types.NewCommand(types.DigitalCommandType, types.DigitalCommand{Action: types.SET, ApplianceID: appliance})
+}
+
+func readAll(t *testing.T, paths []string) []Entry {
+	entries := make([]Entry, 0)
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := NewReader(file)
+		for {
+			entry, err := reader.Next()
+			if err != nil {
+				break
+			}
+			entries = append(entries, entry)
+		}
+		file.Close()
+	}
+	return entries
+}
+
+func TestRecordRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	recorder, err := NewRecorder(path, 200, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(1000, 0)
+	for i := 0; i < 10; i++ {
+		message := chik.NewMessage(chik.LoopbackID, digitalCommand(string(rune('a'+i))))
+		if err := recorder.Record(start.Add(time.Duration(i)*time.Second), message, []string{"topic"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorder.Close()
+
+	files := Files(path)
+	if len(files) != 3 || files[2] != path {
+		t.Fatalf("Unexpected journal files: %v", files)
+	}
+
+	entries := readAll(t, files)
+	if len(entries) == 0 || len(entries) == 10 {
+		t.Fatalf("Expected the oldest entries to be rotated away, got %d entries", len(entries))
+	}
+	last := entries[len(entries)-1]
+	if !last.Time.Equal(start.Add(9*time.Second)) || len(last.Topics) != 1 || last.Topics[0] != "topic" {
+		t.Fatalf("Unexpected last entry: %+v", last)
+	}
+	for i := 1; i < len(entries); i++ {
+		if !entries[i].Time.After(entries[i-1].Time) {
+			t.Fatal("Entries are out of order")
+		}
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	recorder, err := NewRecorder(path, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live := chik.NewController()
+	live.UsePublish(recorder.Interceptor(live))
+	peer := uuid.Must(uuid.NewV4())
+	for _, appliance := range []string{"external", "filtered"} {
+		received := chik.NewMessageFrom(peer, live.ID, digitalCommand(appliance))
+		live.PubMessage(received, types.AnyIncomingCommandType.String(), types.DigitalCommandType.String())
+	}
+	live.Pub(digitalCommand("internal"), chik.LoopbackID)
+	live.Pub(digitalCommand("remote"), peer)
+	recorder.Close()
+
+	if entries := readAll(t, Files(path)); len(entries) != 4 {
+		t.Fatalf("Expected 4 recorded entries, got %d", len(entries))
+	}
+
+	replayed := chik.NewController()
+	internal := replayed.Sub(types.DigitalCommandType.String())
+	outgoing := replayed.Sub(types.AnyOutgoingCommandType.String())
+	filter := func(entry Entry) bool {
+		payload, _ := entry.Message.Command().Payload()
+		return payload.(types.DigitalCommand).ApplianceID != "filtered"
+	}
+	err = Replay(context.Background(), replayed, ReplayOptions{Speed: 1, Filter: filter}, Files(path)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// replayed controllers never reach remotes
+	replayed.Pub(digitalCommand("reply"), uuid.Must(uuid.NewV4()))
+
+	// messages published by the handlers are produced again by the replayed ones
+	expectReplayed(t, internal, outgoing, "external")
+
+	replayed = chik.NewController()
+	internal = replayed.Sub(types.DigitalCommandType.String())
+	outgoing = replayed.Sub(types.AnyOutgoingCommandType.String())
+	err = Replay(context.Background(), replayed, ReplayOptions{Filter: filter, Internal: true}, Files(path)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReplayed(t, internal, outgoing, "external", "internal")
+}
+
+func expectReplayed(t *testing.T, internal chan interface{}, outgoing chan interface{}, appliances ...string) {
+	t.Helper()
+	for _, appliance := range appliances {
+		select {
+		case message := <-internal:
+			payload, _ := message.(*chik.Message).Command().Payload()
+			if payload.(types.DigitalCommand).ApplianceID != appliance {
+				t.Fatalf("Unexpected replayed message %v, expecting %s", message, appliance)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s not replayed", appliance)
+		}
+	}
+	select {
+	case message := <-internal:
+		t.Fatalf("Unexpected replayed message: %v", message)
+	case message := <-outgoing:
+		t.Fatalf("Unexpected outgoing message: %v", message)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// clockHandler tells when it gets the messages and the timer events
+type clockHandler struct {
+	chik.BaseHandler
+	seen  chan time.Time
+	ticks chan time.Time
+}
+
+func (h *clockHandler) Topics() []types.CommandType {
+	return []types.CommandType{types.DigitalCommandType}
+}
+
+func (h *clockHandler) Setup(controller *chik.Controller) (chik.Interrupts, error) {
+	return chik.Interrupts{Timer: chik.NewTimer(time.Minute, false)}, nil
+}
+
+func (h *clockHandler) HandleMessage(message *chik.Message, controller *chik.Controller) error {
+	h.seen <- controller.Now()
+	return nil
+}
+
+func (h *clockHandler) HandleTimerEvent(name string, tick time.Time, controller *chik.Controller) error {
+	h.ticks <- tick
+	return nil
+}
+
+func TestReplayClock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	recorder, err := NewRecorder(path, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := chiktest.Epoch
+	live := chik.NewControllerWithID(uuid.Must(uuid.NewV4()))
+	liveClock := chiktest.NewFakeClock(start)
+	live.SetClock(liveClock)
+	live.UsePublish(recorder.Interceptor(live))
+	peer := uuid.Must(uuid.NewV4())
+	for i := 0; i < 2; i++ {
+		received := chik.NewMessageFrom(peer, live.ID, digitalCommand("door"))
+		live.PubMessage(received, types.AnyIncomingCommandType.String(), types.DigitalCommandType.String())
+		liveClock.Advance(5 * time.Minute)
+	}
+	recorder.Close()
+
+	clock, err := NewClock(Files(path)...)
+	if err != nil || !clock.Now().Equal(start) {
+		t.Fatalf("Clock not set at the first entry: %v %v", clock, err)
+	}
+	replayed := chik.NewControllerWithID(uuid.Must(uuid.NewV4()))
+	replayed.SetClock(clock)
+	handler := &clockHandler{seen: make(chan time.Time, 2), ticks: make(chan time.Time, 10)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go replayed.Start(ctx, []chik.Handler{handler})
+	for replayed.HandlersHealth()[handler.String()].State != chik.HandlerRunning {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := Replay(ctx, replayed, ReplayOptions{Clock: clock}, Files(path)...); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if seen := <-handler.seen; !seen.Equal(start.Add(time.Duration(i) * 5 * time.Minute)) {
+			t.Fatalf("Message %d handled at %v", i, seen)
+		}
+	}
+	for i := 1; i <= 5; i++ {
+		select {
+		case tick := <-handler.ticks:
+			if !tick.Equal(start.Add(time.Duration(i) * time.Minute)) {
+				t.Fatalf("Unexpected tick %v", tick)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Tick %d missing", i)
+		}
+	}
+}
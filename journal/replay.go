@@ -0,0 +1,117 @@
+package journal
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gochik/chik"
+	"github.com/gochik/chik/types"
+)
+
+// ReplayOptions controls how a journal is replayed
+type ReplayOptions struct {
+	// Speed multiplies the recorded pace: 1 is real time, 10 ten times faster,
+	// 0 (or any non-positive value) replays entries as fast as possible
+	Speed float64
+
+	// Filter, if set, selects the entries to replay
+	Filter func(entry Entry) bool
+
+	// Internal also replays the messages published by the handlers, that are otherwise skipped because
+	// the replayed handlers publish them again. Useful to inspect a journal without running the handlers
+	Internal bool
+
+	// Clock, if set, is moved to the recorded time of every entry before it is published, so that
+	// the handlers take the decisions they took originally. It must be the controller clock.
+	// The handlers are given a few milliseconds to handle an entry before the clock moves on
+	Clock *Clock
+}
+
+// Offline returns a publish interceptor discarding the messages directed to remotes,
+// it is installed by Replay so that replayed traffic never leaves the controller
+func Offline() chik.PublishInterceptor {
+	outgoing := types.AnyOutgoingCommandType.String()
+	return func(message *chik.Message, topics []string) (*chik.Message, error) {
+		if hasTopic(topics, outgoing) {
+			return nil, nil
+		}
+		return message, nil
+	}
+}
+
+// Replay publishes the entries of the given journal files on the controller, in order.
+// The controller should be a fresh one dedicated to the replay: live remotes get disabled
+// and recorded outgoing messages are skipped. Only the messages received from remotes are
+// replayed, unless options.Internal is set: the handlers react to them as they did originally.
+// To reproduce their decisions at any speed the controller must run on options.Clock, eg:
+//
+//	clock, err := journal.NewClock(paths...)
+//	controller.SetClock(clock)
+//	go controller.Start(ctx, handlers)
+//	journal.Replay(ctx, controller, journal.ReplayOptions{Speed: 10, Clock: clock}, paths...)
+func Replay(ctx context.Context, controller *chik.Controller, options ReplayOptions, paths ...string) error {
+	controller.UsePublish(Offline())
+
+	var previous time.Time
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = replayFile(ctx, controller, options, file, &previous)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func replayFile(ctx context.Context, controller *chik.Controller, options ReplayOptions, file io.Reader, previous *time.Time) error {
+	reader := NewReader(file)
+	outgoing := types.AnyOutgoingCommandType.String()
+	incoming := types.AnyIncomingCommandType.String()
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hasTopic(entry.Topics, outgoing) || (!options.Internal && !hasTopic(entry.Topics, incoming)) ||
+			(options.Filter != nil && !options.Filter(entry)) {
+			continue
+		}
+
+		if options.Speed > 0 && !previous.IsZero() && entry.Time.After(*previous) {
+			wait := time.Duration(float64(entry.Time.Sub(*previous)) / options.Speed)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		*previous = entry.Time
+
+		if options.Clock != nil {
+			if err := options.Clock.moveTo(ctx, entry.Time); err != nil {
+				return err
+			}
+		}
+		controller.PubMessage(entry.Message, entry.Topics...)
+	}
+}
+
+func hasTopic(topics []string, topic string) bool {
+	for _, t := range topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
@@ -13,9 +13,25 @@ import (
 )
 
 type Message struct {
-	sender   uuid.UUID
-	receiver uuid.UUID
-	command  *types.Command
+	sender    uuid.UUID
+	receiver  uuid.UUID
+	requestID uuid.UUID
+	replyTo   uuid.UUID
+	messageID uuid.UUID
+	command   *types.Command
+
+	// local is set on the messages received from local clients (see ListenUnix)
+	local bool
+}
+
+// envelope is the serialized form of the message content:
+// it extends the command with the optional correlation ids.
+// Peers unaware of correlation ids simply ignore the extra fields
+type envelope struct {
+	*types.Command
+	RequestID *uuid.UUID `json:"request_id,omitempty"`
+	ReplyTo   *uuid.UUID `json:"reply_to,omitempty"`
+	MessageID *uuid.UUID `json:"message_id,omitempty"`
 }
 
 // NewMessage creates a new message
@@ -27,8 +43,38 @@ func NewMessage(receiver uuid.UUID, command *types.Command) *Message {
 	}
 }
 
-// ParseMessage handles incoming data and creates a Message object
+// NewMessageFrom creates a new message on behalf of the given sender
+func NewMessageFrom(sender uuid.UUID, receiver uuid.UUID, command *types.Command) *Message {
+	message := NewMessage(receiver, command)
+	message.sender = sender
+	return message
+}
+
+// NewRequest creates a new message carrying an unique request id,
+// replies to this message will carry the same id (see ReplyTo)
+func NewRequest(receiver uuid.UUID, command *types.Command) *Message {
+	message := NewMessage(receiver, command)
+	message.requestID, _ = uuid.NewV4()
+	return message
+}
+
+// NewReply creates a new message that replies to the given request
+func NewReply(request *Message, command *types.Command) *Message {
+	message := NewMessage(request.sender, command)
+	message.replyTo = request.requestID
+	return message
+}
+
+// MaxMessageSize bounds the length of a message, excluding the length prefix
+const MaxMessageSize = 16 * 1024 * 1024
+
+// ParseMessage handles incoming data and creates a Message object, whatever the content encoding
 func ParseMessage(reader io.Reader) (*Message, error) {
+	return parseMessage(reader, Encoding{Compact: true, Compress: true})
+}
+
+// parseMessage reads a message whose content is JSON or uses the accepted encoding
+func parseMessage(reader io.Reader, accepted Encoding) (*Message, error) {
 	message := Message{}
 	var length uint32
 	err := binary.Read(reader, binary.BigEndian, &length)
@@ -39,6 +85,9 @@ func ParseMessage(reader io.Reader) (*Message, error) {
 	if length < 16*2 {
 		return nil, fmt.Errorf("Message too short, must be at least 32 bytes, got: %d", length)
 	}
+	if length > MaxMessageSize {
+		return nil, fmt.Errorf("Message too long, must be at most %d bytes, got: %d", MaxMessageSize, length)
+	}
 
 	err = binary.Read(reader, binary.BigEndian, &message.sender)
 	if err != nil {
@@ -58,7 +107,7 @@ func ParseMessage(reader io.Reader) (*Message, error) {
 		if err != nil {
 			return nil, err
 		}
-		err = json.Unmarshal(data, &message.command)
+		err = message.parseContent(data, accepted)
 		if err != nil {
 			return nil, err
 		}
@@ -77,14 +126,82 @@ func (m *Message) ReceiverUUID() (uuid.UUID, error) {
 	return m.receiver, nil
 }
 
+// RequestID returns the id that replies to this message will carry, uuid.Nil if it is not a request
+func (m *Message) RequestID() uuid.UUID {
+	return m.requestID
+}
+
+// ReplyTo returns the request id this message is replying to, uuid.Nil if it is not a reply
+func (m *Message) ReplyTo() uuid.UUID {
+	return m.replyTo
+}
+
+// MessageID returns the id of a reliable message, uuid.Nil for fire and forget ones (see PubReliable)
+func (m *Message) MessageID() uuid.UUID {
+	return m.messageID
+}
+
 // Command returns message content as a Command object
 func (m *Message) Command() *types.Command {
 	return m.command
 }
 
-// Bytes returns the binary rapresentation of the message
+// Clone returns a copy of the message that can be modified without affecting the original one
+func (m *Message) Clone() *Message {
+	clone := *m
+	if m.command != nil {
+		command := *m.command
+		command.Data = append(json.RawMessage(nil), m.command.Data...)
+		clone.command = &command
+	}
+	return &clone
+}
+
+func (m *Message) jsonContent() ([]byte, error) {
+	var content interface{} = m.command
+	if m.requestID != uuid.Nil || m.replyTo != uuid.Nil || m.messageID != uuid.Nil {
+		e := envelope{Command: m.command}
+		if m.requestID != uuid.Nil {
+			e.RequestID = &m.requestID
+		}
+		if m.replyTo != uuid.Nil {
+			e.ReplyTo = &m.replyTo
+		}
+		if m.messageID != uuid.Nil {
+			e.MessageID = &m.messageID
+		}
+		content = e
+	}
+	return json.Marshal(content)
+}
+
+func (m *Message) parseJSONContent(data []byte) error {
+	var content envelope
+	err := json.Unmarshal(data, &content)
+	if err != nil {
+		return err
+	}
+	m.command = content.Command
+	if content.RequestID != nil {
+		m.requestID = *content.RequestID
+	}
+	if content.ReplyTo != nil {
+		m.replyTo = *content.ReplyTo
+	}
+	if content.MessageID != nil {
+		m.messageID = *content.MessageID
+	}
+	return nil
+}
+
+// Bytes returns the binary rapresentation of the message, its content is encoded as JSON
 func (m *Message) Bytes() ([]byte, error) {
-	data, err := json.Marshal(m.command)
+	return m.Encode(Encoding{})
+}
+
+// Encode returns the binary rapresentation of the message using the given content encoding
+func (m *Message) Encode(encoding Encoding) ([]byte, error) {
+	data, err := m.encodeContent(encoding)
 	if err != nil {
 		return []byte{}, err
 	}
@@ -110,6 +227,10 @@ func Equal(v1, v2 *Message) bool {
 			return false
 		}
 
+		if v1.requestID != v2.requestID || v1.replyTo != v2.replyTo || v1.messageID != v2.messageID {
+			return false
+		}
+
 		if !reflect.DeepEqual(v1.command, v2.command) {
 			return false
 		}
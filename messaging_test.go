@@ -0,0 +1,151 @@
+package chik
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/gochik/chik/msgpack"
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+)
+
+func TestMessageEncoding(t *testing.T) {
+	receiver, _ := uuid.NewV4()
+	request := NewRequest(receiver, types.NewCommand(types.VersionRequestCommandType, types.SimpleCommand{Action: types.GET}))
+	request.sender, _ = uuid.NewV4()
+	reply := NewReply(request, types.NewCommand(types.VersionReplyCommandType, types.VersionIndication{CurrentVersion: "1.0"}))
+
+	for _, message := range []*Message{
+		NewMessage(receiver, types.NewCommand(types.HeartbeatType, nil)),
+		request,
+		reply,
+	} {
+		data, err := message.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ParseMessage(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !Equal(message, parsed) {
+			t.Errorf("Messages differ: expected %v got %v", message, parsed)
+		}
+	}
+
+	if reply.ReplyTo() != request.RequestID() || reply.ReplyTo() == uuid.Nil {
+		t.Error("Reply does not carry the request id")
+	}
+}
+
+func TestLegacyMessageEncoding(t *testing.T) {
+	message := NewMessage(uuid.Nil, types.NewCommand(types.DigitalCommandType, types.DigitalCommand{Action: types.SET, ApplianceID: "light"}))
+	data, err := message.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"type":1,"data":{"action":0,"applianceID":"light"}}`
+	if content := string(data[4+16*2:]); content != expected {
+		t.Errorf("Unexpected encoding: %s", content)
+	}
+}
+
+func TestCompactEncoding(t *testing.T) {
+	status := types.Status{}
+	for i := 0; i < 100; i++ {
+		status[fmt.Sprintf("device%d", i)] = map[string]interface{}{"state": float64(i) / 2, "kind": 2, "on": i%2 == 0}
+	}
+	request := NewRequest(uuid.Nil, types.NewCommand(types.StatusNotificationCommandType, status))
+	request.sender, _ = uuid.NewV4()
+	reply := NewReply(request, types.NewCommand(types.HeartbeatType, nil))
+
+	for _, message := range []*Message{request, reply} {
+		plain, _ := message.Bytes()
+		for _, encoding := range []Encoding{{Compact: true}, {Compress: true}, {Compact: true, Compress: true}} {
+			data, err := message.Encode(encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) >= len(plain) && len(plain) > CompressionThreshold {
+				t.Errorf("%+v encoding is not smaller than JSON: %d >= %d", encoding, len(data), len(plain))
+			}
+			parsed, err := ParseMessage(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var expected, got interface{}
+			json.Unmarshal(message.Command().Data, &expected)
+			json.Unmarshal(parsed.Command().Data, &got)
+			if parsed.sender != message.sender || parsed.requestID != message.requestID || parsed.replyTo != message.replyTo ||
+				parsed.Command().Type != message.Command().Type || !reflect.DeepEqual(expected, got) {
+				t.Errorf("%+v encoding: messages differ: expected %v got %v", encoding, message, parsed)
+			}
+		}
+	}
+}
+
+func TestEncodingLimits(t *testing.T) {
+	status := types.Status{}
+	for i := 0; i < 100; i++ {
+		status[fmt.Sprintf("device%d", i)] = i
+	}
+	message := NewMessage(uuid.Nil, types.NewCommand(types.StatusNotificationCommandType, status))
+	for _, encoding := range []Encoding{{Compact: true}, {Compress: true}} {
+		data, _ := message.Encode(encoding)
+		if _, err := parseMessage(bytes.NewReader(data), Encoding{}); err == nil {
+			t.Errorf("%+v encoding accepted without being negotiated", encoding)
+		}
+		if _, err := parseMessage(bytes.NewReader(data), encoding); err != nil {
+			t.Errorf("%+v encoding refused: %v", encoding, err)
+		}
+	}
+
+	// compact content nested deeper than the stack can hold
+	deep := append([]byte{compactMarker, 0x95, 0x01}, bytes.Repeat([]byte{0x91}, 1_000_000)...)
+	data, _ := message.Bytes()
+	data = append(data[:4+16*2], deep...)
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	if _, err := ParseMessage(bytes.NewReader(data)); err == nil {
+		t.Error("Too deep content accepted")
+	}
+
+	// command types are a single byte
+	for _, commandType := range []int64{-1, 256} {
+		content, _ := msgpack.Marshal([]interface{}{commandType, nil, nil, nil, nil})
+		data = append(data[:4+16*2], append([]byte{compactMarker}, content...)...)
+		binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+		if _, err := ParseMessage(bytes.NewReader(data)); err == nil {
+			t.Errorf("Command type %d accepted", commandType)
+		}
+	}
+
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, MaxMessageSize+1)
+	if _, err := ParseMessage(bytes.NewReader(append(length, make([]byte, 64)...))); err == nil {
+		t.Error("Too long message accepted")
+	}
+}
+
+func FuzzParseMessage(f *testing.F) {
+	request := NewRequest(uuid.Nil, types.NewCommand(types.DigitalCommandType, types.DigitalCommand{Action: types.SET, ApplianceID: "light"}))
+	for _, encoding := range []Encoding{{}, {Compact: true}, {Compact: true, Compress: true}} {
+		data, _ := request.Encode(encoding)
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		message, err := ParseMessage(bytes.NewReader(data))
+		if err != nil || message.Command() == nil {
+			return
+		}
+		// whatever is parsed can be sent again
+		for _, encoding := range []Encoding{{}, {Compact: true}} {
+			if _, err := message.Encode(encoding); err != nil {
+				t.Fatalf("Cannot encode %v: %v", message, err)
+			}
+		}
+	})
+}
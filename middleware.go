@@ -0,0 +1,78 @@
+package chik
+
+import (
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// PublishInterceptor is called for every message published on the controller, before it reaches subscribers.
+// It returns the message to publish: the given one, a modified copy (see Message.Clone) or nil to silently drop it.
+// An error rejects the message. Messages are shared between subscribers: never modify the given one
+type PublishInterceptor func(message *Message, topics []string) (*Message, error)
+
+// DeliveryInterceptor is called before the handler with the given name receives a message,
+// returned values have the same meaning they have for PublishInterceptor
+type DeliveryInterceptor func(handler string, message *Message) (*Message, error)
+
+type interceptors struct {
+	sync.RWMutex
+	publish  []PublishInterceptor
+	delivery []DeliveryInterceptor
+}
+
+// UsePublish appends interceptors to the chain called on every published message.
+// Interceptors are called in the order they are added
+func (c *Controller) UsePublish(interceptors ...PublishInterceptor) {
+	c.interceptors.Lock()
+	defer c.interceptors.Unlock()
+	c.interceptors.publish = append(c.interceptors.publish, interceptors...)
+}
+
+// UseDelivery appends interceptors to the chain called before an handler receives a message.
+// Interceptors are called in the order they are added
+func (c *Controller) UseDelivery(interceptors ...DeliveryInterceptor) {
+	c.interceptors.Lock()
+	defer c.interceptors.Unlock()
+	c.interceptors.delivery = append(c.interceptors.delivery, interceptors...)
+}
+
+// interceptPublish runs the publish chain, a nil result means the message must not be published
+func (c *Controller) interceptPublish(message *Message, topics []string) *Message {
+	c.interceptors.RLock()
+	chain := c.interceptors.publish
+	c.interceptors.RUnlock()
+
+	var err error
+	for _, interceptor := range chain {
+		message, err = interceptor(message, topics)
+		if err != nil {
+			log.Warn().Err(err).Strs("topics", topics).Msg("Message rejected")
+			return nil
+		}
+		if message == nil {
+			return nil
+		}
+	}
+	return message
+}
+
+// interceptDelivery runs the delivery chain, a nil result means the message must not be delivered
+func (c *Controller) interceptDelivery(handler string, message *Message) *Message {
+	c.interceptors.RLock()
+	chain := c.interceptors.delivery
+	c.interceptors.RUnlock()
+
+	var err error
+	for _, interceptor := range chain {
+		message, err = interceptor(handler, message)
+		if err != nil {
+			log.Warn().Err(err).Str("handler", handler).Msg("Message delivery rejected")
+			return nil
+		}
+		if message == nil {
+			return nil
+		}
+	}
+	return message
+}
@@ -0,0 +1,91 @@
+package chik
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gochik/chik/types"
+)
+
+type recorderHandler struct {
+	BaseHandler
+	name     string
+	received chan *Message
+}
+
+func (h *recorderHandler) String() string {
+	return h.name
+}
+
+func (h *recorderHandler) Topics() []types.CommandType {
+	return []types.CommandType{types.DigitalCommandType}
+}
+
+func (h *recorderHandler) HandleMessage(message *Message, controller *Controller) error {
+	h.received <- message
+	return nil
+}
+
+func digitalCommand(appliance string) *types.Command {
+	return types.NewCommand(types.DigitalCommandType, types.DigitalCommand{Action: types.SET, ApplianceID: appliance})
+}
+
+func TestInterceptors(t *testing.T) {
+	cont := NewController()
+	cont.UsePublish(func(message *Message, topics []string) (*Message, error) {
+		if message.Command().Type != types.DigitalCommandType {
+			return message, nil
+		}
+		payload, _ := message.Command().Payload()
+		command := payload.(types.DigitalCommand)
+		switch command.ApplianceID {
+		case "filtered":
+			return nil, nil
+		case "rejected":
+			return nil, errors.New("not allowed")
+		case "rewritten":
+			clone := message.Clone()
+			command.ApplianceID = "modified"
+			clone.Command().Data = types.NewCommand(types.DigitalCommandType, command).Data
+			return clone, nil
+		}
+		return message, nil
+	})
+	cont.UseDelivery(func(handler string, message *Message) (*Message, error) {
+		if handler == "second" {
+			return nil, nil
+		}
+		return message, nil
+	})
+
+	first := &recorderHandler{name: "first", received: make(chan *Message, 5)}
+	second := &recorderHandler{name: "second", received: make(chan *Message, 5)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cont.Start(ctx, []Handler{first, second})
+	time.Sleep(10 * time.Millisecond)
+
+	for _, appliance := range []string{"filtered", "rejected", "rewritten"} {
+		cont.Pub(digitalCommand(appliance), LoopbackID)
+	}
+
+	select {
+	case message := <-first.received:
+		payload, _ := message.Command().Payload()
+		if payload.(types.DigitalCommand).ApplianceID != "modified" {
+			t.Errorf("Unexpected message: %v", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Rewritten message not received")
+	}
+
+	select {
+	case message := <-first.received:
+		t.Errorf("Unexpected message: %v", message)
+	case message := <-second.received:
+		t.Errorf("Unexpected message on filtered handler: %v", message)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,362 @@
+// Package msgpack implements the subset of MessagePack (https://msgpack.org) needed
+// to carry JSON-like values: nil, booleans, integers, floats, strings, binaries, arrays
+// and maps with string keys.
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxPreallocation limits the memory allocated upfront for untrusted lengths
+const maxPreallocation = 1024
+
+// MaxDepth is the maximum nesting of arrays and maps, it bounds the recursion on untrusted data
+const MaxDepth = 100
+
+var errDepth = fmt.Errorf("msgpack: nesting deeper than %d levels", MaxDepth)
+
+// Marshal encodes a value
+func Marshal(value interface{}) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	if err := encode(&buffer, value, 0); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func writeHeader(buffer *bytes.Buffer, fixed byte, fixedMax int, codes [3]byte, length int) {
+	switch {
+	case fixedMax > 0 && length <= fixedMax:
+		buffer.WriteByte(fixed | byte(length))
+	case codes[0] != 0 && length <= math.MaxUint8:
+		buffer.WriteByte(codes[0])
+		buffer.WriteByte(byte(length))
+	case length <= math.MaxUint16:
+		buffer.WriteByte(codes[1])
+		binary.Write(buffer, binary.BigEndian, uint16(length))
+	default:
+		buffer.WriteByte(codes[2])
+		binary.Write(buffer, binary.BigEndian, uint32(length))
+	}
+}
+
+func encodeInt(buffer *bytes.Buffer, value int64) {
+	switch {
+	case value >= 0 && value <= math.MaxInt8:
+		buffer.WriteByte(byte(value))
+	case value < 0 && value >= -32:
+		buffer.WriteByte(byte(value))
+	case value >= math.MinInt8 && value <= math.MaxInt8:
+		buffer.WriteByte(0xd0)
+		buffer.WriteByte(byte(value))
+	case value >= math.MinInt16 && value <= math.MaxInt16:
+		buffer.WriteByte(0xd1)
+		binary.Write(buffer, binary.BigEndian, int16(value))
+	case value >= math.MinInt32 && value <= math.MaxInt32:
+		buffer.WriteByte(0xd2)
+		binary.Write(buffer, binary.BigEndian, int32(value))
+	default:
+		buffer.WriteByte(0xd3)
+		binary.Write(buffer, binary.BigEndian, value)
+	}
+}
+
+func encode(buffer *bytes.Buffer, value interface{}, depth int) error {
+	if depth > MaxDepth {
+		return errDepth
+	}
+	switch v := value.(type) {
+	case nil:
+		buffer.WriteByte(0xc0)
+
+	case bool:
+		if v {
+			buffer.WriteByte(0xc3)
+		} else {
+			buffer.WriteByte(0xc2)
+		}
+
+	case int:
+		encodeInt(buffer, int64(v))
+
+	case int64:
+		encodeInt(buffer, v)
+
+	case uint64:
+		if v <= math.MaxInt64 {
+			encodeInt(buffer, int64(v))
+			break
+		}
+		buffer.WriteByte(0xcf)
+		binary.Write(buffer, binary.BigEndian, v)
+
+	case float64:
+		buffer.WriteByte(0xcb)
+		binary.Write(buffer, binary.BigEndian, v)
+
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			encodeInt(buffer, i)
+			break
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return encode(buffer, u, depth)
+		}
+		// integers out of range would lose precision as floats
+		if !strings.ContainsAny(string(v), ".eE") {
+			return fmt.Errorf("integer %s out of range", v)
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		return encode(buffer, f, depth)
+
+	case string:
+		writeHeader(buffer, 0xa0, 31, [3]byte{0xd9, 0xda, 0xdb}, len(v))
+		buffer.WriteString(v)
+
+	case []byte:
+		writeHeader(buffer, 0, 0, [3]byte{0xc4, 0xc5, 0xc6}, len(v))
+		buffer.Write(v)
+
+	case []interface{}:
+		writeHeader(buffer, 0x90, 15, [3]byte{0, 0xdc, 0xdd}, len(v))
+		for _, item := range v {
+			if err := encode(buffer, item, depth+1); err != nil {
+				return err
+			}
+		}
+
+	case map[string]interface{}:
+		writeHeader(buffer, 0x80, 15, [3]byte{0, 0xde, 0xdf}, len(v))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			encode(buffer, key, depth+1)
+			if err := encode(buffer, v[key], depth+1); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("msgpack: unsupported type %T", value)
+	}
+	return nil
+}
+
+// Unmarshal decodes a value, integers are returned as int64 (uint64 if they do not fit)
+// and maps as map[string]interface{}
+func Unmarshal(data []byte) (interface{}, error) {
+	reader := bytes.NewReader(data)
+	value, err := decode(reader, 0)
+	if err != nil {
+		return nil, err
+	}
+	if reader.Len() > 0 {
+		return nil, errors.New("msgpack: trailing data")
+	}
+	return value, nil
+}
+
+func readLength(reader *bytes.Reader, size int) (int, error) {
+	switch size {
+	case 1:
+		b, err := reader.ReadByte()
+		return int(b), unexpectedEOF(err)
+	case 2:
+		var length uint16
+		err := binary.Read(reader, binary.BigEndian, &length)
+		return int(length), unexpectedEOF(err)
+	default:
+		var length uint32
+		err := binary.Read(reader, binary.BigEndian, &length)
+		return int(length), unexpectedEOF(err)
+	}
+}
+
+func readBytes(reader *bytes.Reader, length int) ([]byte, error) {
+	if length > reader.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, length)
+	_, err := io.ReadFull(reader, data)
+	return data, err
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// capacity returns the size to preallocate for a collection of the given length
+func capacity(length int) int {
+	if length > maxPreallocation {
+		return maxPreallocation
+	}
+	return length
+}
+
+func decodeArray(reader *bytes.Reader, length int, depth int) (interface{}, error) {
+	// every item takes at least a byte
+	if length > reader.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	result := make([]interface{}, 0, capacity(length))
+	for i := 0; i < length; i++ {
+		item, err := decode(reader, depth)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+func decodeMap(reader *bytes.Reader, length int, depth int) (interface{}, error) {
+	// every entry takes at least two bytes
+	if length > reader.Len()/2 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	result := make(map[string]interface{}, capacity(length))
+	for i := 0; i < length; i++ {
+		key, err := decode(reader, depth)
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: unsupported map key %T", key)
+		}
+		if result[name], err = decode(reader, depth); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func decodeFixed(reader *bytes.Reader, value interface{}) (interface{}, error) {
+	if err := binary.Read(reader, binary.BigEndian, value); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	switch v := value.(type) {
+	case *int8:
+		return int64(*v), nil
+	case *int16:
+		return int64(*v), nil
+	case *int32:
+		return int64(*v), nil
+	case *int64:
+		return *v, nil
+	case *uint8:
+		return int64(*v), nil
+	case *uint16:
+		return int64(*v), nil
+	case *uint32:
+		return int64(*v), nil
+	case *uint64:
+		if *v <= math.MaxInt64 {
+			return int64(*v), nil
+		}
+		return *v, nil
+	case *float32:
+		return float64(*v), nil
+	case *float64:
+		return *v, nil
+	}
+	return nil, fmt.Errorf("msgpack: unsupported fixed size %T", value)
+}
+
+// decode reads a value, depth is the nesting level of the arrays and maps containing it
+func decode(reader *bytes.Reader, depth int) (interface{}, error) {
+	if depth > MaxDepth {
+		return nil, errDepth
+	}
+	code, err := reader.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xe0 == 0xa0:
+		data, err := readBytes(reader, int(code&0x1f))
+		return string(data), err
+	case code&0xf0 == 0x90:
+		return decodeArray(reader, int(code&0x0f), depth+1)
+	case code&0xf0 == 0x80:
+		return decodeMap(reader, int(code&0x0f), depth+1)
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc:
+		return decodeFixed(reader, new(uint8))
+	case 0xcd:
+		return decodeFixed(reader, new(uint16))
+	case 0xce:
+		return decodeFixed(reader, new(uint32))
+	case 0xcf:
+		return decodeFixed(reader, new(uint64))
+	case 0xd0:
+		return decodeFixed(reader, new(int8))
+	case 0xd1:
+		return decodeFixed(reader, new(int16))
+	case 0xd2:
+		return decodeFixed(reader, new(int32))
+	case 0xd3:
+		return decodeFixed(reader, new(int64))
+	case 0xca:
+		return decodeFixed(reader, new(float32))
+	case 0xcb:
+		return decodeFixed(reader, new(float64))
+	case 0xd9, 0xda, 0xdb:
+		length, err := readLength(reader, 1<<(code-0xd9))
+		if err != nil {
+			return nil, err
+		}
+		data, err := readBytes(reader, length)
+		return string(data), err
+	case 0xc4, 0xc5, 0xc6:
+		length, err := readLength(reader, 1<<(code-0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return readBytes(reader, length)
+	case 0xdc, 0xdd:
+		length, err := readLength(reader, 2<<(code-0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return decodeArray(reader, length, depth+1)
+	case 0xde, 0xdf:
+		length, err := readLength(reader, 2<<(code-0xde))
+		if err != nil {
+			return nil, err
+		}
+		return decodeMap(reader, length, depth+1)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported format 0x%02x", code)
+}
@@ -0,0 +1,144 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	long := strings.Repeat("x", 70000)
+	values := []interface{}{
+		nil,
+		true,
+		false,
+		int64(0),
+		int64(127),
+		int64(-32),
+		int64(-33),
+		int64(200),
+		int64(-200),
+		int64(70000),
+		int64(math.MaxInt64),
+		int64(math.MinInt64),
+		uint64(math.MaxUint64),
+		1.5,
+		"",
+		"short",
+		long,
+		[]byte{1, 2, 3},
+		[]interface{}{int64(1), "two", []interface{}{}},
+		map[string]interface{}{"a": int64(1), "b": map[string]interface{}{"c": nil}},
+	}
+	for _, value := range values {
+		data, err := Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := Unmarshal(data)
+		if err != nil {
+			t.Fatalf("%v: %v", value, err)
+		}
+		if !reflect.DeepEqual(value, decoded) {
+			t.Errorf("Expected %v, got %v", value, decoded)
+		}
+	}
+}
+
+func TestJSONNumbers(t *testing.T) {
+	data, err := Marshal([]interface{}{json.Number("12"), json.Number("1.25"), 3, json.Number("18446744073709551615")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _ := Unmarshal(data)
+	if !reflect.DeepEqual(decoded, []interface{}{int64(12), 1.25, int64(3), uint64(math.MaxUint64)}) {
+		t.Errorf("Unexpected numbers: %v", decoded)
+	}
+	if _, err := Marshal(json.Number("18446744073709551616")); err == nil {
+		t.Error("Out of range integer encoded")
+	}
+}
+
+func TestInvalidData(t *testing.T) {
+	for _, data := range [][]byte{
+		{},
+		{0xc1},
+		{0xa5, 'a'},
+		{0xdd, 0xff, 0xff, 0xff, 0xff},
+		{0x81, 0x01, 0x01},
+		{0xc0, 0xc0},
+	} {
+		if _, err := Unmarshal(data); err == nil {
+			t.Errorf("%v: expected an error", data)
+		}
+	}
+}
+
+func nested(depth int) interface{} {
+	var value interface{} = "leaf"
+	for i := 0; i < depth; i++ {
+		value = []interface{}{value}
+	}
+	return value
+}
+
+func TestLimits(t *testing.T) {
+	data, err := Marshal(nested(MaxDepth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unmarshal(data); err != nil {
+		t.Errorf("Maximum depth refused: %v", err)
+	}
+	if _, err := Marshal(nested(MaxDepth + 1)); err == nil {
+		t.Error("Too deep value encoded")
+	}
+
+	for _, data := range [][]byte{
+		// nested arrays deeper than the stack can hold
+		bytes.Repeat([]byte{0x91}, 20_000_000),
+		append(bytes.Repeat([]byte{0x81, 0xa1, 'a'}, MaxDepth+1), 0xc0),
+		// lengths larger than the data
+		{0xdd, 0x7f, 0xff, 0xff, 0xff, 0xc0},
+		{0xdf, 0x7f, 0xff, 0xff, 0xff, 0xa1, 'a', 0xc0},
+	} {
+		if _, err := Unmarshal(data); err == nil {
+			t.Errorf("%d bytes starting with %v: expected an error", len(data), data[:4])
+		}
+	}
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for _, value := range []interface{}{
+		nil,
+		int64(-200),
+		uint64(math.MaxUint64),
+		1.5,
+		"short",
+		[]byte{1, 2, 3},
+		[]interface{}{int64(1), "two", []interface{}{}},
+		map[string]interface{}{"a": int64(1), "b": map[string]interface{}{"c": nil}},
+		nested(MaxDepth),
+	} {
+		data, _ := Marshal(value)
+		f.Add(data)
+	}
+	f.Add([]byte{0xca, 0x7f, 0xc0, 0x00, 0x00})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		value, err := Unmarshal(data)
+		if err != nil {
+			return
+		}
+		// whatever is decoded can be encoded and decoded again
+		encoded, err := Marshal(value)
+		if err != nil {
+			t.Fatalf("Cannot encode %v: %v", value, err)
+		}
+		if _, err := Unmarshal(encoded); err != nil {
+			t.Fatalf("Cannot decode %v encoded as %v: %v", value, encoded, err)
+		}
+	})
+}
@@ -0,0 +1,314 @@
+package chik
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// DeliveryPolicy defines what happens when a subscriber does not consume its messages fast enough
+type DeliveryPolicy uint8
+
+// Available delivery policies
+const (
+	// DropNewest discards the message being published when the subscriber queue is full
+	DropNewest DeliveryPolicy = iota
+	// DropOldest discards the oldest queued message to make room for the one being published
+	DropOldest
+	// Block makes the publisher wait until the subscriber has room for the message
+	Block
+	// CoalesceByTopic replaces a queued message with the one being published on the same topic.
+	// Useful for messages like status notifications where only the latest one matters.
+	// When there is nothing to replace and the queue is full the oldest message is dropped
+	CoalesceByTopic
+)
+
+// SubscriptionOptions configures how messages are queued for a subscriber
+type SubscriptionOptions struct {
+	Policy     DeliveryPolicy
+	BufferSize int
+}
+
+// DefaultSubscriptionOptions are the options used by Sub and by handlers without specific options
+var DefaultSubscriptionOptions = SubscriptionOptions{
+	Policy:     DropNewest,
+	BufferSize: BufferSize,
+}
+
+// DeliveryStats counts what happened to the messages published to a subscriber
+type DeliveryStats struct {
+	Delivered uint64 `json:"delivered"`
+	Dropped   uint64 `json:"dropped"`
+	Coalesced uint64 `json:"coalesced"`
+}
+
+type deliveryCounters struct {
+	delivered uint64
+	dropped   uint64
+	coalesced uint64
+}
+
+func (c *deliveryCounters) stats() DeliveryStats {
+	return DeliveryStats{
+		Delivered: atomic.LoadUint64(&c.delivered),
+		Dropped:   atomic.LoadUint64(&c.dropped),
+		Coalesced: atomic.LoadUint64(&c.coalesced),
+	}
+}
+
+type delivery struct {
+	topic   string
+	message interface{}
+}
+
+// subscriber queues messages following its policy, a goroutine moves them from the queue to out
+type subscriber struct {
+	sync.Mutex
+	out       chan interface{}
+	options   SubscriptionOptions
+	once      bool
+	topics    []string
+	queue     []delivery
+	finishing bool
+	wake      chan struct{}
+	space     chan struct{}
+	quit      chan struct{}
+	quitOnce  sync.Once
+	counters  *deliveryCounters
+}
+
+func newSubscriber(options SubscriptionOptions, once bool, counters *deliveryCounters, topics []string) *subscriber {
+	if options.BufferSize <= 0 {
+		options.BufferSize = BufferSize
+	}
+	if counters == nil {
+		counters = &deliveryCounters{}
+	}
+	s := &subscriber{
+		out:      make(chan interface{}),
+		options:  options,
+		once:     once,
+		topics:   topics,
+		queue:    make([]delivery, 0, options.BufferSize),
+		wake:     make(chan struct{}, 1),
+		space:    make(chan struct{}),
+		quit:     make(chan struct{}),
+		counters: counters,
+	}
+	go s.run()
+	return s
+}
+
+func notify(channel chan struct{}) {
+	select {
+	case channel <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) run() {
+	defer close(s.out)
+	for {
+		s.Lock()
+		if len(s.queue) == 0 {
+			finishing := s.finishing
+			s.Unlock()
+			if finishing {
+				return
+			}
+			select {
+			case <-s.wake:
+				continue
+
+			case <-s.quit:
+				return
+			}
+		}
+		next := s.queue[0]
+		s.queue = s.queue[1:]
+		// wake up every publisher waiting for room in the queue
+		close(s.space)
+		s.space = make(chan struct{})
+		s.Unlock()
+
+		select {
+		case s.out <- next.message:
+			atomic.AddUint64(&s.counters.delivered, 1)
+
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// push queues a message following the subscriber policy
+func (s *subscriber) push(topic string, message interface{}) {
+	s.Lock()
+	defer s.Unlock()
+	for len(s.queue) >= s.options.BufferSize {
+		switch s.options.Policy {
+		case DropOldest:
+			s.queue = s.queue[1:]
+			atomic.AddUint64(&s.counters.dropped, 1)
+
+		case CoalesceByTopic:
+			for i := range s.queue {
+				if s.queue[i].topic == topic {
+					s.queue[i].message = message
+					atomic.AddUint64(&s.counters.coalesced, 1)
+					return
+				}
+			}
+			s.queue = s.queue[1:]
+			atomic.AddUint64(&s.counters.dropped, 1)
+
+		case Block:
+			space := s.space
+			s.Unlock()
+			select {
+			case <-space:
+			case <-s.quit:
+			}
+			s.Lock()
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
+
+		default:
+			atomic.AddUint64(&s.counters.dropped, 1)
+			return
+		}
+	}
+
+	if s.options.Policy == CoalesceByTopic {
+		for i := range s.queue {
+			if s.queue[i].topic == topic {
+				s.queue[i].message = message
+				atomic.AddUint64(&s.counters.coalesced, 1)
+				return
+			}
+		}
+	}
+	s.queue = append(s.queue, delivery{topic, message})
+	notify(s.wake)
+}
+
+// finish closes the subscription once queued messages have been delivered
+func (s *subscriber) finish() {
+	s.Lock()
+	s.finishing = true
+	s.Unlock()
+	notify(s.wake)
+}
+
+// stop closes the subscription discarding queued messages
+func (s *subscriber) stop() {
+	s.quitOnce.Do(func() { close(s.quit) })
+}
+
+// broker dispatches published messages to the subscribers of each topic
+type broker struct {
+	sync.Mutex
+	topics    map[string]map[*subscriber]struct{}
+	byChannel map[chan interface{}]*subscriber
+	closed    bool
+}
+
+func newBroker() *broker {
+	return &broker{
+		topics:    make(map[string]map[*subscriber]struct{}),
+		byChannel: make(map[chan interface{}]*subscriber),
+	}
+}
+
+func (b *broker) sub(options SubscriptionOptions, once bool, counters *deliveryCounters, topics ...string) chan interface{} {
+	s := newSubscriber(options, once, counters, topics)
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		s.stop()
+		return s.out
+	}
+	for _, topic := range topics {
+		if b.topics[topic] == nil {
+			b.topics[topic] = make(map[*subscriber]struct{})
+		}
+		b.topics[topic][s] = struct{}{}
+	}
+	b.byChannel[s.out] = s
+	return s.out
+}
+
+// remove deletes the subscriber from the broker, the caller must hold the lock
+func (b *broker) remove(s *subscriber) {
+	for _, topic := range s.topics {
+		delete(b.topics[topic], s)
+		if len(b.topics[topic]) == 0 {
+			delete(b.topics, topic)
+		}
+	}
+	delete(b.byChannel, s.out)
+}
+
+func (b *broker) unsub(channel chan interface{}) {
+	b.Lock()
+	s, ok := b.byChannel[channel]
+	if ok {
+		b.remove(s)
+	}
+	b.Unlock()
+	if ok {
+		s.stop()
+	}
+}
+
+func (b *broker) pub(message interface{}, topics ...string) {
+	targets := make([]delivery, 0)
+	subscribers := make([]*subscriber, 0)
+	finished := make([]*subscriber, 0)
+
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		return
+	}
+	for _, topic := range topics {
+		for s := range b.topics[topic] {
+			if s.once {
+				if _, ok := b.byChannel[s.out]; !ok {
+					continue
+				}
+				b.remove(s)
+				finished = append(finished, s)
+			}
+			targets = append(targets, delivery{topic, message})
+			subscribers = append(subscribers, s)
+		}
+	}
+	b.Unlock()
+
+	// pushing without holding the lock allows blocking subscribers to publish in turn
+	for i, s := range subscribers {
+		s.push(targets[i].topic, targets[i].message)
+	}
+	for _, s := range finished {
+		s.finish()
+	}
+}
+
+func (b *broker) shutdown() {
+	b.Lock()
+	b.closed = true
+	subscribers := make([]*subscriber, 0, len(b.byChannel))
+	for _, s := range b.byChannel {
+		subscribers = append(subscribers, s)
+	}
+	b.topics = make(map[string]map[*subscriber]struct{})
+	b.byChannel = make(map[chan interface{}]*subscriber)
+	b.Unlock()
+
+	for _, s := range subscribers {
+		s.stop()
+	}
+}
@@ -0,0 +1,95 @@
+package chik
+
+import (
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, channel chan interface{}) interface{} {
+	t.Helper()
+	select {
+	case value := <-channel:
+		return value
+	case <-time.After(time.Second):
+		t.Fatal("Nothing received")
+	}
+	return nil
+}
+
+func fill(b *broker, topic string, count int) {
+	for i := 0; i < count; i++ {
+		b.pub(i, topic)
+	}
+}
+
+func TestDeliveryPolicies(t *testing.T) {
+	for _, val := range []struct {
+		Name     string
+		Policy   DeliveryPolicy
+		Expected []int
+		Dropped  uint64
+	}{
+		{"Drop newest", DropNewest, []int{0, 1}, 3},
+		{"Drop oldest", DropOldest, []int{3, 4}, 3},
+		{"Coalesce", CoalesceByTopic, []int{4}, 0},
+	} {
+		b := newBroker()
+		counters := &deliveryCounters{}
+		sub := b.sub(SubscriptionOptions{Policy: val.Policy, BufferSize: 2}, false, counters, "topic")
+		s := b.byChannel[sub]
+		// the first message keeps the delivery goroutine busy until it is received
+		b.pub(-1, "topic")
+		for queued := 1; queued > 0; {
+			s.Lock()
+			queued = len(s.queue)
+			s.Unlock()
+		}
+		fill(b, "topic", 5)
+		for _, expected := range append([]int{-1}, val.Expected...) {
+			if value := receive(t, sub); value != expected {
+				t.Errorf("%s: expecting %v got %v", val.Name, expected, value)
+			}
+		}
+		if stats := counters.stats(); stats.Dropped != val.Dropped {
+			t.Errorf("%s: unexpected drop count %v", val.Name, stats)
+		}
+		b.shutdown()
+	}
+}
+
+func TestBlockPolicy(t *testing.T) {
+	b := newBroker()
+	sub := b.sub(SubscriptionOptions{Policy: Block, BufferSize: 1}, false, nil, "topic")
+	done := make(chan struct{})
+	go func() {
+		fill(b, "topic", 5)
+		close(done)
+	}()
+	for i := 0; i < 5; i++ {
+		if value := receive(t, sub); value != i {
+			t.Errorf("Expecting %v got %v", i, value)
+		}
+	}
+	<-done
+	b.shutdown()
+}
+
+func TestSubOnceAndUnsub(t *testing.T) {
+	b := newBroker()
+	once := b.sub(DefaultSubscriptionOptions, true, nil, "a", "b")
+	sub := b.sub(DefaultSubscriptionOptions, false, nil, "a")
+	b.pub("first", "a")
+	b.pub("second", "b")
+	if value := receive(t, once); value != "first" {
+		t.Errorf("Unexpected value: %v", value)
+	}
+	if _, ok := <-once; ok {
+		t.Error("SubOnce channel has not been closed")
+	}
+
+	b.unsub(sub)
+	for range sub {
+	}
+	b.pub("third", "a")
+	b.shutdown()
+}
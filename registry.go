@@ -0,0 +1,110 @@
+package chik
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gochik/chik/config"
+	"github.com/rs/zerolog/log"
+)
+
+// handlersConfigKey is the config key listing the names of the handlers to create
+const handlersConfigKey = "handlers"
+
+// HandlerFactory creates an handler, it returns an error if the handler cannot be created
+// (eg: its config section is missing)
+type HandlerFactory func() (Handler, error)
+
+var factories = struct {
+	sync.Mutex
+	byName map[string]HandlerFactory
+}{byName: make(map[string]HandlerFactory)}
+
+// RegisterHandler makes an handler factory available under the given name.
+// It is meant to be called from the init function of handler packages, name should match Handler.String().
+// It panics if the name is already taken
+func RegisterHandler(name string, factory HandlerFactory) {
+	factories.Lock()
+	defer factories.Unlock()
+	if _, exists := factories.byName[name]; exists {
+		panic(fmt.Sprintf("handler %q registered twice", name))
+	}
+	factories.byName[name] = factory
+}
+
+// RegisteredHandlers returns the sorted list of names that can be passed to CreateHandlers
+func RegisteredHandlers() []string {
+	factories.Lock()
+	defer factories.Unlock()
+	return registeredNames()
+}
+
+// registeredNames returns the sorted list of registered names, the caller must hold the factories lock
+func registeredNames() []string {
+	result := make([]string, 0, len(factories.byName))
+	for name := range factories.byName {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// CreateHandlers creates the handlers registered with the given names
+func CreateHandlers(names ...string) ([]Handler, error) {
+	factories.Lock()
+	selected := make([]HandlerFactory, 0, len(names))
+	for _, name := range names {
+		factory, ok := factories.byName[name]
+		if !ok {
+			factories.Unlock()
+			return nil, fmt.Errorf("unknown handler %q, available handlers are: %s", name, strings.Join(registeredNames(), ", "))
+		}
+		selected = append(selected, factory)
+	}
+	factories.Unlock()
+
+	result := make([]Handler, 0, len(names))
+	for i, factory := range selected {
+		handler, err := factory()
+		if err != nil {
+			return nil, fmt.Errorf("cannot create handler %q: %w", names[i], err)
+		}
+		result = append(result, handler)
+	}
+	return result, nil
+}
+
+// HandlersFromConfig creates the handlers listed in the "handlers" array of the config file
+func HandlersFromConfig() ([]Handler, error) {
+	var names []string
+	err := config.GetStruct(handlersConfigKey, &names)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q from config: %w", handlersConfigKey, err)
+	}
+	return CreateHandlers(names...)
+}
+
+// StartFromConfig starts the handlers listed in the config file (see HandlersFromConfig)
+// together with the given ones, that are usually the handlers requiring parameters
+// (eg: version and router). If the unix_socket config key is set, local clients are served on it (see ListenUnix)
+func (c *Controller) StartFromConfig(ctx context.Context, handlers ...Handler) error {
+	configured, err := HandlersFromConfig()
+	if err != nil {
+		log.Err(err).Msg("Cannot create handlers")
+		return err
+	}
+
+	var socketPath string
+	config.GetStruct("unix_socket", &socketPath)
+	if socketPath != "" {
+		go func() {
+			if err := c.ListenUnix(ctx, socketPath); err != nil {
+				log.Err(err).Msg("Cannot serve local clients")
+			}
+		}()
+	}
+	return c.Start(ctx, append(configured, handlers...))
+}
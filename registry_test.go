@@ -0,0 +1,46 @@
+package chik
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/gochik/chik/config"
+)
+
+// registerHandler registers a factory for the duration of the test
+func registerHandler(t *testing.T, name string, factory HandlerFactory) {
+	RegisterHandler(name, factory)
+	t.Cleanup(func() {
+		factories.Lock()
+		delete(factories.byName, name)
+		factories.Unlock()
+	})
+}
+
+func TestCreateHandlers(t *testing.T) {
+	registerHandler(t, "test-echo", func() (Handler, error) { return &echoHandler{}, nil })
+	registerHandler(t, "test-broken", func() (Handler, error) { return nil, errors.New("missing config") })
+
+	handlers, err := CreateHandlers("test-echo")
+	if err != nil || len(handlers) != 1 {
+		t.Fatalf("Unexpected result: %v %v", handlers, err)
+	}
+
+	_, err = CreateHandlers("test-echo", "test-unknown")
+	if err == nil || !strings.Contains(err.Error(), "test-unknown") {
+		t.Errorf("Expecting an unknown handler error, got: %v", err)
+	}
+
+	_, err = CreateHandlers("test-broken")
+	if err == nil || !strings.Contains(err.Error(), "missing config") {
+		t.Errorf("Expecting a creation error, got: %v", err)
+	}
+
+	config.Set(handlersConfigKey, []interface{}{"test-echo"})
+	defer config.Set(handlersConfigKey, nil)
+	handlers, err = HandlersFromConfig()
+	if err != nil || len(handlers) != 1 {
+		t.Fatalf("Unexpected result from config: %v %v", handlers, err)
+	}
+}
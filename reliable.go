@@ -0,0 +1,213 @@
+package chik
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// OutboxRetryInterval is how often unacknowledged reliable messages are sent again
+const OutboxRetryInterval = 30 * time.Second
+
+// OutboxMaxAge is how long a reliable message is retried before giving up
+const OutboxMaxAge = 24 * time.Hour
+
+// dedupWindow is how long the ids of received reliable messages are remembered
+const dedupWindow = OutboxMaxAge
+
+// Ack acknowledges the reception of a reliable message
+type Ack struct {
+	MessageID uuid.UUID `json:"message_id"`
+}
+
+type outboxEntry struct {
+	Message  []byte    `json:"message"`
+	Created  time.Time `json:"created"`
+	lastSent time.Time
+	message  *Message
+}
+
+// outbox keeps reliable messages until the receiver acknowledges them,
+// if it has a path its content is persisted so that it survives restarts
+type outbox struct {
+	sync.Mutex
+	path     string
+	entries  map[uuid.UUID]*outboxEntry
+	received map[uuid.UUID]time.Time
+}
+
+func newOutbox() *outbox {
+	return &outbox{
+		entries:  make(map[uuid.UUID]*outboxEntry),
+		received: make(map[uuid.UUID]time.Time),
+	}
+}
+
+// load reads the persisted entries, the lock must be held
+func (o *outbox) load() error {
+	data, err := os.ReadFile(o.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []*outboxEntry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		entry.message, err = ParseMessage(bytes.NewReader(entry.Message))
+		if err != nil {
+			return err
+		}
+		o.entries[entry.message.messageID] = entry
+	}
+	return nil
+}
+
+// save persists the entries, the lock must be held
+func (o *outbox) save() {
+	if o.path == "" {
+		return
+	}
+	entries := make([]*outboxEntry, 0, len(o.entries))
+	for _, entry := range o.entries {
+		entries = append(entries, entry)
+	}
+	data, err := json.Marshal(entries)
+	if err == nil {
+		err = os.WriteFile(o.path+".tmp", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(o.path+".tmp", o.path)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("Cannot save outbox")
+	}
+}
+
+// SetOutbox makes the reliable messages outbox persistent, messages already stored
+// at the given path are loaded and sent again
+func (c *Controller) SetOutbox(path string) error {
+	c.outbox.Lock()
+	defer c.outbox.Unlock()
+	c.outbox.path = path
+	if err := c.outbox.load(); err != nil {
+		return err
+	}
+	c.outbox.save()
+	return nil
+}
+
+// PubReliable publishes a command for a remote receiver with at-least-once delivery:
+// the message is kept in the outbox and sent again until the receiver acknowledges it.
+// The receiver discards duplicates, the returned id is the one carried by the AckCommandType
+func (c *Controller) PubReliable(command *types.Command, receiverID uuid.UUID) (uuid.UUID, error) {
+	if receiverID == LoopbackID {
+		return uuid.Nil, errors.New("reliable delivery is only available for remote receivers")
+	}
+	message := NewMessage(receiverID, command)
+	message.sender = c.ID
+	message.messageID, _ = uuid.NewV4()
+	data, err := message.Bytes()
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	c.outbox.Lock()
+	c.outbox.entries[message.messageID] = &outboxEntry{
+		Message:  data,
+		Created:  c.Now(),
+		lastSent: c.Now(),
+		message:  message,
+	}
+	c.outbox.save()
+	c.outbox.Unlock()
+
+	c.pub(message)
+	return message.messageID, nil
+}
+
+// Outbox returns the ids of the reliable messages waiting for an acknowledgement
+func (c *Controller) Outbox() []uuid.UUID {
+	c.outbox.Lock()
+	defer c.outbox.Unlock()
+	result := make([]uuid.UUID, 0, len(c.outbox.entries))
+	for id := range c.outbox.entries {
+		result = append(result, id)
+	}
+	return result
+}
+
+// retryOutbox sends again the messages not acknowledged within OutboxRetryInterval,
+// all of them if force is set, and drops the ones older than OutboxMaxAge
+func (c *Controller) retryOutbox(force bool) {
+	now := c.Now()
+	pending := make([]*Message, 0)
+	c.outbox.Lock()
+	changed := false
+	for id, entry := range c.outbox.entries {
+		if now.Sub(entry.Created) > OutboxMaxAge {
+			log.Warn().Str("message", id.String()).Msg("Reliable message expired without acknowledgement")
+			delete(c.outbox.entries, id)
+			changed = true
+			continue
+		}
+		if force || now.Sub(entry.lastSent) >= OutboxRetryInterval {
+			entry.lastSent = now
+			pending = append(pending, entry.message.Clone())
+		}
+	}
+	for id, at := range c.outbox.received {
+		if now.Sub(at) > dedupWindow {
+			delete(c.outbox.received, id)
+		}
+	}
+	if changed {
+		c.outbox.save()
+	}
+	c.outbox.Unlock()
+
+	for _, message := range pending {
+		c.pub(message)
+	}
+}
+
+// handleReliable processes acknowledgements and reliable messages coming from a remote,
+// it returns false if the message is a duplicate that must not be published again
+func (c *Controller) handleReliable(message *Message) bool {
+	if message.command.Type == types.AckCommandType {
+		var ack Ack
+		if err := json.Unmarshal(message.command.Data, &ack); err == nil {
+			c.outbox.Lock()
+			if _, ok := c.outbox.entries[ack.MessageID]; ok {
+				delete(c.outbox.entries, ack.MessageID)
+				c.outbox.save()
+			}
+			c.outbox.Unlock()
+		}
+		return true
+	}
+
+	// relays forward reliable messages for others without acknowledging them
+	if message.messageID == uuid.Nil || message.receiver != c.ID {
+		return true
+	}
+	c.Pub(types.NewCommand(types.AckCommandType, Ack{message.messageID}), message.sender)
+
+	c.outbox.Lock()
+	defer c.outbox.Unlock()
+	if _, duplicate := c.outbox.received[message.messageID]; duplicate {
+		return false
+	}
+	c.outbox.received[message.messageID] = c.Now()
+	return true
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/gochik/chik/types"
@@ -14,20 +15,66 @@ import (
 
 var logger = log.With().Str("component", "remote").Logger()
 
-// Remote represents a remote endpoint, data are sent via Controller.Pub() and received directly by the interested Handler
+// RemoteBufferSize is how many outgoing messages a remote queues,
+// eg: the ones published while it waits for the peer handshake (see HandshakeTimeout)
+const RemoteBufferSize = 1024
+
+// Cipher protects the messages exchanged with remote peers (see the e2e package).
+// Seal is applied to outgoing messages, Open to incoming ones: both return the message
+// unchanged when it does not need protection
+type Cipher interface {
+	Seal(message *Message) (*Message, error)
+	Open(message *Message) (*Message, error)
+}
+
+// Remote represents a remote endpoint, data are sent via Controller.Pub() and received directly by the interested Handler.
+// Both sides start by sending an Handshake, outgoing messages are held until the peer one is received.
+// A controller can run several remotes at once, each one sends the messages routed to it (see SetDefaultRoute)
 type Remote struct {
-	conn    net.Conn
-	timeout time.Duration
+	transport Transport
+	timeout   time.Duration
+	peer      peer
+	ready     chan struct{}
+	readyOnce sync.Once
+	cipher    Cipher
+
+	// local remotes never take the default route (see ListenUnix)
+	local bool
+
+	// id is the peer the remote claims to be connected to, guarded by the controller routes
+	id            uuid.UUID
+	authenticated bool
 }
 
-func (r Remote) send(ctx context.Context, controller *Controller) error {
+func (r *Remote) setReady() {
+	r.readyOnce.Do(func() { close(r.ready) })
+}
+
+func (r *Remote) write(message *Message) error {
+	return r.transport.WriteMessage(message, r.peer.Encoding(), r.timeout)
+}
+
+func (r *Remote) send(ctx context.Context, controller *Controller, out chan interface{}) error {
 	logger.Info().Msg("Sender started")
-	out := controller.Sub(types.AnyOutgoingCommandType.String(), types.RemoteStopCommandType.String())
 	defer func() {
 		controller.Unsub(out)
 		logger.Info().Msg("Sender terminated")
 	}()
 
+	handshake := NewMessage(uuid.Nil, types.NewCommand(types.HandshakeCommandType, newHandshake(controller)))
+	handshake.sender = controller.ID
+	if err := r.write(handshake); err != nil {
+		logger.Warn().Msgf("Cannot send handshake, exiting: %v", err)
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-r.ready:
+	case <-time.After(HandshakeTimeout):
+		logger.Warn().Msg("No handshake received, assuming a legacy peer")
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -40,20 +87,43 @@ func (r Remote) send(ctx context.Context, controller *Controller) error {
 				continue
 			}
 			if message.command.Type == types.RemoteStopCommandType {
+				// a loopback stop command concerns every remote, otherwise only the one connected to the receiver
+				if message.receiver != LoopbackID && !controller.routes.connected(message.receiver, r) {
+					continue
+				}
 				logger.Info().Msg("Stop command received. Terminating Sender")
 				return errors.New("Stop received")
 			}
+			if controller.routes.lookup(message.receiver) != r {
+				continue
+			}
 			if message.sender == uuid.Nil {
 				message.sender = controller.ID
 			}
-			logger.Debug().Msgf("Sending message: %v", message)
-			r.conn.SetWriteDeadline(time.Now().Add(r.timeout))
-			bytes, err := message.Bytes()
-			if err != nil {
-				logger.Warn().Msgf("Cannot encode message: %v", err)
+			// the content of sealed messages is translated too, only the receiving peer can do it after opening them
+			plain := message.command.Type
+			if message = r.toPeer(message); message == nil {
+				continue
 			}
-			_, err = r.conn.Write(bytes)
-			if err != nil {
+			if r.cipher != nil {
+				if message.command.Type == types.EncryptedCommandType && plain != types.EncryptedCommandType {
+					logger.Warn().Msgf("%v is numbered as an encrypted message by the peer, message dropped", plain)
+					continue
+				}
+				sealed, err := r.cipher.Seal(message)
+				if err != nil {
+					logger.Warn().Msgf("Cannot seal message, dropping it: %v", err)
+					continue
+				}
+				if sealed != message {
+					if sealed = r.toPeer(sealed); sealed == nil {
+						continue
+					}
+				}
+				message = sealed
+			}
+			logger.Debug().Msgf("Sending message: %v", message)
+			if err := r.write(message); err != nil {
 				logger.Warn().Msgf("Cannot write bytes, exiting: %v", err)
 				return err
 			}
@@ -61,7 +131,33 @@ func (r Remote) send(ctx context.Context, controller *Controller) error {
 	}
 }
 
-func (r Remote) receive(ctx context.Context, controller *Controller) error {
+// toPeer translates the command type of an outgoing message to the peer numbering,
+// nil is returned if the peer does not support it
+func (r *Remote) toPeer(message *Message) *Message {
+	commandType, supported := r.peer.outgoing(message.command.Type)
+	if !supported {
+		logger.Warn().Msgf("Peer does not support %v, message dropped", message.command.Type)
+		return nil
+	}
+	if commandType != message.command.Type {
+		message = message.Clone()
+		message.command.Type = commandType
+	}
+	return message
+}
+
+// fromPeer translates the command type of an incoming message to the local numbering, false if it must be dropped
+func (r *Remote) fromPeer(message *Message) bool {
+	commandType, known := r.peer.incoming(message.command.Type)
+	if !known {
+		logger.Warn().Msgf("Command type %v received has another meaning locally, message dropped", message.command.Type)
+		return false
+	}
+	message.command.Type = commandType
+	return true
+}
+
+func (r *Remote) receive(ctx context.Context, controller *Controller) error {
 	logger.Info().Msg("Receiver started")
 	defer logger.Info().Msg("Receiver terminated")
 
@@ -71,40 +167,111 @@ func (r Remote) receive(ctx context.Context, controller *Controller) error {
 			return nil
 
 		default:
-			if r.timeout != 0 {
-				r.conn.SetReadDeadline(time.Now().Add(r.timeout))
-			}
-			message, err := ParseMessage(r.conn)
+			// the peer may use what we advertised as soon as it reads our handshake, maybe before we read its one
+			message, err := r.transport.ReadMessage(advertisedEncoding, r.timeout)
 			if err != nil {
 				logger.Error().Msgf("Invalid message: %v", err)
 				return err
 			}
 			logger.Debug().Msgf("Message received: %v", message)
+			if handshake, ok := parseHandshake(message); ok {
+				if err := r.peer.agree(handshake); err != nil {
+					logger.Error().Msgf("Handshake refused: %v", err)
+					return err
+				}
+				logger.Info().
+					Str("peer", handshake.ID.String()).
+					Str("version", handshake.SoftwareVersion).
+					Interface("encoding", r.peer.Encoding()).
+					Msgf("Handshake completed, protocol %d.%d", handshake.ProtocolMajor, handshake.ProtocolMinor)
+				r.setReady()
+				if !controller.routes.connect(handshake.ID, r, controller.Authenticated(handshake.ID)) {
+					logger.Warn().Str("peer", handshake.ID.String()).Msg("Peer already connected through another remote, route not taken")
+				}
+				controller.PubMessage(message, types.HandshakeCommandType.String())
+				continue
+			}
+			// a first message that is not an handshake comes from a legacy peer
+			r.setReady()
+			if message.sender != uuid.Nil && message.sender != controller.ID {
+				authenticated := controller.Authenticated(message.sender)
+				if r.peer.Handshake() == nil {
+					controller.routes.connect(message.sender, r, authenticated)
+				} else {
+					controller.routes.learn(message.sender, r, authenticated)
+				}
+			}
+
+			if !r.fromPeer(message) {
+				continue
+			}
+			if r.cipher != nil {
+				sealed := message.command.Type == types.EncryptedCommandType
+				if message, err = r.cipher.Open(message); err != nil {
+					logger.Warn().Msgf("Cannot open message, dropping it: %v", err)
+					continue
+				}
+				// the sealed content is in the peer numbering as well
+				if sealed && !r.fromPeer(message) {
+					continue
+				}
+			}
+			if !controller.handleReliable(message) {
+				logger.Debug().Msgf("Duplicate message %v dropped", message.messageID)
+				continue
+			}
+			message.local = r.local
 			controller.PubMessage(message, types.AnyIncomingCommandType.String(), message.Command().Type.String())
 		}
 	}
 }
 
-// Start starts a new remote and returns a context and a cancel function to stop remote operations.
-// The returned context can also be closed by an error or a timeout in the send/receive routine
+// StartRemote starts a new remote on a stream connection (see StartRemoteTransport)
 func StartRemote(controller *Controller, conn net.Conn, readTimeout time.Duration) (context.Context, context.CancelFunc) {
-	remote := Remote{
-		conn:    conn,
-		timeout: readTimeout,
+	return StartRemoteTransport(controller, NewStreamTransport(conn), readTimeout)
+}
+
+// StartRemoteTransport starts a new remote and returns a context and a cancel function to stop remote operations.
+// The returned context can also be closed by an error or a timeout in the send/receive routine,
+// context.Cause returns the error that closed it
+func StartRemoteTransport(controller *Controller, transport Transport, readTimeout time.Duration) (context.Context, context.CancelFunc) {
+	return startRemote(controller, transport, readTimeout, false)
+}
+
+func startRemote(controller *Controller, transport Transport, readTimeout time.Duration, local bool) (context.Context, context.CancelFunc) {
+	remote := &Remote{
+		transport: transport,
+		timeout:   readTimeout,
+		ready:     make(chan struct{}),
+		cipher:    controller.cipher,
+		local:     local,
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancelCause(context.Background())
+	// subscribing before returning ensures that messages published afterwards are sent
+	options := SubscriptionOptions{Policy: DropNewest, BufferSize: RemoteBufferSize}
+	out := controller.SubWithOptions(options, types.AnyOutgoingCommandType.String(), types.RemoteStopCommandType.String())
+	controller.routes.add(remote)
 
 	go func() {
 		g, innerCtx := errgroup.WithContext(ctx)
 		// Send function
-		g.Go(func() error { return remote.send(innerCtx, controller) })
+		g.Go(func() error { return remote.send(innerCtx, controller, out) })
 		// Receive function
 		g.Go(func() error { return remote.receive(innerCtx, controller) })
-		g.Wait()
-		remote.conn.Close()
-		cancel()
+		// closing the connection unblocks the receiver when the sender stops
+		go func() {
+			<-innerCtx.Done()
+			remote.transport.Close()
+		}()
+		err := g.Wait()
+		remote.transport.Close()
+		controller.routes.remove(remote)
+		if err == nil {
+			err = context.Canceled
+		}
+		cancel(err)
 	}()
 
-	return ctx, cancel
+	return ctx, func() { cancel(context.Canceled) }
 }
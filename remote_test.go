@@ -1,10 +1,16 @@
 package chik
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"net"
+	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
 )
 
 var ctx context.Context
@@ -57,3 +63,301 @@ func TestInvalidRead(t *testing.T) {
 		})
 	}
 }
+
+func TestRemoteRequest(t *testing.T) {
+	testRoutine(t, func(c net.Conn, controller *Controller) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go controller.Start(ctx, []Handler{&echoHandler{}})
+
+		client := NewController()
+		client.ID, _ = uuid.NewV4()
+		remoteCtx, remoteCancel := StartRemote(client, c, MaxIdleTime)
+		defer remoteCancel()
+		time.Sleep(10 * time.Millisecond)
+
+		requestCtx, requestCancel := context.WithTimeout(remoteCtx, time.Second)
+		defer requestCancel()
+		reply, err := client.Request(requestCtx, types.NewCommand(types.VersionRequestCommandType, nil), controller.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.SenderUUID() != controller.ID {
+			t.Errorf("Unexpected reply sender: %v", reply.SenderUUID())
+		}
+	})
+}
+
+func writeHandshake(t *testing.T, c net.Conn, handshake Handshake) {
+	message := NewMessage(uuid.Nil, types.NewCommand(types.HandshakeCommandType, handshake))
+	message.sender = handshake.ID
+	data, _ := message.Bytes()
+	if _, err := c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	testRoutine(t, func(c net.Conn, controller *Controller) {
+		received, err := ParseMessage(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		local, ok := parseHandshake(received)
+		if !ok || local.ID != controller.ID || local.ProtocolMajor != ProtocolMajor {
+			t.Fatalf("Unexpected handshake: %v", received)
+		}
+
+		// the peer numbers digital commands differently and uses the number of analog ones for another type
+		handshake := newHandshake(controller)
+		handshake.ID = uuid.Must(uuid.NewV4())
+		handshake.CommandTypes = map[string]types.CommandType{
+			"HeartbeatType":      types.HeartbeatType,
+			"DigitalCommandType": 200,
+			"OtherCommandType":   types.AnalogCommandType,
+		}
+		writeHandshake(t, c, handshake)
+
+		digital := controller.Sub(types.DigitalCommandType.String())
+		message := NewMessage(controller.ID, digitalCommand("light"))
+		message.command.Type = 200
+		data, _ := message.Bytes()
+		c.Write(data)
+		select {
+		case <-digital:
+		case <-time.After(time.Second):
+			t.Fatal("Renumbered command not translated")
+		}
+
+		controller.Pub(types.NewCommand(types.AnalogCommandType, types.AnalogCommand{}), handshake.ID)
+		controller.Pub(digitalCommand("light"), handshake.ID)
+		received, err = ParseMessage(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received.Command().Type != 200 {
+			t.Fatalf("Unexpected message sent to peer: %v", received)
+		}
+
+		// types without a name keep their number, unless it means something else locally
+		incoming := controller.Sub(types.AnyIncomingCommandType.String())
+		for _, commandType := range []types.CommandType{types.AnalogCommandType, 230} {
+			message := NewMessage(controller.ID, types.NewCommand(commandType, nil))
+			data, _ := message.Bytes()
+			c.Write(data)
+		}
+		select {
+		case data := <-incoming:
+			if data.(*Message).Command().Type != 230 {
+				t.Fatalf("Unexpected message received: %v", data)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Unknown command type not received")
+		}
+		controller.Pub(types.NewCommand(230, nil), handshake.ID)
+		received, err = ParseMessage(c)
+		if err != nil || received.Command().Type != 230 {
+			t.Fatalf("Unknown command type not sent to peer: %v %v", received, err)
+		}
+	})
+}
+
+func TestHandshakeMajorMismatch(t *testing.T) {
+	testRoutine(t, func(c net.Conn, controller *Controller) {
+		handshake := newHandshake(controller)
+		handshake.ID = uuid.Must(uuid.NewV4())
+		handshake.ProtocolMajor = ProtocolMajor + 1
+		writeHandshake(t, c, handshake)
+		if !hasStopped() {
+			t.Error("Remote with a different protocol major version not refused")
+		}
+	})
+}
+
+func TestLegacyPeer(t *testing.T) {
+	testRoutine(t, func(c net.Conn, controller *Controller) {
+		if _, err := ParseMessage(c); err != nil {
+			t.Fatal(err)
+		}
+		digital := controller.Sub(types.DigitalCommandType.String())
+		data, _ := NewMessage(controller.ID, digitalCommand("light")).Bytes()
+		c.Write(data)
+		select {
+		case <-digital:
+		case <-time.After(time.Second):
+			t.Fatal("Legacy message not received")
+		}
+
+		peerID := uuid.Must(uuid.NewV4())
+		controller.Pub(digitalCommand("light"), peerID)
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		received, err := ParseMessage(c)
+		if err != nil || received.Command().Type != types.DigitalCommandType {
+			t.Fatalf("Message not sent to legacy peer: %v", err)
+		}
+	})
+}
+
+func TestReliableDelivery(t *testing.T) {
+	testRoutine(t, func(c net.Conn, controller *Controller) {
+		if _, err := ParseMessage(c); err != nil {
+			t.Fatal(err)
+		}
+		peerID := uuid.Must(uuid.NewV4())
+		handshake := newHandshake(controller)
+		handshake.ID = peerID
+		writeHandshake(t, c, handshake)
+
+		outbox := filepath.Join(t.TempDir(), "outbox")
+		if err := controller.SetOutbox(outbox); err != nil {
+			t.Fatal(err)
+		}
+		id, err := controller.PubReliable(digitalCommand("door"), peerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		sent, err := ParseMessage(c)
+		if err != nil || sent.MessageID() != id {
+			t.Fatalf("Reliable message not sent: %v %v", sent, err)
+		}
+
+		// the connection drops: the message is sent again by the next one
+		restarted := NewControllerWithID(controller.ID)
+		if err := restarted.SetOutbox(outbox); err != nil {
+			t.Fatal(err)
+		}
+		if pending := restarted.Outbox(); len(pending) != 1 || pending[0] != id {
+			t.Fatalf("Outbox not persisted: %v", pending)
+		}
+		out := restarted.Sub(types.AnyOutgoingCommandType.String())
+		restarted.retryOutbox(true)
+		resent := (<-out).(*Message)
+		if resent.MessageID() != id || resent.receiver != peerID {
+			t.Fatalf("Unexpected message sent again: %v", resent)
+		}
+
+		ack := NewMessageFrom(peerID, controller.ID, types.NewCommand(types.AckCommandType, Ack{id}))
+		data, _ := ack.Bytes()
+		c.Write(data)
+		deadline := time.Now().Add(time.Second)
+		for len(controller.Outbox()) > 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if len(controller.Outbox()) > 0 {
+			t.Fatal("Acknowledged message still in the outbox")
+		}
+	})
+}
+
+func TestReliableDeduplication(t *testing.T) {
+	testRoutine(t, func(c net.Conn, controller *Controller) {
+		if _, err := ParseMessage(c); err != nil {
+			t.Fatal(err)
+		}
+		peerID := uuid.Must(uuid.NewV4())
+		handshake := newHandshake(controller)
+		handshake.ID = peerID
+		writeHandshake(t, c, handshake)
+
+		digital := controller.Sub(types.DigitalCommandType.String())
+		message := NewMessageFrom(peerID, controller.ID, digitalCommand("door"))
+		message.messageID = uuid.Must(uuid.NewV4())
+		data, _ := message.Bytes()
+		for i := 0; i < 2; i++ {
+			c.Write(data)
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			ack, err := ParseMessage(c)
+			if err != nil || ack.Command().Type != types.AckCommandType || ack.receiver != peerID {
+				t.Fatalf("Message not acknowledged: %v %v", ack, err)
+			}
+		}
+
+		<-digital
+		select {
+		case duplicate := <-digital:
+			t.Fatalf("Duplicate message published: %v", duplicate)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
+
+// wrapCipher seals messages without encrypting them
+type wrapCipher struct{}
+
+func (wrapCipher) Seal(message *Message) (*Message, error) {
+	if message.command.Type == types.EncryptedCommandType || message.command.Type == types.HandshakeCommandType {
+		return message, nil
+	}
+	data, err := message.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return NewMessageFrom(message.sender, message.receiver, types.NewCommand(types.EncryptedCommandType, types.EncryptedCommand{Box: data})), nil
+}
+
+func (wrapCipher) Open(message *Message) (*Message, error) {
+	if message.command.Type != types.EncryptedCommandType {
+		return message, nil
+	}
+	var sealed types.EncryptedCommand
+	if err := json.Unmarshal(message.command.Data, &sealed); err != nil {
+		return nil, err
+	}
+	return ParseMessage(bytes.NewReader(sealed.Box))
+}
+
+func TestSealedTranslation(t *testing.T) {
+	srv, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	c, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := srv.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller := NewControllerWithID(uuid.Must(uuid.NewV4()))
+	controller.SetCipher(wrapCipher{})
+	_, cancel := StartRemote(controller, s, MaxIdleTime)
+	defer cancel()
+
+	if _, err := ParseMessage(c); err != nil {
+		t.Fatal(err)
+	}
+	handshake := newHandshake(controller)
+	handshake.ID = uuid.Must(uuid.NewV4())
+	handshake.CommandTypes = map[string]types.CommandType{
+		"HandshakeCommandType": types.HandshakeCommandType,
+		"EncryptedCommandType": types.EncryptedCommandType,
+		"DigitalCommandType":   200,
+	}
+	writeHandshake(t, c, handshake)
+
+	// the sealed content is in the peer numbering
+	controller.Pub(digitalCommand("light"), handshake.ID)
+	received, err := ParseMessage(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := wrapCipher{}.Open(received)
+	if err != nil || received.Command().Type != types.EncryptedCommandType || opened.Command().Type != 200 {
+		t.Fatalf("Unexpected sealed message: %v %v", opened, err)
+	}
+
+	digital := controller.Sub(types.DigitalCommandType.String())
+	sealed, _ := wrapCipher{}.Seal(opened)
+	sealed.receiver = controller.ID
+	data, _ := sealed.Bytes()
+	c.Write(data)
+	select {
+	case <-digital:
+	case <-time.After(time.Second):
+		t.Fatal("Sealed command not translated after opening")
+	}
+}
@@ -0,0 +1,153 @@
+package chik
+
+import (
+	"sync"
+
+	"github.com/gofrs/uuid"
+)
+
+// routes keeps track of the remotes connected to a controller.
+// Outgoing messages are sent to the remote of their receiver: the one it is directly connected to,
+// otherwise the one it has been seen sending from (eg: a relay). Any other message takes the default route
+type routes struct {
+	sync.RWMutex
+	remotes   []*Remote
+	direct    map[uuid.UUID]*Remote
+	learned   map[uuid.UUID]*Remote
+	preferred uuid.UUID
+}
+
+func (r *routes) add(remote *Remote) {
+	r.Lock()
+	defer r.Unlock()
+	r.remotes = append(r.remotes, remote)
+}
+
+func (r *routes) remove(remote *Remote) {
+	r.Lock()
+	defer r.Unlock()
+	for i, current := range r.remotes {
+		if current == remote {
+			r.remotes = append(r.remotes[:i], r.remotes[i+1:]...)
+			break
+		}
+	}
+	for id, current := range r.direct {
+		if current == remote {
+			delete(r.direct, id)
+			// eg: the peer reconnected before the old connection timed out
+			if claimant := r.claimant(id); claimant != nil {
+				r.direct[id] = claimant
+			}
+		}
+	}
+	for id, current := range r.learned {
+		if current == remote {
+			delete(r.learned, id)
+		}
+	}
+}
+
+// claimant returns the remote that claimed to be connected to the given peer, authenticated ones first.
+// The lock must be held
+func (r *routes) claimant(id uuid.UUID) *Remote {
+	var result *Remote
+	for _, remote := range r.remotes {
+		if remote.id == id && (result == nil || remote.authenticated && !result.authenticated) {
+			result = remote
+		}
+	}
+	return result
+}
+
+// connect records that the remote is directly connected to the given peer, false if the peer is bound to another remote.
+// Anyone can claim an id: only a remote authenticated as the peer replaces one that is not,
+// otherwise the first remote keeps the route until it stops
+func (r *routes) connect(id uuid.UUID, remote *Remote, authenticated bool) bool {
+	r.Lock()
+	defer r.Unlock()
+	remote.id, remote.authenticated = id, authenticated
+	if current, ok := r.direct[id]; ok && current != remote && (current.authenticated || !authenticated) {
+		return false
+	}
+	if r.direct == nil {
+		r.direct = make(map[uuid.UUID]*Remote)
+	}
+	r.direct[id] = remote
+	delete(r.learned, id)
+	return true
+}
+
+// connected tells whether the remote is directly connected to the given peer
+func (r *routes) connected(id uuid.UUID, remote *Remote) bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.direct[id] == remote
+}
+
+// learn records that messages from the given sender come through the remote.
+// A route is never learned for a directly connected peer, and it is replaced only by an authenticated sender
+func (r *routes) learn(sender uuid.UUID, remote *Remote, authenticated bool) {
+	r.RLock()
+	_, direct := r.direct[sender]
+	current, known := r.learned[sender]
+	r.RUnlock()
+	if direct || current == remote || known && !authenticated {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if r.learned == nil {
+		r.learned = make(map[uuid.UUID]*Remote)
+	}
+	r.learned[sender] = remote
+}
+
+// lookup returns the remote a message for the given receiver has to be sent to, nil if there are no remotes
+func (r *routes) lookup(receiver uuid.UUID) *Remote {
+	r.RLock()
+	defer r.RUnlock()
+	if remote, ok := r.direct[receiver]; ok {
+		return remote
+	}
+	if remote, ok := r.learned[receiver]; ok {
+		return remote
+	}
+	if remote, ok := r.direct[r.preferred]; ok && r.preferred != uuid.Nil {
+		return remote
+	}
+	for _, remote := range r.remotes {
+		if !remote.local {
+			return remote
+		}
+	}
+	return nil
+}
+
+func (r *routes) peers() []uuid.UUID {
+	r.RLock()
+	defer r.RUnlock()
+	result := make([]uuid.UUID, 0, len(r.direct))
+	for _, remote := range r.remotes {
+		for id, current := range r.direct {
+			if current == remote {
+				result = append(result, id)
+			}
+		}
+	}
+	return result
+}
+
+// SetDefaultRoute makes the remote connected to the given peer the default route.
+// Until that peer is connected, and with uuid.Nil, the default route is the oldest remote that is not local
+func (c *Controller) SetDefaultRoute(peer uuid.UUID) {
+	c.routes.Lock()
+	defer c.routes.Unlock()
+	c.routes.preferred = peer
+}
+
+// Peers returns the ids of the peers the controller is directly connected to, oldest connection first
+func (c *Controller) Peers() []uuid.UUID {
+	return c.routes.peers()
+}
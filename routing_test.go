@@ -0,0 +1,132 @@
+package chik
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+)
+
+type routingPeer struct {
+	controller *Controller
+	incoming   chan interface{}
+	remoteCtx  context.Context
+}
+
+func connectPeer(t *testing.T, hub *Controller) *routingPeer {
+	t.Helper()
+	return connectPeerAs(t, hub, uuid.Must(uuid.NewV4()))
+}
+
+func connectPeerAs(t *testing.T, hub *Controller, id uuid.UUID) *routingPeer {
+	t.Helper()
+	hubSide, peerSide := net.Pipe()
+	peer := &routingPeer{controller: NewControllerWithID(id)}
+	peer.incoming = peer.controller.Sub(types.AnyIncomingCommandType.String())
+	peer.remoteCtx, _ = StartRemote(peer.controller, peerSide, time.Second)
+	handshakes := hub.Sub(types.HandshakeCommandType.String())
+	defer hub.Unsub(handshakes)
+	StartRemote(hub, hubSide, time.Second)
+	select {
+	case <-handshakes:
+	case <-time.After(time.Second):
+		t.Fatal("Handshake not completed")
+	}
+	return peer
+}
+
+func expectIncoming(t *testing.T, peer *routingPeer, expected bool) *Message {
+	t.Helper()
+	select {
+	case data := <-peer.incoming:
+		if !expected {
+			t.Fatalf("Unexpected message %v", data)
+		}
+		return data.(*Message)
+	case <-time.After(100 * time.Millisecond):
+		if expected {
+			t.Fatal("Message not received")
+		}
+	}
+	return nil
+}
+
+func TestRouting(t *testing.T) {
+	hub := NewControllerWithID(uuid.Must(uuid.NewV4()))
+	first := connectPeer(t, hub)
+	second := connectPeer(t, hub)
+	if peers := hub.Peers(); len(peers) != 2 || peers[0] != first.controller.ID || peers[1] != second.controller.ID {
+		t.Fatalf("Unexpected peers: %v", peers)
+	}
+
+	t.Run("ByReceiver", func(t *testing.T) {
+		hub.Pub(types.NewCommand(types.VersionRequestCommandType, nil), second.controller.ID)
+		expectIncoming(t, second, true)
+		expectIncoming(t, first, false)
+	})
+
+	t.Run("DefaultRoute", func(t *testing.T) {
+		unknown := uuid.Must(uuid.NewV4())
+		hub.Pub(types.NewCommand(types.VersionRequestCommandType, nil), unknown)
+		expectIncoming(t, first, true)
+		expectIncoming(t, second, false)
+
+		hub.SetDefaultRoute(second.controller.ID)
+		defer hub.SetDefaultRoute(uuid.Nil)
+		hub.Pub(types.NewCommand(types.VersionRequestCommandType, nil), unknown)
+		expectIncoming(t, second, true)
+		expectIncoming(t, first, false)
+	})
+
+	t.Run("LearnedRoute", func(t *testing.T) {
+		// a peer behind the second one, eg: a client of a relay
+		behind := uuid.Must(uuid.NewV4())
+		message := NewMessageFrom(behind, hub.ID, types.NewCommand(types.HeartbeatType, nil))
+		second.controller.PubMessage(message, types.AnyOutgoingCommandType.String())
+		time.Sleep(50 * time.Millisecond)
+
+		hub.Pub(types.NewCommand(types.VersionRequestCommandType, nil), behind)
+		if received := expectIncoming(t, second, true); received.receiver != behind {
+			t.Errorf("Unexpected receiver: %v", received.receiver)
+		}
+		expectIncoming(t, first, false)
+	})
+
+	t.Run("ClaimedID", func(t *testing.T) {
+		// anyone can claim the id of a connected peer, or send on behalf of a learned one
+		impostor := connectPeerAs(t, hub, first.controller.ID)
+		behind := uuid.Must(uuid.NewV4())
+		message := NewMessageFrom(behind, hub.ID, types.NewCommand(types.HeartbeatType, nil))
+		second.controller.PubMessage(message, types.AnyOutgoingCommandType.String())
+		time.Sleep(50 * time.Millisecond)
+		message = NewMessageFrom(behind, hub.ID, types.NewCommand(types.HeartbeatType, nil))
+		impostor.controller.PubMessage(message, types.AnyOutgoingCommandType.String())
+		time.Sleep(50 * time.Millisecond)
+
+		hub.Pub(types.NewCommand(types.VersionRequestCommandType, nil), first.controller.ID)
+		expectIncoming(t, first, true)
+		hub.Pub(types.NewCommand(types.VersionRequestCommandType, nil), behind)
+		expectIncoming(t, second, true)
+		expectIncoming(t, impostor, false)
+	})
+
+	t.Run("StopOne", func(t *testing.T) {
+		hub.Pub(types.NewCommand(types.RemoteStopCommandType, nil), second.controller.ID)
+		select {
+		case <-second.remoteCtx.Done():
+		case <-time.After(time.Second):
+			t.Fatal("Remote not stopped")
+		}
+		waitFor(t, func() bool { return len(hub.Peers()) == 1 })
+		if first.remoteCtx.Err() != nil {
+			t.Fatal("Other remote stopped")
+		}
+
+		// messages for the disconnected peer take the default route
+		hub.Pub(types.NewCommand(types.VersionRequestCommandType, nil), second.controller.ID)
+		expectIncoming(t, first, true)
+	})
+}
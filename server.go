@@ -0,0 +1,286 @@
+package chik
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+	"golang.org/x/net/websocket"
+)
+
+// Server accepts remote connections serving each one with its own controller,
+// the handlers of every session share the same peers map (see the router handler)
+type Server struct {
+	// ID is the identity of the controllers serving the sessions
+	ID uuid.UUID
+
+	// Handlers creates the handlers of a new session
+	Handlers func(peers *sync.Map) []Handler
+
+	// Configure, if set, is called on the controller of a new session before it starts
+	Configure func(controller *Controller)
+
+	// TLS, if set, is used to secure the accepted connections
+	TLS *tls.Config
+
+	// Authenticate, if set, tells whether the peer of a session has proved to be the given one
+	// (see Controller.Authenticated). By default a peer is authenticated by a verified TLS client
+	// certificate whose common name, or URI "urn:uuid:<id>", is its id
+	Authenticate func(transport Transport, peer uuid.UUID) bool
+
+	// MaxConnections limits the number of concurrent sessions, 0 means no limit
+	MaxConnections int
+
+	// Timeout is the read timeout of the connections (see StartRemote)
+	Timeout time.Duration
+
+	// AllowedOrigins lists the origins, eg: "https://example.com", whose pages can open WebSocket sessions
+	// besides the pages of the server itself, "*" allows any origin
+	AllowedOrigins []string
+
+	// DrainTimeout is how long sessions are given to flush their messages on shutdown
+	DrainTimeout time.Duration
+
+	peers    sync.Map
+	mutex    sync.Mutex
+	sessions map[*session]struct{}
+	wg       sync.WaitGroup
+}
+
+type session struct {
+	controller *Controller
+	transport  Transport
+	remoteCtx  context.Context
+	cancel     context.CancelFunc
+	ended      chan struct{}
+}
+
+// NewServer creates a Server with the default settings
+func NewServer(id uuid.UUID, handlers func(peers *sync.Map) []Handler) *Server {
+	return &Server{
+		ID:           id,
+		Handlers:     handlers,
+		Timeout:      MaxIdleTime,
+		DrainTimeout: 5 * time.Second,
+		sessions:     make(map[*session]struct{}),
+	}
+}
+
+// Peers returns the map shared by the sessions handlers
+func (s *Server) Peers() *sync.Map {
+	return &s.peers
+}
+
+// Sessions returns the number of active sessions
+func (s *Server) Sessions() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.sessions)
+}
+
+// ListenAndServe listens on the given TCP address and serves the connections (see Serve)
+func (s *Server) ListenAndServe(ctx context.Context, address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, listener)
+}
+
+// Serve accepts connections on the listener until ctx is done or the listener is closed,
+// then it closes the listener and waits for every session to be drained.
+// Other accept errors are logged and retried after a growing delay
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	if s.TLS != nil {
+		listener = tls.NewListener(listener, s.TLS)
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				break
+			}
+			// eg: too many open files, retried like net/http does
+			delay = nextAcceptDelay(delay)
+			logger.Warn().Err(err).Msgf("Cannot accept connections, retrying in %v", delay)
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+			continue
+		}
+		delay = 0
+		if s.open(NewStreamTransport(conn)) == nil {
+			logger.Warn().Str("address", conn.RemoteAddr().String()).Msg("Connection limit reached, connection refused")
+			conn.Close()
+		}
+	}
+
+	s.Drain()
+	return nil
+}
+
+// nextAcceptDelay doubles the delay before accepting again, from 5ms up to 1s
+func nextAcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > time.Second {
+		return time.Second
+	}
+	return delay
+}
+
+// WebSocketHandler returns an http.Handler serving WebSocket connections as sessions.
+// These sessions are drained along with the others when Serve returns, call Drain otherwise
+func (s *Server) WebSocketHandler() http.Handler {
+	return websocket.Server{
+		Handshake: s.checkOrigin,
+		Handler: func(conn *websocket.Conn) {
+			transport := NewWebSocketTransport(conn)
+			current := s.open(transport)
+			if current == nil {
+				logger.Warn().Str("address", transport.RemoteAddr()).Msg("Connection limit reached, connection refused")
+				return
+			}
+			// the connection is closed as soon as the handler returns
+			<-current.ended
+		},
+	}
+}
+
+// checkOrigin refuses the WebSocket handshakes started by pages of other sites, unless their origin is allowed
+func (s *Server) checkOrigin(config *websocket.Config, request *http.Request) error {
+	origin, err := websocket.Origin(config, request)
+	if err != nil {
+		return err
+	}
+	// only browsers send an origin
+	if origin == nil || strings.EqualFold(origin.Host, request.Host) {
+		return nil
+	}
+	for _, allowed := range s.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin.Scheme+"://"+origin.Host) {
+			return nil
+		}
+	}
+	logger.Warn().Str("origin", origin.String()).Msg("WebSocket origin not allowed, connection refused")
+	return fmt.Errorf("origin %s not allowed", origin)
+}
+
+// certifiedPeer tells whether the verified client certificate of the transport has been issued to the peer
+func certifiedPeer(transport Transport, peer uuid.UUID) bool {
+	certificate := verifiedCertificate(transport)
+	if certificate == nil {
+		return false
+	}
+	if certificate.Subject.CommonName == peer.String() {
+		return true
+	}
+	for _, uri := range certificate.URIs {
+		if uri.String() == "urn:uuid:"+peer.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// open starts a session for the transport, nil if the connection limit is reached
+func (s *Server) open(transport Transport) *session {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.MaxConnections > 0 && len(s.sessions) >= s.MaxConnections {
+		return nil
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[*session]struct{})
+	}
+
+	// sessions outlive the Serve context so that they can be drained
+	sessionCtx, cancel := context.WithCancel(context.Background())
+	current := &session{
+		controller: NewControllerWithID(s.ID),
+		transport:  transport,
+		cancel:     cancel,
+		ended:      make(chan struct{}),
+	}
+	authenticate := s.Authenticate
+	if authenticate == nil {
+		authenticate = certifiedPeer
+	}
+	current.controller.authenticate = func(peer uuid.UUID) bool {
+		return authenticate(transport, peer)
+	}
+	if s.Configure != nil {
+		s.Configure(current.controller)
+	}
+	s.sessions[current] = struct{}{}
+	s.wg.Add(1)
+
+	done := make(chan struct{})
+	go func() {
+		if err := current.controller.Start(sessionCtx, s.Handlers(&s.peers)); err != nil {
+			logger.Error().Err(err).Str("address", transport.RemoteAddr()).Msg("Cannot start the session controller, closing the connection")
+			cancel()
+		}
+		close(done)
+	}()
+	var remoteCancel context.CancelFunc
+	current.remoteCtx, remoteCancel = StartRemoteTransport(current.controller, transport, s.Timeout)
+	logger.Info().Str("address", transport.RemoteAddr()).Msg("Session started")
+
+	go func() {
+		select {
+		case <-current.remoteCtx.Done():
+		case <-sessionCtx.Done():
+		}
+		remoteCancel()
+		transport.Close()
+		cancel()
+		<-done
+
+		s.mutex.Lock()
+		delete(s.sessions, current)
+		s.mutex.Unlock()
+		logger.Info().Str("address", transport.RemoteAddr()).Msg("Session terminated")
+		close(current.ended)
+		s.wg.Done()
+	}()
+	return current
+}
+
+// Drain asks every session to flush its messages and stop, waiting for all of them
+func (s *Server) Drain() {
+	s.mutex.Lock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for current := range s.sessions {
+		sessions = append(sessions, current)
+	}
+	s.mutex.Unlock()
+
+	for _, current := range sessions {
+		go func(current *session) {
+			current.controller.Pub(types.NewCommand(types.RemoteStopCommandType, nil), LoopbackID)
+			select {
+			case <-current.remoteCtx.Done():
+			case <-time.After(s.DrainTimeout):
+			}
+			current.cancel()
+		}(current)
+	}
+	s.wg.Wait()
+}
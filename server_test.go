@@ -0,0 +1,275 @@
+package chik
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+)
+
+// peerHandler registers the session into the peers map until it is torn down
+type peerHandler struct {
+	BaseHandler
+	peers *sync.Map
+	id    uuid.UUID
+}
+
+func (h *peerHandler) String() string {
+	return "peer"
+}
+
+func (h *peerHandler) Setup(controller *Controller) (Interrupts, error) {
+	h.id = uuid.Must(uuid.NewV4())
+	h.peers.Store(h.id, controller)
+	return Interrupts{Timer: NewEmptyTimer()}, nil
+}
+
+func (h *peerHandler) Teardown() {
+	h.peers.Delete(h.id)
+}
+
+func countPeers(peers *sync.Map) int {
+	count := 0
+	peers.Range(func(key, value interface{}) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(uuid.Must(uuid.NewV4()), func(peers *sync.Map) []Handler {
+		return []Handler{&peerHandler{peers: peers}, &echoHandler{}}
+	})
+	server.MaxConnections = 2
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- server.Serve(ctx, listener) }()
+
+	clients := make([]net.Conn, 0)
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		clients = append(clients, conn)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = ParseMessage(conn)
+		if i < 2 && err != nil {
+			t.Fatalf("Session %d not started: %v", i, err)
+		}
+		if i < 2 {
+			writeHandshake(t, conn, newHandshake(NewControllerWithID(uuid.Must(uuid.NewV4()))))
+		}
+		if i == 2 && err == nil {
+			t.Fatal("Connection over the limit accepted")
+		}
+	}
+	waitFor(t, func() bool { return countPeers(server.Peers()) == 2 })
+
+	// sessions are served by their controller
+	request := NewRequest(server.ID, types.NewCommand(types.VersionRequestCommandType, nil))
+	request.sender = uuid.Must(uuid.NewV4())
+	data, _ := request.Bytes()
+	clients[0].Write(data)
+	clients[0].SetReadDeadline(time.Now().Add(time.Second))
+	reply, err := ParseMessage(clients[0])
+	if err != nil || reply.ReplyTo() != request.RequestID() {
+		t.Fatalf("Request not served: %v %v", reply, err)
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * server.DrainTimeout):
+		t.Fatal("Server not drained")
+	}
+	if server.Sessions() != 0 || countPeers(server.Peers()) != 0 {
+		t.Fatalf("Sessions not terminated: %d sessions, %d peers", server.Sessions(), countPeers(server.Peers()))
+	}
+	for _, conn := range clients[:2] {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := ParseMessage(conn); err == nil {
+			t.Error("Connection still open after shutdown")
+		}
+	}
+}
+
+// flakyListener fails the first accepts like a process out of file descriptors
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, syscall.EMFILE
+	}
+	return l.Listener.Accept()
+}
+
+func TestServerErrors(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a zero Server works as well, its handlers cannot start
+	server := &Server{Handlers: func(peers *sync.Map) []Handler {
+		return []Handler{&echoHandler{}, &echoHandler{}}
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- server.Serve(ctx, &flakyListener{Listener: listener, failures: 3}) }()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for err == nil {
+		_, err = ParseMessage(conn)
+	}
+	if timeout, ok := err.(net.Error); ok && timeout.Timeout() {
+		t.Fatal("Connection not closed after the controller failed to start")
+	}
+	waitFor(t, func() bool { return server.Sessions() == 0 })
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Server not stopped")
+	}
+}
+
+// authHandler tells whether the senders of the messages are authenticated
+type authHandler struct {
+	BaseHandler
+	authenticated chan bool
+}
+
+func (h *authHandler) Topics() []types.CommandType {
+	return []types.CommandType{types.AnyIncomingCommandType}
+}
+
+func (h *authHandler) HandleMessage(message *Message, controller *Controller) error {
+	h.authenticated <- controller.Authenticated(message.SenderUUID())
+	return nil
+}
+
+// certificate creates a self signed certificate for the given common name
+func certificate(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, parsed
+}
+
+func TestCertifiedPeer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, serverParsed := certificate(t, "relay")
+	peer := uuid.Must(uuid.NewV4())
+	peerCert, peerParsed := certificate(t, peer.String())
+	clients := x509.NewCertPool()
+	clients.AddCert(peerParsed)
+	servers := x509.NewCertPool()
+	servers.AddCert(serverParsed)
+
+	handler := &authHandler{authenticated: make(chan bool, 10)}
+	server := NewServer(uuid.Must(uuid.NewV4()), func(peers *sync.Map) []Handler {
+		return []Handler{handler}
+	})
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clients,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Serve(ctx, listener)
+
+	for _, test := range []struct {
+		name          string
+		id            uuid.UUID
+		certificates  []tls.Certificate
+		authenticated bool
+	}{
+		{"certified", peer, []tls.Certificate{peerCert}, true},
+		{"certificate of another peer", uuid.Must(uuid.NewV4()), []tls.Certificate{peerCert}, false},
+		{"no certificate", peer, nil, false},
+	} {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: servers, Certificates: test.certificates})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := NewControllerWithID(test.id)
+		_, stop := StartRemote(client, conn, time.Second)
+		client.Pub(types.NewCommand(types.HeartbeatType, nil), server.ID)
+		select {
+		case authenticated := <-handler.authenticated:
+			if authenticated != test.authenticated {
+				t.Errorf("%s: authenticated %v", test.name, authenticated)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: message not received", test.name)
+		}
+		stop()
+	}
+}
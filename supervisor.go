@@ -0,0 +1,259 @@
+package chik
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gochik/chik/types"
+	"github.com/rs/zerolog/log"
+)
+
+// HandlerState is the lifecycle state of an handler
+type HandlerState string
+
+// Handler lifecycle states
+const (
+	HandlerStarting   HandlerState = "starting"
+	HandlerRunning    HandlerState = "running"
+	HandlerBackingOff HandlerState = "backing_off"
+	HandlerFailed     HandlerState = "failed"
+	HandlerStopped    HandlerState = "stopped"
+	// HandlerBlocked handlers wait for a dependency that failed before completing its setup
+	HandlerBlocked HandlerState = "blocked"
+)
+
+// HandlerHealth describes the current state of an handler.
+// The health of every handler is stored in the global status under the "handlers" key
+type HandlerHealth struct {
+	State     HandlerState `json:"state"`
+	LastError string       `json:"last_error,omitempty"`
+	Restarts  int          `json:"restarts"`
+	Dropped   uint64       `json:"dropped,omitempty"`
+}
+
+// RestartPolicy defines how a failing handler is restarted.
+// After a failure the handler is restarted waiting InitialBackoff, the wait time is multiplied
+// by Multiplier after every failure up to MaxBackoff.
+// If the handler fails more than MaxRestarts times within Window it is considered permanently failed
+// and it is not restarted anymore. A MaxRestarts of 0 means the handler is restarted forever
+type RestartPolicy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	MaxRestarts    int
+	Window         time.Duration
+}
+
+// DefaultRestartPolicy is the policy applied to handlers that do not have a specific one
+var DefaultRestartPolicy = RestartPolicy{
+	InitialBackoff: 1 * time.Second,
+	MaxBackoff:     5 * time.Minute,
+	Multiplier:     2,
+	MaxRestarts:    10,
+	Window:         10 * time.Minute,
+}
+
+// nextBackoff returns the time to wait before the restart following the one that waited current
+func (p RestartPolicy) nextBackoff(current time.Duration) time.Duration {
+	next := time.Duration(float64(current) * p.Multiplier)
+	if next < p.InitialBackoff {
+		next = p.InitialBackoff
+	}
+	if p.MaxBackoff > 0 && next > p.MaxBackoff {
+		next = p.MaxBackoff
+	}
+	return next
+}
+
+// supervisor keeps restart policies and health of the handlers run by a controller
+type supervisor struct {
+	sync.Mutex
+	policies map[string]RestartPolicy
+	health   map[string]HandlerHealth
+	// version counts the updates, publishing is set while one of them publishes the health
+	version    uint64
+	publishing bool
+}
+
+func newSupervisor() *supervisor {
+	return &supervisor{
+		policies: make(map[string]RestartPolicy),
+		health:   make(map[string]HandlerHealth),
+	}
+}
+
+func (s *supervisor) policy(handler string) RestartPolicy {
+	s.Lock()
+	defer s.Unlock()
+	if policy, ok := s.policies[handler]; ok {
+		return policy
+	}
+	return DefaultRestartPolicy
+}
+
+// update edits the health of the given handler and publishes the result on the global status.
+// The health is published after releasing the lock, since subscribers may use the supervisor:
+// while an update is publishing the others just record their changes, that it publishes next
+func (s *supervisor) update(controller *Controller, handler string, edit func(health *HandlerHealth)) {
+	s.Lock()
+	previous := s.health[handler]
+	health := previous
+	edit(&health)
+	if health == previous {
+		s.Unlock()
+		return
+	}
+	s.health[handler] = health
+	s.version++
+	if s.publishing {
+		s.Unlock()
+		return
+	}
+	s.publishing = true
+	for {
+		published := s.version
+		snapshot := make(map[string]HandlerHealth, len(s.health))
+		for k, v := range s.health {
+			snapshot[k] = v
+		}
+		s.Unlock()
+
+		controller.Pub(types.NewCommand(types.StatusUpdateCommandType, types.Status{"handlers": snapshot}), LoopbackID)
+
+		s.Lock()
+		if s.version == published {
+			s.publishing = false
+			s.Unlock()
+			return
+		}
+	}
+}
+
+// SetRestartPolicy sets the restart policy of the handler with the given name.
+// It needs to be called before Start
+func (c *Controller) SetRestartPolicy(handler string, policy RestartPolicy) {
+	c.supervisor.Lock()
+	c.supervisor.policies[handler] = policy
+	c.supervisor.Unlock()
+}
+
+// HandlersHealth returns the current health of every handler
+func (c *Controller) HandlersHealth() map[string]HandlerHealth {
+	c.supervisor.Lock()
+	defer c.supervisor.Unlock()
+	result := make(map[string]HandlerHealth, len(c.supervisor.health))
+	for k, v := range c.supervisor.health {
+		result[k] = v
+	}
+	return result
+}
+
+// HandlerInfo describes an handler registered on the controller
+type HandlerInfo struct {
+	Name         string        `json:"name"`
+	Topics       []string      `json:"topics"`
+	Dependencies []string      `json:"dependencies"`
+	Health       HandlerHealth `json:"health"`
+}
+
+// Handlers returns the description of every handler given to Start, in the order they are started
+func (c *Controller) Handlers() []HandlerInfo {
+	c.lifecycle.Lock()
+	nodes := c.nodes
+	c.lifecycle.Unlock()
+
+	health := c.HandlersHealth()
+	result := make([]HandlerInfo, 0, len(nodes))
+	for _, node := range nodes {
+		topics := make([]string, 0)
+		for _, topic := range node.handler.Topics() {
+			topics = append(topics, topic.String())
+		}
+		result = append(result, HandlerInfo{
+			Name:         node.String(),
+			Topics:       topics,
+			Dependencies: node.handler.Dependencies(),
+			Health:       health[node.String()],
+		})
+	}
+	return result
+}
+
+func (c *Controller) findNode(name string) (*handlerNode, error) {
+	for _, node := range c.nodes {
+		if node.String() == name {
+			return node, nil
+		}
+	}
+	return nil, fmt.Errorf("handler %q is not registered", name)
+}
+
+// StopHandler tears down the handler with the given name and waits for it to be stopped.
+// Handlers depending on it keep running
+func (c *Controller) StopHandler(name string) error {
+	c.lifecycle.Lock()
+	node, err := c.findNode(name)
+	if err != nil {
+		c.lifecycle.Unlock()
+		return err
+	}
+	node.Lock()
+	running := node.running
+	if running {
+		node.cancel()
+	}
+	stopped := node.stopped
+	node.Unlock()
+	c.lifecycle.Unlock()
+
+	if !running {
+		return fmt.Errorf("handler %q is not running", name)
+	}
+	log.Info().Str("handler", name).Msg("Handler stop requested")
+	<-stopped
+	return nil
+}
+
+// StartHandler starts again an handler that has been stopped or that permanently failed,
+// its restart budget is reset
+func (c *Controller) StartHandler(name string) error {
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+	if c.ctx == nil || c.stopping {
+		return errors.New("controller is not running")
+	}
+	node, err := c.findNode(name)
+	if err != nil {
+		return err
+	}
+	node.Lock()
+	running := node.running
+	node.Unlock()
+	if running {
+		return fmt.Errorf("handler %q is already running", name)
+	}
+	log.Info().Str("handler", name).Msg("Handler start requested")
+	c.launch(node)
+	return nil
+}
+
+// RestartHandler stops the handler with the given name, if it is running, and starts it again
+func (c *Controller) RestartHandler(name string) error {
+	c.lifecycle.Lock()
+	node, err := c.findNode(name)
+	c.lifecycle.Unlock()
+	if err != nil {
+		return err
+	}
+	node.Lock()
+	running := node.running
+	node.Unlock()
+	if running {
+		if err := c.StopHandler(name); err != nil {
+			return err
+		}
+	}
+	return c.StartHandler(name)
+}
@@ -0,0 +1,115 @@
+package chik
+
+import (
+	"time"
+)
+
+// Schedule defines when a Timer fires
+type Schedule interface {
+	// Next returns the first firing time strictly after the given one, a zero time means never
+	Next(after time.Time) time.Time
+}
+
+// every is a Schedule firing at a fixed interval
+type every time.Duration
+
+func (i every) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(i))
+}
+
+// Timer describes when an handler needs to be woken up, it starts when the handler setup completes
+type Timer struct {
+	triggerAtStart bool
+	schedule       Schedule
+}
+
+// NewTimer creates a new timer given an interval and the option to fire when started
+func NewTimer(interval time.Duration, triggerAtStart bool) Timer {
+	if interval <= 0 {
+		panic("non-positive interval for NewTimer")
+	}
+	return NewScheduleTimer(every(interval), triggerAtStart)
+}
+
+// NewStartupActionTimer creates a timer that fires only at start and then never triggers again
+func NewStartupActionTimer() Timer {
+	return Timer{
+		triggerAtStart: true,
+	}
+}
+
+// NewEmptyTimer creates a timer that does never fire
+func NewEmptyTimer() Timer {
+	return Timer{}
+}
+
+// NewCronTimer creates a timer firing as defined by a cron expression (see ParseCron)
+func NewCronTimer(expression string, triggerAtStart bool) (Timer, error) {
+	schedule, err := ParseCron(expression)
+	if err != nil {
+		return Timer{}, err
+	}
+	return NewScheduleTimer(schedule, triggerAtStart), nil
+}
+
+// NewScheduleTimer creates a timer firing as defined by the given schedule
+func NewScheduleTimer(schedule Schedule, triggerAtStart bool) Timer {
+	return Timer{
+		triggerAtStart: triggerAtStart,
+		schedule:       schedule,
+	}
+}
+
+// Interrupts are the sources of events for an handler other than messages.
+// The events of Timer and of the named Timers are handled by HandleTimerEvent,
+// that gets the name of the timer that fired
+type Interrupts struct {
+	Timer  Timer
+	Timers map[string]Timer
+	Event  <-chan interface{}
+}
+
+// timerEvent is emitted when a timer fires, name is empty for Interrupts.Timer
+type timerEvent struct {
+	name string
+	tick time.Time
+}
+
+// run sends an event on ticks every time the timer fires until stop is closed.
+// The first timer is armed before returning, ticks missed because the receiver is busy
+// are dropped, as it happens with time.Ticker
+func (t Timer) run(clock Clock, name string, ticks chan<- timerEvent, stop <-chan struct{}) {
+	if t.schedule == nil {
+		return
+	}
+	next := t.schedule.Next(clock.Now())
+	if next.IsZero() {
+		return
+	}
+	timer := clock.NewTimer(next.Sub(clock.Now()))
+	go func() {
+		for {
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+
+			case tick := <-timer.C():
+				select {
+				case ticks <- timerEvent{name, tick}:
+				case <-stop:
+					return
+				}
+			}
+
+			now := clock.Now()
+			for !next.IsZero() && !next.After(now) {
+				next = t.schedule.Next(next)
+			}
+			if next.IsZero() {
+				return
+			}
+			timer = clock.NewTimer(next.Sub(now))
+		}
+	}()
+}
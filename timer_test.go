@@ -0,0 +1,55 @@
+package chik
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type timersHandler struct {
+	BaseHandler
+	fired chan string
+}
+
+func (h *timersHandler) Setup(controller *Controller) (Interrupts, error) {
+	return Interrupts{
+		Timer: NewTimer(20*time.Millisecond, false),
+		Timers: map[string]Timer{
+			"startup": NewStartupActionTimer(),
+			"fast":    NewTimer(5*time.Millisecond, false),
+		},
+	}, nil
+}
+
+func (h *timersHandler) HandleTimerEvent(name string, tick time.Time, controller *Controller) error {
+	if name == "" {
+		name = "main"
+	}
+	h.fired <- name
+	return nil
+}
+
+func TestNamedTimers(t *testing.T) {
+	handler := &timersHandler{fired: make(chan string)}
+	cont := NewController()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cont.Start(ctx, []Handler{handler})
+
+	if name := <-handler.fired; name != "startup" {
+		t.Fatalf("Expecting the startup timer first, got %s", name)
+	}
+	counts := make(map[string]int)
+	timeout := time.After(time.Second)
+	for counts["main"] < 2 {
+		select {
+		case name := <-handler.fired:
+			counts[name]++
+		case <-timeout:
+			t.Fatalf("Timers did not fire: %v", counts)
+		}
+	}
+	if counts["fast"] <= counts["main"] || counts["startup"] != 0 {
+		t.Errorf("Unexpected timer events: %v", counts)
+	}
+}
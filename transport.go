@@ -0,0 +1,173 @@
+package chik
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Transport carries messages between a Remote and its peer.
+// Messages read are refused unless their content is JSON or uses the given encoding.
+// A zero timeout means no deadline
+type Transport interface {
+	ReadMessage(encoding Encoding, timeout time.Duration) (*Message, error)
+	WriteMessage(message *Message, encoding Encoding, timeout time.Duration) error
+	RemoteAddr() string
+	Close() error
+}
+
+type streamTransport struct {
+	conn net.Conn
+}
+
+// NewStreamTransport creates a Transport that frames messages on a stream connection
+// prefixing each one with its length
+func NewStreamTransport(conn net.Conn) Transport {
+	return &streamTransport{conn}
+}
+
+func (t *streamTransport) ReadMessage(encoding Encoding, timeout time.Duration) (*Message, error) {
+	if timeout != 0 {
+		t.conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	return parseMessage(t.conn, encoding)
+}
+
+func (t *streamTransport) WriteMessage(message *Message, encoding Encoding, timeout time.Duration) error {
+	if timeout != 0 {
+		t.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	data, err := message.Encode(encoding)
+	if err != nil {
+		logger.Warn().Msgf("Cannot encode message, dropping it: %v", err)
+		return nil
+	}
+	_, err = t.conn.Write(data)
+	return err
+}
+
+func (t *streamTransport) RemoteAddr() string {
+	return t.conn.RemoteAddr().String()
+}
+
+func (t *streamTransport) Close() error {
+	return t.conn.Close()
+}
+
+type webSocketTransport struct {
+	conn *websocket.Conn
+}
+
+// NewWebSocketTransport creates a Transport that sends every message in its own binary frame.
+// Frames hold the message without the length prefix: [16 bytes sender][16 bytes receiver][content]
+func NewWebSocketTransport(conn *websocket.Conn) Transport {
+	conn.PayloadType = websocket.BinaryFrame
+	conn.MaxPayloadBytes = MaxMessageSize
+	return &webSocketTransport{conn}
+}
+
+// DialWebSocket opens a WebSocket transport to the given ws:// or wss:// url, tlsConfig can be nil.
+// Both the connection and the handshake are aborted when ctx is done
+func DialWebSocket(ctx context.Context, url string, origin string, tlsConfig *tls.Config) (Transport, error) {
+	config, err := websocket.NewConfig(url, origin)
+	if err != nil {
+		return nil, err
+	}
+	address := config.Location.Host
+	if config.Location.Port() == "" {
+		address = net.JoinHostPort(config.Location.Hostname(), map[string]string{"ws": "80", "wss": "443"}[config.Location.Scheme])
+	}
+
+	var conn net.Conn
+	if config.Location.Scheme == "wss" {
+		dialer := tls.Dialer{Config: tlsConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	} else {
+		dialer := net.Dialer{}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	handshaken := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshaken:
+		}
+	}()
+	ws, err := websocket.NewClient(config, conn)
+	close(handshaken)
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return NewWebSocketTransport(ws), nil
+}
+
+func (t *webSocketTransport) ReadMessage(encoding Encoding, timeout time.Duration) (*Message, error) {
+	if timeout != 0 {
+		t.conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	var frame []byte
+	if err := websocket.Message.Receive(t.conn, &frame); err != nil {
+		return nil, err
+	}
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(frame)))
+	return parseMessage(bytes.NewReader(append(length, frame...)), encoding)
+}
+
+func (t *webSocketTransport) WriteMessage(message *Message, encoding Encoding, timeout time.Duration) error {
+	if timeout != 0 {
+		t.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	data, err := message.Encode(encoding)
+	if err != nil {
+		logger.Warn().Msgf("Cannot encode message, dropping it: %v", err)
+		return nil
+	}
+	return websocket.Message.Send(t.conn, data[4:])
+}
+
+// RemoteAddr returns the address of the client on the server side, the url of the server otherwise
+func (t *webSocketTransport) RemoteAddr() string {
+	if request := t.conn.Request(); request != nil {
+		return request.RemoteAddr
+	}
+	return t.conn.RemoteAddr().String()
+}
+
+func (t *webSocketTransport) Close() error {
+	return t.conn.Close()
+}
+
+// verifiedCertificate returns the client certificate of the transport peer, nil unless it has been verified
+func verifiedCertificate(transport Transport) *x509.Certificate {
+	var chains [][]*x509.Certificate
+	switch current := transport.(type) {
+	case *streamTransport:
+		if conn, ok := current.conn.(*tls.Conn); ok {
+			chains = conn.ConnectionState().VerifiedChains
+		}
+	case *webSocketTransport:
+		if request := current.conn.Request(); request != nil && request.TLS != nil {
+			chains = request.TLS.VerifiedChains
+		}
+	}
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+	return chains[0][0]
+}
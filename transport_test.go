@@ -0,0 +1,104 @@
+package chik
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gochik/chik/types"
+	"github.com/gofrs/uuid"
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocketFraming(t *testing.T) {
+	server := NewServer(uuid.Must(uuid.NewV4()), func(peers *sync.Map) []Handler { return []Handler{} })
+	httpServer := httptest.NewServer(server.WebSocketHandler())
+	defer httpServer.Close()
+	defer server.Drain()
+
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+	conn, err := websocket.Dial(url, "", httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the handshake comes in a single binary frame without length prefix
+	var frame []byte
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err := websocket.Message.Receive(conn, &frame); err != nil {
+		t.Fatal(err)
+	}
+	if len(frame) < 32 || !bytes.Equal(frame[:16], server.ID.Bytes()) {
+		t.Fatalf("Unexpected frame: %v", frame)
+	}
+}
+
+func TestWebSocketRemote(t *testing.T) {
+	server := NewServer(uuid.Must(uuid.NewV4()), func(peers *sync.Map) []Handler {
+		return []Handler{&peerHandler{peers: peers}, &echoHandler{}}
+	})
+	httpServer := httptest.NewServer(server.WebSocketHandler())
+	defer httpServer.Close()
+
+	client := NewControllerWithID(uuid.Must(uuid.NewV4()))
+	states := client.Sub(types.ConnectionStateCommandType.String())
+	dialer := NewDialer("ws" + strings.TrimPrefix(httpServer.URL, "http"))
+	dialer.Heartbeat = ""
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dialer.Run(ctx, client)
+
+	expectState(t, states, types.Connecting)
+	expectState(t, states, types.Connected)
+	waitFor(t, func() bool { return countPeers(server.Peers()) == 1 })
+
+	requestCtx, requestCancel := context.WithTimeout(ctx, time.Second)
+	defer requestCancel()
+	reply, err := client.Request(requestCtx, types.NewCommand(types.VersionRequestCommandType, nil), server.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.SenderUUID() != server.ID {
+		t.Errorf("Unexpected reply sender: %v", reply.SenderUUID())
+	}
+
+	server.Drain()
+	expectState(t, states, types.Disconnected)
+	if server.Sessions() != 0 || countPeers(server.Peers()) != 0 {
+		t.Fatalf("Sessions not terminated: %d sessions, %d peers", server.Sessions(), countPeers(server.Peers()))
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	server := NewServer(uuid.Must(uuid.NewV4()), func(peers *sync.Map) []Handler { return []Handler{} })
+	httpServer := httptest.NewServer(server.WebSocketHandler())
+	defer httpServer.Close()
+	defer server.Drain()
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+
+	for _, test := range []struct {
+		origin  string
+		allowed []string
+		ok      bool
+	}{
+		{httpServer.URL, nil, true},
+		{"https://evil.example", nil, false},
+		{"https://app.example", []string{"https://app.example/"}, true},
+		{"https://evil.example", []string{"https://app.example"}, false},
+		{"https://evil.example", []string{"*"}, true},
+	} {
+		server.AllowedOrigins = test.allowed
+		conn, err := websocket.Dial(url, "", test.origin)
+		if (err == nil) != test.ok {
+			t.Errorf("Origin %s with %v: unexpected result %v", test.origin, test.allowed, err)
+		}
+		if err == nil {
+			conn.Close()
+		}
+	}
+}
@@ -1,11 +1,11 @@
-//go:generate stringer -type=CommandType
-
 package types
 
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
+	"github.com/gofrs/uuid"
 	"github.com/rs/zerolog/log"
 )
 
@@ -13,7 +13,8 @@ import (
 // used as binary flag
 type EnabledDays uint16
 
-// CommandType represent the type of the current message
+// CommandType represent the type of the current message.
+// Types defined outside of this package are added with RegisterCommandType
 type CommandType uint8
 
 // Command types types used in various plugins
@@ -51,6 +52,36 @@ const (
 	AnyOutgoingCommandType
 	RemoteStopCommandType
 
+	// Handlers management
+	HandlerRequestCommandType
+	HandlerReplyCommandType
+
+	// Error reported to the sender of a rejected command
+	ErrorReplyCommandType
+
+	// First message sent on a remote connection, its value must never change
+	HandshakeCommandType
+
+	// End to end encrypted command, only the endpoints can read its content
+	EncryptedCommandType
+
+	// Acknowledgement of a reliable message
+	AckCommandType
+
+	// Connection state changes, published on the loopback address
+	ConnectionStateCommandType
+
+	// Presence of the peers connected to a relay: requests and notifications
+	PresenceRequestCommandType
+	PresenceCommandType
+
+	// Pairings between the peers of a relay: requests, replies and notifications
+	PairingRequestCommandType
+	PairingCommandType
+
+	// Delivery of a message queued by a relay for an offline receiver
+	DeliveryReportCommandType
+
 	messageBound
 )
 
@@ -121,6 +152,99 @@ type AnalogCommand struct {
 // value can be anything
 type Status map[string]interface{}
 
+// ErrorReply is sent back to the sender of a command that has not been executed
+type ErrorReply struct {
+	Type  CommandType `json:"type"`
+	Error string      `json:"error"`
+}
+
+// EncryptedCommand carries a sealed message between two endpoints
+type EncryptedCommand struct {
+	Nonce []byte `json:"nonce"`
+	Box   []byte `json:"box"`
+}
+
+// Connection states
+const (
+	Connecting   = "connecting"
+	Connected    = "connected"
+	Disconnected = "disconnected"
+)
+
+// ConnectionState notifies a change in the connection to a remote,
+// Reason explains why the connection has been lost or could not be established
+type ConnectionState struct {
+	State   string `json:"state"`
+	Address string `json:"address"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// PresenceRequest is sent to a relay: SET subscribes to the presence of the given peers,
+// RESET unsubscribes and GET queries it. A GET without peers lists the online ones.
+// The relay replies with a PresenceCommandType containing a list of Presence
+type PresenceRequest struct {
+	Action Action      `json:"action"`
+	Peers  []uuid.UUID `json:"peers,omitempty"`
+}
+
+// Presence tells whether a peer is connected to the relay and since when, Since is zero for peers never seen
+type Presence struct {
+	ID     uuid.UUID `json:"id"`
+	Online bool      `json:"online"`
+	Since  time.Time `json:"since"`
+}
+
+// PairingRequest is sent to a relay to manage the pairings of the sender: SET without a Code creates
+// a one-time pairing code, SET with a Code pairs the sender with the peer that created it,
+// GET with a Code returns that peer without using the code, GET without lists the pairings
+// and RESET revokes the one with Peer.
+// PublicKey is the optional end to end encryption key of the sender, handed over to its paired peers
+// along with Proof, that binds it to the pairing code (see the e2e package).
+// The relay replies with a PairingCommandType containing a Pairing
+type PairingRequest struct {
+	Action    Action    `json:"action"`
+	Code      string    `json:"code,omitempty"`
+	Peer      uuid.UUID `json:"peer,omitempty"`
+	PublicKey string    `json:"public_key,omitempty"`
+	Proof     string    `json:"proof,omitempty"`
+}
+
+// PairedPeer is a peer paired with the receiver of a Pairing, Proof is set when it has just
+// redeemed a pairing code of the receiver
+type PairedPeer struct {
+	ID        uuid.UUID `json:"id"`
+	PublicKey string    `json:"public_key,omitempty"`
+	Proof     string    `json:"proof,omitempty"`
+}
+
+// Pairing carries a newly created pairing code, the paired peers or the revoked ones.
+// It is also sent to a peer when it gets paired or unpaired by another one
+type Pairing struct {
+	Code    string       `json:"code,omitempty"`
+	Expires time.Time    `json:"expires,omitempty"`
+	Paired  []PairedPeer `json:"paired,omitempty"`
+	Revoked []uuid.UUID  `json:"revoked,omitempty"`
+}
+
+// Delivery states of a message queued by a relay
+const (
+	Queued    = "queued"
+	Delivered = "delivered"
+	Expired   = "expired"
+	Dropped   = "dropped"
+)
+
+// DeliveryReport is sent by a relay to the sender of a message addressed to an offline peer:
+// the message is queued, then delivered when the peer reconnects, or expired or dropped.
+// MessageID and RequestID identify reliable messages and requests
+type DeliveryReport struct {
+	Receiver  uuid.UUID   `json:"receiver"`
+	Type      CommandType `json:"type"`
+	MessageID uuid.UUID   `json:"message_id,omitempty"`
+	RequestID uuid.UUID   `json:"request_id,omitempty"`
+	State     string      `json:"state"`
+}
+
 // VersionIndication returns info about the current version and the optional update available
 type VersionIndication struct {
 	CurrentVersion   string
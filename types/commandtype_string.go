@@ -1,43 +0,0 @@
-// Code generated by "stringer -type=CommandType"; DO NOT EDIT.
-
-package types
-
-import "strconv"
-
-func _() {
-	// An "invalid array index" compiler error signifies that the constant values have changed.
-	// Re-run the stringer command to generate them again.
-	var x [1]struct{}
-	_ = x[HeartbeatType-0]
-	_ = x[DigitalCommandType-1]
-	_ = x[AnalogCommandType-2]
-	_ = x[StatusCommandType-3]
-	_ = x[StatusNotificationCommandType-4]
-	_ = x[VersionRequestCommandType-5]
-	_ = x[VersionReplyCommandType-6]
-	_ = x[ActionRequestCommandType-7]
-	_ = x[ActionReplyCommandType-8]
-	_ = x[StatusUpdateCommandType-9]
-	_ = x[NullCommandType-10]
-	_ = x[TelegramNotificationCommandType-11]
-	_ = x[SystemdRequestCommandType-12]
-	_ = x[SystemdReplyCommandType-13]
-	_ = x[SnapcastManagerCommandType-14]
-	_ = x[SnapcastClientCommandType-15]
-	_ = x[SnapcastGroupCommandType-16]
-	_ = x[AnyIncomingCommandType-17]
-	_ = x[AnyOutgoingCommandType-18]
-	_ = x[RemoteStopCommandType-19]
-	_ = x[messageBound-20]
-}
-
-const _CommandType_name = "HeartbeatTypeDigitalCommandTypeAnalogCommandTypeStatusCommandTypeStatusNotificationCommandTypeVersionRequestCommandTypeVersionReplyCommandTypeActionRequestCommandTypeActionReplyCommandTypeStatusUpdateCommandTypeNullCommandTypeTelegramNotificationCommandTypeSystemdRequestCommandTypeSystemdReplyCommandTypeSnapcastManagerCommandTypeSnapcastClientCommandTypeSnapcastGroupCommandTypeAnyIncomingCommandTypeAnyOutgoingCommandTypeRemoteStopCommandTypemessageBound"
-
-var _CommandType_index = [...]uint16{0, 13, 31, 48, 65, 94, 119, 142, 166, 188, 211, 226, 257, 282, 305, 331, 356, 380, 402, 424, 445, 457}
-
-func (i CommandType) String() string {
-	if i >= CommandType(len(_CommandType_index)-1) {
-		return "CommandType(" + strconv.FormatInt(int64(i), 10) + ")"
-	}
-	return _CommandType_name[_CommandType_index[i]:_CommandType_index[i+1]]
-}
@@ -0,0 +1,181 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// FirstCustomCommandType is the lowest id available to command types registered outside of chik,
+// lower ids are reserved for built-in command types
+const FirstCustomCommandType CommandType = 128
+
+// CommandTypeInfo describes a command type
+type CommandTypeInfo struct {
+	ID   CommandType
+	Name string
+	// Payload is the type of the command data, nil if unknown
+	Payload reflect.Type
+}
+
+var commandTypes = struct {
+	sync.RWMutex
+	byID   map[CommandType]CommandTypeInfo
+	byName map[string]CommandType
+}{
+	byID:   make(map[CommandType]CommandTypeInfo),
+	byName: make(map[string]CommandType),
+}
+
+var builtinCommandTypes = map[CommandType]string{
+	HeartbeatType:                   "HeartbeatType",
+	DigitalCommandType:              "DigitalCommandType",
+	AnalogCommandType:               "AnalogCommandType",
+	StatusCommandType:               "StatusCommandType",
+	StatusNotificationCommandType:   "StatusNotificationCommandType",
+	VersionRequestCommandType:       "VersionRequestCommandType",
+	VersionReplyCommandType:         "VersionReplyCommandType",
+	ActionRequestCommandType:        "ActionRequestCommandType",
+	ActionReplyCommandType:          "ActionReplyCommandType",
+	StatusUpdateCommandType:         "StatusUpdateCommandType",
+	NullCommandType:                 "NullCommandType",
+	TelegramNotificationCommandType: "TelegramNotificationCommandType",
+	SystemdRequestCommandType:       "SystemdRequestCommandType",
+	SystemdReplyCommandType:         "SystemdReplyCommandType",
+	SnapcastManagerCommandType:      "SnapcastManagerCommandType",
+	SnapcastClientCommandType:       "SnapcastClientCommandType",
+	SnapcastGroupCommandType:        "SnapcastGroupCommandType",
+	AnyIncomingCommandType:          "AnyIncomingCommandType",
+	AnyOutgoingCommandType:          "AnyOutgoingCommandType",
+	RemoteStopCommandType:           "RemoteStopCommandType",
+	HandlerRequestCommandType:       "HandlerRequestCommandType",
+	HandlerReplyCommandType:         "HandlerReplyCommandType",
+	ErrorReplyCommandType:           "ErrorReplyCommandType",
+	HandshakeCommandType:            "HandshakeCommandType",
+	EncryptedCommandType:            "EncryptedCommandType",
+	AckCommandType:                  "AckCommandType",
+	ConnectionStateCommandType:      "ConnectionStateCommandType",
+	PresenceRequestCommandType:      "PresenceRequestCommandType",
+	PresenceCommandType:             "PresenceCommandType",
+	PairingRequestCommandType:       "PairingRequestCommandType",
+	PairingCommandType:              "PairingCommandType",
+	DeliveryReportCommandType:       "DeliveryReportCommandType",
+}
+
+var builtinPayloads = map[CommandType]interface{}{
+	DigitalCommandType:            DigitalCommand{},
+	AnalogCommandType:             AnalogCommand{},
+	StatusNotificationCommandType: Status{},
+	StatusUpdateCommandType:       Status{},
+	VersionRequestCommandType:     SimpleCommand{},
+	VersionReplyCommandType:       VersionIndication{},
+	ErrorReplyCommandType:         ErrorReply{},
+	EncryptedCommandType:          EncryptedCommand{},
+	ConnectionStateCommandType:    ConnectionState{},
+	PresenceRequestCommandType:    PresenceRequest{},
+	PresenceCommandType:           []Presence{},
+	PairingRequestCommandType:     PairingRequest{},
+	PairingCommandType:            Pairing{},
+	DeliveryReportCommandType:     DeliveryReport{},
+}
+
+func init() {
+	for id, name := range builtinCommandTypes {
+		register(id, name, builtinPayloads[id])
+	}
+}
+
+func register(id CommandType, name string, payload interface{}) {
+	info := CommandTypeInfo{ID: id, Name: name}
+	if payload != nil {
+		info.Payload = reflect.TypeOf(payload)
+	}
+	commandTypes.byID[id] = info
+	commandTypes.byName[name] = id
+}
+
+// RegisterCommandType adds a command type with a stable id and an unique name.
+// The id must not be lower than FirstCustomCommandType, payload is optional and
+// it is an instance of the type carried as command data (see Command.Payload).
+// Messages with unregistered types are still routed using their numeric id
+func RegisterCommandType(id CommandType, name string, payload interface{}) error {
+	if id < FirstCustomCommandType {
+		return fmt.Errorf("command type id %d is reserved, custom ids start from %d", id, FirstCustomCommandType)
+	}
+	if name == "" {
+		return fmt.Errorf("command type %d has no name", id)
+	}
+
+	commandTypes.Lock()
+	defer commandTypes.Unlock()
+	if existing, ok := commandTypes.byID[id]; ok {
+		return fmt.Errorf("command type id %d is already registered as %s", id, existing.Name)
+	}
+	if existing, ok := commandTypes.byName[name]; ok {
+		return fmt.Errorf("command type %s is already registered with id %d", name, existing)
+	}
+	register(id, name, payload)
+	return nil
+}
+
+// MustRegisterCommandType is like RegisterCommandType but panics on errors, it returns the given id.
+// It allows to declare command types as package variables:
+//
+//	var MyCommandType = types.MustRegisterCommandType(200, "MyCommandType", MyCommand{})
+func MustRegisterCommandType(id CommandType, name string, payload interface{}) CommandType {
+	if err := RegisterCommandType(id, name, payload); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// CommandTypeByName returns the command type registered with the given name
+func CommandTypeByName(name string) (CommandType, bool) {
+	commandTypes.RLock()
+	defer commandTypes.RUnlock()
+	id, ok := commandTypes.byName[name]
+	return id, ok
+}
+
+// CommandTypes returns every known command type sorted by id
+func CommandTypes() []CommandTypeInfo {
+	commandTypes.RLock()
+	defer commandTypes.RUnlock()
+	result := make([]CommandTypeInfo, 0, len(commandTypes.byID))
+	for _, info := range commandTypes.byID {
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// Info returns the description of the command type, false if it is not registered
+func (i CommandType) Info() (CommandTypeInfo, bool) {
+	commandTypes.RLock()
+	defer commandTypes.RUnlock()
+	info, ok := commandTypes.byID[i]
+	return info, ok
+}
+
+func (i CommandType) String() string {
+	if info, ok := i.Info(); ok {
+		return info.Name
+	}
+	return "CommandType(" + strconv.FormatInt(int64(i), 10) + ")"
+}
+
+// Payload decodes the command data into a new instance of the payload type registered for the command type
+func (c *Command) Payload() (interface{}, error) {
+	info, ok := c.Type.Info()
+	if !ok || info.Payload == nil {
+		return nil, fmt.Errorf("no payload type registered for %v", c.Type)
+	}
+	payload := reflect.New(info.Payload)
+	if err := json.Unmarshal(c.Data, payload.Interface()); err != nil {
+		return nil, err
+	}
+	return payload.Elem().Interface(), nil
+}
@@ -0,0 +1,53 @@
+package types
+
+import (
+	"testing"
+)
+
+type customPayload struct {
+	Value string `json:"value"`
+}
+
+func TestBuiltinCommandTypes(t *testing.T) {
+	for id := CommandType(0); id < messageBound; id++ {
+		if _, ok := id.Info(); !ok {
+			t.Errorf("Command type %d has no name", id)
+		}
+	}
+	if DigitalCommandType.String() != "DigitalCommandType" {
+		t.Errorf("Unexpected name: %s", DigitalCommandType)
+	}
+}
+
+func TestRegisterCommandType(t *testing.T) {
+	if err := RegisterCommandType(messageBound, "Reserved", nil); err == nil {
+		t.Error("Registering a reserved id must fail")
+	}
+
+	custom := MustRegisterCommandType(FirstCustomCommandType+10, "CustomCommandType", customPayload{})
+	if err := RegisterCommandType(custom, "Other", nil); err == nil {
+		t.Error("Registering an id twice must fail")
+	}
+	if err := RegisterCommandType(custom+1, "CustomCommandType", nil); err == nil {
+		t.Error("Registering a name twice must fail")
+	}
+	if custom.String() != "CustomCommandType" {
+		t.Errorf("Unexpected name: %s", custom)
+	}
+	if id, ok := CommandTypeByName("CustomCommandType"); !ok || id != custom {
+		t.Errorf("Lookup by name failed: %v", id)
+	}
+
+	payload, err := NewCommand(custom, customPayload{"hello"}).Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.(customPayload).Value != "hello" {
+		t.Errorf("Unexpected payload: %v", payload)
+	}
+
+	unknown := custom + 1
+	if unknown.String() != "CommandType(139)" {
+		t.Errorf("Unexpected name for an unknown type: %s", unknown)
+	}
+}